@@ -50,6 +50,10 @@ type AppConfig struct {
 		DevTeam      string `mapstructure:"dev_team"`
 		Enable       bool   `mapstructure:"enable"`
 		TemplatePath string `mapstructure:"template_path"`
+
+		ResetPasswordURL    string `mapstructure:"reset_password_url"`
+		VerifyMailURL       string `mapstructure:"verify_mail_url"`
+		RequireVerification bool   `mapstructure:"require_verification"`
 	} `mapstructure:"mail"`
 
 	SearchFeed struct {
@@ -88,12 +92,95 @@ type AppConfig struct {
 		PointStatus           map[string]int `mapstructure:"point_status"`
 		HotTagsWeight         map[string]int `mapstructure:"hot_tags_wieght"`
 		Promotions            map[string]int `mapstructure:"promotions"`
+		MemberRole            map[string]int `mapstructure:"member_role"`
 	} `mapstructure:"models"`
 
 	ReadrID      int    `mapstructure:"readr_id"`
 	DefaultOrder int    `mapstructure:"default_order"`
 	DomainName   string `mapstructure:"domain_name"`
 	TokenSecret  string `mapstructure:"token_secret"`
+	// Store is where members are kept, mysql by default, or memory for tests and local development without MySQL and Redis
+	Store string `mapstructure:"store"`
+
+	IdentityProviders []string `mapstructure:"identity_providers"`
+	// RoleScopes maps names in models.member_role to the scopes they are granted
+	RoleScopes map[string][]string `mapstructure:"role_scopes"`
+	// FieldPresets names lists of member fields, to be asked for by name in fields
+	FieldPresets map[string][]string `mapstructure:"field_presets"`
+
+	PasswordPolicy struct {
+		MinLength           int    `mapstructure:"min_length"`
+		MaxLength           int    `mapstructure:"max_length"`
+		RequireLower        bool   `mapstructure:"require_lower"`
+		RequireUpper        bool   `mapstructure:"require_upper"`
+		RequireDigit        bool   `mapstructure:"require_digit"`
+		RequireSymbol       bool   `mapstructure:"require_symbol"`
+		MinCharacterClasses int    `mapstructure:"min_character_classes"`
+		RejectPersonalInfo  bool   `mapstructure:"reject_personal_info"`
+		BlacklistPath       string `mapstructure:"blacklist_path"`
+	} `mapstructure:"password_policy"`
+
+	Lockout struct {
+		Enable          bool `mapstructure:"enable"`
+		MemberThreshold int  `mapstructure:"member_threshold"`
+		IPThreshold     int  `mapstructure:"ip_threshold"`
+		BaseDelay       int  `mapstructure:"base_delay"`
+		MaxDelay        int  `mapstructure:"max_delay"`
+		Window          int  `mapstructure:"window"`
+	} `mapstructure:"lockout"`
+
+	TwoFactor struct {
+		Issuer        string `mapstructure:"issuer"`
+		Skew          int    `mapstructure:"skew"`
+		RecoveryCodes int    `mapstructure:"recovery_codes"`
+		RequiredRole  int    `mapstructure:"required_role"`
+	} `mapstructure:"two_factor"`
+
+	// Purge erases members deleted for longer than GracePeriod seconds, BatchSize members at a time,
+	// every Interval seconds. The job doesn't run with Interval 0.
+	Purge struct {
+		GracePeriod int `mapstructure:"grace_period"`
+		BatchSize   int `mapstructure:"batch_size"`
+		Interval    int `mapstructure:"interval"`
+	} `mapstructure:"purge"`
+
+	// Export builds archives of members with at most SyncLimit audit records in the request,
+	// and larger ones in background, at most Workers at once. Archives are downloadable for TTL seconds.
+	Export struct {
+		SyncLimit int `mapstructure:"sync_limit"`
+		TTL       int `mapstructure:"ttl"`
+		Workers   int `mapstructure:"workers"`
+	} `mapstructure:"export"`
+
+	// Timeout bounds requests to Default seconds, or those in Routes keyed by method and route in lowercase,
+	// such as "get /member/:id/export". Requests aren't bounded with 0.
+	Timeout struct {
+		Default int            `mapstructure:"default"`
+		Routes  map[string]int `mapstructure:"routes"`
+	} `mapstructure:"timeout"`
+
+	PasswordHash struct {
+		Algorithm string `mapstructure:"algorithm"`
+		Argon2    struct {
+			Memory  uint32 `mapstructure:"memory"`
+			Time    uint32 `mapstructure:"time"`
+			Threads uint8  `mapstructure:"threads"`
+		} `mapstructure:"argon2"`
+		Scrypt struct {
+			LogN int `mapstructure:"ln"`
+			R    int `mapstructure:"r"`
+			P    int `mapstructure:"p"`
+		} `mapstructure:"scrypt"`
+	} `mapstructure:"password_hash"`
+
+	Token struct {
+		Issuer           string `mapstructure:"issuer"`
+		Audience         string `mapstructure:"audience"`
+		AccessTTL        int    `mapstructure:"access_ttl"`
+		RefreshTTL       int    `mapstructure:"refresh_ttl"`
+		PasswordResetTTL int    `mapstructure:"password_reset_ttl"`
+		VerifyMailTTL    int    `mapstructure:"verify_mail_ttl"`
+	} `mapstructure:"token"`
 
 	PaymentService struct {
 		PartnerKey         string `mapstructure:"partner_key"`
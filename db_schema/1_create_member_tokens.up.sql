@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `member_tokens` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `member_id` bigint(20) NOT NULL,
+  `purpose` varchar(32) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `purpose_token_hash` (`purpose`,`token_hash`),
+  KEY `member_purpose` (`member_id`,`purpose`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
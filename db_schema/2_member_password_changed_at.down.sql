@@ -0,0 +1 @@
+ALTER TABLE members DROP `password_changed_at`;
@@ -0,0 +1 @@
+ALTER TABLE members ADD `password_changed_at` datetime DEFAULT NULL;
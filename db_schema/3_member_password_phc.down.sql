@@ -0,0 +1 @@
+ALTER TABLE members MODIFY `password` binary(64) DEFAULT NULL;
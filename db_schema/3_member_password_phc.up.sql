@@ -0,0 +1 @@
+ALTER TABLE members MODIFY `password` varbinary(255) DEFAULT NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `member_recovery_codes`;
+DROP TABLE IF EXISTS `member_two_factor`;
+ALTER TABLE members DROP `two_factor_enabled`;
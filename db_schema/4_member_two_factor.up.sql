@@ -0,0 +1,21 @@
+ALTER TABLE members ADD `two_factor_enabled` tinyint(1) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS `member_two_factor` (
+  `member_id` bigint(20) NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `last_used_step` bigint(20) NOT NULL DEFAULT 0,
+  `enabled_at` datetime DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`member_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `member_recovery_codes` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `member_id` bigint(20) NOT NULL,
+  `code_hash` varbinary(64) NOT NULL,
+  `salt` varbinary(32) NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `member_id` (`member_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
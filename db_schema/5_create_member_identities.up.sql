@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS `member_identities` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `member_id` bigint(20) NOT NULL,
+  `provider` varchar(32) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `provider_subject` (`provider`,`subject`),
+  UNIQUE KEY `member_provider` (`member_id`,`provider`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO member_identities (member_id, provider, subject, created_at)
+  SELECT id, register_mode, COALESCE(NULLIF(social_id, ''), member_id), COALESCE(created_at, NOW())
+  FROM members
+  WHERE register_mode IN ('oauth-fb', 'oauth-goo');
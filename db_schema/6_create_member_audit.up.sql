@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `member_audit` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `member_id` bigint(20) NOT NULL,
+  `actor_id` bigint(20) DEFAULT NULL,
+  `action` varchar(32) NOT NULL,
+  `changes` text,
+  `request_id` varchar(64) DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `member_action` (`member_id`,`action`),
+  KEY `actor_id` (`actor_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
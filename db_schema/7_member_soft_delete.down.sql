@@ -0,0 +1 @@
+ALTER TABLE members DROP KEY `active_deleted_at`, DROP `prev_active`, DROP `deleted_at`;
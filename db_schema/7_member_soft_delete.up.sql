@@ -0,0 +1,4 @@
+ALTER TABLE members ADD `deleted_at` datetime DEFAULT NULL, ADD `prev_active` int(11) DEFAULT NULL, ADD KEY `active_deleted_at` (`active`, `deleted_at`);
+
+-- Members deleted before are regarded as deleted when they were last updated
+UPDATE members SET deleted_at = COALESCE(updated_at, NOW()) WHERE active = -1;
@@ -0,0 +1 @@
+ALTER TABLE members DROP `anonymized_at`;
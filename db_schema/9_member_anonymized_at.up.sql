@@ -0,0 +1 @@
+ALTER TABLE members ADD `anonymized_at` datetime DEFAULT NULL;
@@ -4,12 +4,15 @@ go 1.14
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
-	github.com/gin-gonic/gin v1.6.2
+	github.com/garyburd/redigo v1.6.0
+	github.com/gin-gonic/gin v1.7.7
 	github.com/go-sql-driver/mysql v1.4.1
+	github.com/golang-jwt/jwt/v4 v4.3.0
 	github.com/golang-migrate/migrate v3.5.4+incompatible
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/prometheus/client_golang v0.9.3
 	github.com/readr-media/readr-restful v0.0.0-20200227100724-794e60171429
 	github.com/spf13/viper v1.6.2
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/crypto v0.0.0-20190418165655-df01cb2cc480
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,129 @@
+// Package apierror defines errors responded by APIs. Every error has a code for clients to tell errors apart,
+// and a kind deciding the HTTP status it is responded with.
+package apierror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// Kind classifies errors by how clients could handle them
+type Kind int
+
+const (
+	// Internal errors are failures of the server, or anything not made by this package
+	Internal Kind = iota
+	Invalid
+	Unauthorized
+	Forbidden
+	NotFound
+	Conflict
+	Gone
+	Unprocessable
+	TooManyRequests
+	Timeout
+)
+
+var statuses = map[Kind]int{
+	Internal:        http.StatusInternalServerError,
+	Invalid:         http.StatusBadRequest,
+	Unauthorized:    http.StatusUnauthorized,
+	Forbidden:       http.StatusForbidden,
+	NotFound:        http.StatusNotFound,
+	Conflict:        http.StatusConflict,
+	Gone:            http.StatusGone,
+	Unprocessable:   http.StatusUnprocessableEntity,
+	TooManyRequests: http.StatusTooManyRequests,
+	Timeout:         http.StatusGatewayTimeout,
+}
+
+// Error is an error responded to clients. Message is shown as it is, while the cause in Err is only logged.
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	// Details are anything more for clients to fix the request, such as violated rules
+	Details interface{}
+	Err     error
+}
+
+var (
+	ErrInternal = New(Internal, "internal_error", "Internal Server Error")
+	ErrTimeout  = New(Timeout, "timeout", "Gateway Timeout")
+	ErrNotFound = New(NotFound, "not_found", "Item Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrConflict = New(Conflict, "duplicate_entry", "Duplicate Entry").Wrap(rrsql.DuplicateError)
+)
+
+// New makes an error of kind, to be declared once and returned wherever it happens
+func New(kind Kind, code string, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an Error of the same code, so copies made by Wrap and WithDetails match their origin
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Status returns the HTTP status e is responded with
+func (e *Error) Status() int {
+	if status, ok := statuses[e.Kind]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Wrap returns a copy of e caused by err
+func (e *Error) Wrap(err error) *Error {
+	copied := *e
+	copied.Err = err
+	return &copied
+}
+
+// WithDetails returns a copy of e with details
+func (e *Error) WithDetails(details interface{}) *Error {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+// BadRequest makes err, a failure to parse or validate a request, an Invalid error of code showing the message of err.
+// Errors made by this package are kept as they are.
+func BadRequest(code string, err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Kind: Invalid, Code: code, Message: err.Error(), Err: err}
+}
+
+// From returns err as an Error. Missing and duplicate rows of rrsql and timeouts are told apart,
+// other errors are internal.
+func From(err error) *Error {
+	var e *Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, rrsql.ItemNotFoundError):
+		return ErrNotFound.Wrap(err)
+	case errors.Is(err, rrsql.DuplicateError):
+		return ErrConflict.Wrap(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout.Wrap(err)
+	default:
+		return ErrInternal.Wrap(err)
+	}
+}
@@ -0,0 +1,47 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrom(t *testing.T) {
+	notFound := New(NotFound, "user_not_found", "User Not Found").Wrap(rrsql.ItemNotFoundError)
+	dbErr := errors.New("connection refused")
+	for _, tc := range []struct {
+		name   string
+		err    error
+		code   string
+		status int
+	}{
+		{"Typed", notFound, "user_not_found", http.StatusNotFound},
+		{"TypedWrapped", fmt.Errorf("get member: %w", notFound), "user_not_found", http.StatusNotFound},
+		{"ItemNotFound", rrsql.ItemNotFoundError, "not_found", http.StatusNotFound},
+		{"Duplicate", rrsql.DuplicateError, "duplicate_entry", http.StatusConflict},
+		{"Deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), "timeout", http.StatusGatewayTimeout},
+		{"Untyped", dbErr, "internal_error", http.StatusInternalServerError},
+	} {
+		e := From(tc.err)
+		assert.Equal(t, tc.code, e.Code, tc.name)
+		assert.Equal(t, tc.status, e.Status(), tc.name)
+	}
+	assert.Nil(t, From(nil))
+	assert.Equal(t, "Internal Server Error", From(dbErr).Message)
+	assert.True(t, errors.Is(From(dbErr), dbErr))
+}
+
+func TestIs(t *testing.T) {
+	notFound := New(NotFound, "user_not_found", "User Not Found").Wrap(rrsql.ItemNotFoundError)
+	assert.True(t, errors.Is(notFound.WithDetails("id"), notFound))
+	assert.True(t, errors.Is(notFound.Wrap(errors.New("no rows")), notFound))
+	assert.True(t, errors.Is(notFound, rrsql.ItemNotFoundError))
+	assert.False(t, errors.Is(notFound, New(NotFound, "export_not_found", "Export Not Found")))
+	assert.Equal(t, "Invalid sort: size", BadRequest("invalid_query", errors.New("Invalid sort: size")).Message)
+	assert.Equal(t, notFound, BadRequest("invalid_query", notFound))
+}
@@ -0,0 +1,93 @@
+package lockout
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/readr-media/readr-restful-member/config"
+)
+
+// Record keeps failed attempts of a key, such as a member or a client IP
+type Record struct {
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked reports whether the record is locked at now
+func (r Record) Locked(now time.Time) bool {
+	return now.Before(r.LockedUntil)
+}
+
+// Store persists records. Records expire after a window without failures.
+type Store interface {
+	Get(key string) (Record, error)
+	// Fail atomically adds one failure to key and returns the updated record
+	Fail(key string, window time.Duration) (Record, error)
+	Lock(key string, until time.Time, window time.Duration) error
+	Clear(key string) error
+}
+
+var DefaultStore Store = new(redisStore)
+
+func MemberKey(id int64) string {
+	return fmt.Sprintf("lockout:member:%d", id)
+}
+
+// UnknownKey is the key of an identifier matching no member, such as a mail not registered
+func UnknownKey(idType string, id string) string {
+	return fmt.Sprintf("lockout:unknown:%s:%s", idType, id)
+}
+
+func IPKey(ip string) string {
+	return fmt.Sprintf("lockout:ip:%s", ip)
+}
+
+// Check returns the record of key.
+// Lockout fails open, store errors are logged and regarded as no record,
+// so logins still work while Redis is down.
+func Check(key string) Record {
+	if !config.Config.Lockout.Enable {
+		return Record{}
+	}
+	r, err := DefaultStore.Get(key)
+	if err != nil {
+		log.Printf("Error getting lockout record %s: %v\n", key, err)
+		return Record{}
+	}
+	return r
+}
+
+// Fail records a failed attempt of key. Once failures reach threshold, key is locked for
+// BaseDelay seconds, doubled on every further failure up to MaxDelay.
+func Fail(key string, threshold int) Record {
+	if !config.Config.Lockout.Enable {
+		return Record{}
+	}
+	window := time.Duration(config.Config.Lockout.Window) * time.Second
+	r, err := DefaultStore.Fail(key, window)
+	if err != nil {
+		log.Printf("Error recording lockout failure %s: %v\n", key, err)
+		return Record{}
+	}
+	if threshold <= 0 || r.Failures < threshold {
+		return r
+	}
+
+	delay := float64(config.Config.Lockout.BaseDelay) * math.Pow(2, float64(r.Failures-threshold))
+	delay = math.Min(delay, float64(config.Config.Lockout.MaxDelay))
+	r.LockedUntil = time.Now().Add(time.Duration(delay) * time.Second)
+	if err = DefaultStore.Lock(key, r.LockedUntil, window); err != nil {
+		log.Printf("Error locking %s: %v\n", key, err)
+	}
+	return r
+}
+
+// Clear forgets failures and lock of key
+func Clear(key string) error {
+	if !config.Config.Lockout.Enable {
+		return nil
+	}
+	return DefaultStore.Clear(key)
+}
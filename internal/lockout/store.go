@@ -0,0 +1,135 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/readr-media/readr-restful-member/internal/rrredis"
+)
+
+// redisStore keeps every record in a hash of fields failures and locked_until, in unix seconds
+type redisStore struct{}
+
+func (s *redisStore) Get(key string) (r Record, err error) {
+	conn := rrredis.RedisHelper.ReadConn()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("HMGET", key, "failures", "locked_until"))
+	if err != nil {
+		return Record{}, err
+	}
+	var lockedUntil int64
+	if _, err = redis.Scan(values, &r.Failures, &lockedUntil); err != nil {
+		return Record{}, err
+	}
+	if lockedUntil > 0 {
+		r.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	return r, nil
+}
+
+func (s *redisStore) Fail(key string, window time.Duration) (r Record, err error) {
+	conn := rrredis.RedisHelper.WriteConn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, "failures", 1)
+	conn.Send("HGET", key, "locked_until")
+	conn.Send("EXPIRE", key, int(window.Seconds()))
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return Record{}, err
+	}
+	var lockedUntil int64
+	if _, err = redis.Scan(values, &r.Failures, &lockedUntil); err != nil {
+		return Record{}, err
+	}
+	if lockedUntil > 0 {
+		r.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	return r, nil
+}
+
+func (s *redisStore) Lock(key string, until time.Time, window time.Duration) error {
+	conn := rrredis.RedisHelper.WriteConn()
+	defer conn.Close()
+
+	// Keep the record at least until the lock is over
+	if ttl := time.Until(until); ttl > window {
+		window = ttl
+	}
+	conn.Send("MULTI")
+	conn.Send("HSET", key, "locked_until", until.Unix())
+	conn.Send("EXPIRE", key, int(window.Seconds()))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *redisStore) Clear(key string) error {
+	conn := rrredis.RedisHelper.WriteConn()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// MemoryStore keeps records in memory, for tests and single instance deployments
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	Record
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]memoryRecord)}
+}
+
+// get returns the unexpired record of key. Callers hold the lock.
+func (s *MemoryStore) get(key string) memoryRecord {
+	r, ok := s.records[key]
+	if !ok || time.Now().After(r.expiresAt) {
+		delete(s.records, key)
+		return memoryRecord{}
+	}
+	return r
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key).Record, nil
+}
+
+func (s *MemoryStore) Fail(key string, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.get(key)
+	r.Failures++
+	r.expiresAt = time.Now().Add(window)
+	s.records[key] = r
+	return r.Record, nil
+}
+
+func (s *MemoryStore) Lock(key string, until time.Time, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.get(key)
+	r.LockedUntil = until
+	if r.expiresAt = time.Now().Add(window); until.After(r.expiresAt) {
+		r.expiresAt = until
+	}
+	s.records[key] = r
+	return nil
+}
+
+func (s *MemoryStore) Clear(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,106 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/mail"
+	"path/filepath"
+	"sync"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/utils"
+)
+
+type MailArgs struct {
+	Receiver []string `json:"receiver"`
+	CC       []string `json:"cc"`
+	BCC      []string `json:"bcc"`
+	Subject  string   `json:"subject"`
+	Payload  string   `json:"content"`
+}
+
+// Sender delivers mails. MailAPI could be replaced with an Outbox in tests.
+type Sender interface {
+	Send(args MailArgs) error
+}
+
+type mailAPI struct{}
+
+var MailAPI Sender = new(mailAPI)
+
+// Send posts the mail to the mail service at Mail.Host.
+// Mails are only logged if Mail.Enable is false.
+func (m *mailAPI) Send(args MailArgs) error {
+
+	if !config.Config.Mail.Enable {
+		log.Printf("Mail disabled, skip sending %q to %v\n", args.Subject, args.Receiver)
+		return nil
+	}
+
+	from := mail.Address{Name: config.Config.Mail.UserName, Address: config.Config.Mail.User}
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"user":     config.Config.Mail.User,
+		"password": config.Config.Mail.Password,
+		"from":     from.String(),
+		"to":       args.Receiver,
+		"cc":       args.CC,
+		"bcc":      args.BCC,
+		"subject":  args.Subject,
+		"body":     args.Payload,
+	})
+
+	resp, body, err := utils.HTTPRequest("POST", config.Config.Mail.Host, map[string]string{}, reqBody)
+	if err != nil {
+		log.Printf("Send mail error: %v\n", err)
+		return err
+	}
+	if resp.StatusCode != 200 {
+		log.Printf("Send mail error: %v, status_code: %v", string(body), resp.StatusCode)
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// Render executes the html template named name under Mail.TemplatePath with data
+func Render(name string, data interface{}) (string, error) {
+	t, err := template.ParseFiles(filepath.Join(config.Config.Mail.TemplatePath, name))
+	if err != nil {
+		return "", fmt.Errorf("Parse mail template %s error: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Outbox is a Sender keeping mails in memory instead of sending them
+type Outbox struct {
+	mu    sync.Mutex
+	Mails []MailArgs
+}
+
+func (o *Outbox) Send(args MailArgs) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Mails = append(o.Mails, args)
+	return nil
+}
+
+// Last returns the latest mail sent to receiver
+func (o *Outbox) Last(receiver string) (MailArgs, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := len(o.Mails) - 1; i >= 0; i-- {
+		for _, r := range o.Mails[i].Receiver {
+			if r == receiver {
+				return o.Mails[i], true
+			}
+		}
+	}
+	return MailArgs{}, false
+}
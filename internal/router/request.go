@@ -0,0 +1,38 @@
+package router
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/readr-media/readr-restful-member/internal/utils"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// Request IDs from upstream are kept only if they are short and plain enough to log and store
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID takes X-Request-ID from upstream, or generates one, and echoes it in the response,
+// so a request could be traced across logs, audit trail and other services.
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		uuid, err := utils.NewUUIDv4()
+		if err != nil {
+			c.Next()
+			return
+		}
+		id = uuid.String()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(RequestIDHeader, id)
+	c.Next()
+}
+
+// GetRequestID returns the ID of request set by RequestID, or empty string without the middleware
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
@@ -1,6 +1,74 @@
 package router
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/readr-media/readr-restful-member/internal/apierror"
+)
+
 // ResponseMeta stores the information about response
 type ResponseMeta struct {
 	Total *int `json:"total,omitempty"`
+	// NextCursor and PrevCursor are given to fetch pages after and before the current one
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// ErrorResponse is the body of every error responded, with the ID of request to trace it in logs
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// newErrorResponse returns the body responding e to request of c
+func newErrorResponse(c *gin.Context, e *apierror.Error) ErrorResponse {
+	return ErrorResponse{Code: e.Code, Message: e.Message, Details: e.Details, RequestID: GetRequestID(c)}
+}
+
+// RespondError responds err with the status of its kind and aborts the rest of handlers.
+// Internal errors are logged, and responded without telling the cause.
+func RespondError(c *gin.Context, err error) {
+	e := apierror.From(err)
+	if e.Kind == apierror.Internal {
+		log.Printf("Error in %s %s, request %s: %v\n", c.Request.Method, c.FullPath(), GetRequestID(c), err)
+	}
+	c.AbortWithStatusJSON(e.Status(), newErrorResponse(c, e))
+}
+
+// CacheableJSON responds obj as JSON with an ETag of its content, or 304 without body if the client
+// has the same content already, told by If-None-Match. Caches have to revalidate it every time.
+func CacheableJSON(c *gin.Context, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		RespondError(c, err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatch(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// etagMatch reports whether etag is one of ETags listed in If-None-Match, compared weakly
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
 }
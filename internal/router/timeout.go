@@ -0,0 +1,70 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/readr-media/readr-restful-member/internal/apierror"
+)
+
+// Timeout bounds the context of each request, by the timeout in routes keyed by method and route in lowercase
+// such as "get /member/:id/export", or defaultTimeout for other routes. Requests aren't bounded with 0.
+// Handlers are expected to give up once the context is done. Server errors they respond after the deadline
+// are turned into apierror.ErrTimeout, so clients could tell timeouts from other failures.
+func Timeout(defaultTimeout time.Duration, routes map[string]time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout, ok := routes[strings.ToLower(c.Request.Method+" "+c.FullPath())]
+		if !ok {
+			timeout = defaultTimeout
+		}
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		body, _ := json.Marshal(newErrorResponse(c, apierror.ErrTimeout))
+		c.Writer = &timeoutWriter{ResponseWriter: c.Writer, ctx: ctx, body: body}
+		c.Next()
+	}
+}
+
+// timeoutWriter writes body with 504 in place of server errors written after ctx is past its deadline,
+// and discards the body of such errors
+type timeoutWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	body     []byte
+	timedOut bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if code < http.StatusInternalServerError || code == http.StatusGatewayTimeout ||
+		w.ctx.Err() != context.DeadlineExceeded || w.Written() {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.timedOut = true
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	w.ResponseWriter.Write(w.body)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	if w.timedOut {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,42 @@
+package rrredis
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type redisHelper struct {
+	readPool  *redis.Pool
+	writePool *redis.Pool
+}
+
+var RedisHelper = redisHelper{}
+
+func (r *redisHelper) ReadConn() redis.Conn {
+	return r.readPool.Get()
+}
+
+func (r *redisHelper) WriteConn() redis.Conn {
+	return r.writePool.Get()
+}
+
+// Connect sets up connection pools to the read and write Redis endpoints
+func Connect(readURL string, writeURL string, password string) {
+	RedisHelper = redisHelper{
+		readPool: &redis.Pool{
+			MaxIdle:     30,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", readURL, redis.DialPassword(password))
+			},
+		},
+		writePool: &redis.Pool{
+			MaxIdle:     30,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", writeURL, redis.DialPassword(password))
+			},
+		},
+	}
+}
@@ -0,0 +1,166 @@
+package rrsql
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Cursor is a position in rows sorted by Sort, made of values of sort keys of the row next to it.
+// Rows after the position come next, or those before it for Backward cursors of previous pages.
+type Cursor struct {
+	Sort     string        `json:"s"`
+	Values   []interface{} `json:"v"`
+	Backward bool          `json:"b,omitempty"`
+}
+
+// NewCursor makes a cursor at row, columns mapped to values, sorted by keys parsed from sort
+func NewCursor(sort string, keys []SortKey, row map[string]interface{}, backward bool) Cursor {
+	c := Cursor{Sort: sort, Values: make([]interface{}, len(keys)), Backward: backward}
+	for i, k := range keys {
+		c.Values[i] = plainValue(row[k.Column])
+	}
+	return c
+}
+
+// Encode turns c into an opaque string to be given to clients
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses an encoded cursor of rows sorted by sort, which keys are parsed from.
+// Values are converted to the types of columns, so that they are compared the same way as columns.
+func DecodeCursor(encoded string, sort string, keys []SortKey, columns map[string]reflect.Type) (c Cursor, err error) {
+
+	invalid := errors.New("Invalid cursor")
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Cursor{}, invalid
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(&c); err != nil || c.Sort != sort || len(c.Values) != len(keys) {
+		return Cursor{}, invalid
+	}
+	for i, k := range keys {
+		t, ok := columns[k.Column]
+		if !ok {
+			return Cursor{}, invalid
+		}
+		if c.Values[i] == nil {
+			continue
+		}
+		if c.Values[i], err = scalarOperand(t, c.Values[i]); err != nil {
+			return Cursor{}, invalid
+		}
+	}
+	return c, nil
+}
+
+// directions returns keys in the order rows are fetched from c, reversed for backward cursors
+func (c Cursor) directions(keys []SortKey) []SortKey {
+	if !c.Backward {
+		return keys
+	}
+	return ReverseSort(keys)
+}
+
+// ReverseSort returns keys in the opposite order, to fetch rows before a position
+func ReverseSort(keys []SortKey) []SortKey {
+	reversed := make([]SortKey, len(keys))
+	for i, k := range keys {
+		reversed[i] = SortKey{Column: k.Column, Desc: !k.Desc}
+	}
+	return reversed
+}
+
+// KeysetRestricts turns c into a condition with placeholders and its values, matching rows after c
+// on columns of table, in the order of keys fetched with ORDER BY of ReverseSort for backward cursors.
+// NULL comes before any value, the way MySQL sorts it.
+func KeysetRestricts(c Cursor, keys []SortKey, table string) (restricts string, values []interface{}) {
+
+	terms := []string{}
+	for i, k := range c.directions(keys) {
+		column := k.Column
+		if table != "" {
+			column = table + "." + k.Column
+		}
+		equals, equalValues := []string{}, []interface{}{}
+		for j := 0; j < i; j++ {
+			prior := keys[j].Column
+			if table != "" {
+				prior = table + "." + prior
+			}
+			equals = append(equals, prior+" <=> ?")
+			equalValues = append(equalValues, c.Values[j])
+		}
+		switch {
+		case !k.Desc && c.Values[i] == nil:
+			equals = append(equals, column+" IS NOT NULL")
+		case !k.Desc:
+			equals = append(equals, column+" > ?")
+			equalValues = append(equalValues, c.Values[i])
+		case c.Values[i] == nil:
+			// Nothing comes after NULL in descending order
+			continue
+		default:
+			equals = append(equals, fmt.Sprintf("(%s < ? OR %s IS NULL)", column, column))
+			equalValues = append(equalValues, c.Values[i])
+		}
+		terms = append(terms, "("+strings.Join(equals, " AND ")+")")
+		values = append(values, equalValues...)
+	}
+	if len(terms) == 0 {
+		return "FALSE", nil
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", values
+}
+
+// Follows reports whether row, columns mapped to values, comes after c in the order of keys.
+// It is for data kept out of MySQL, like Filter.Match.
+func (c Cursor) Follows(keys []SortKey, row map[string]interface{}) bool {
+	position := make(map[string]interface{}, len(keys))
+	for i, k := range keys {
+		position[k.Column] = c.Values[i]
+	}
+	return CompareRows(c.directions(keys), row, position) > 0
+}
+
+// CompareRows compares rows a and b, columns mapped to values, in the order of keys.
+// NULL comes before any value, and strings are compared case insensitively, the way MySQL sorts them.
+func CompareRows(keys []SortKey, a, b map[string]interface{}) int {
+	for _, k := range keys {
+		va, vb := plainValue(a[k.Column]), plainValue(b[k.Column])
+		c := 0
+		switch {
+		case va == nil && vb == nil:
+		case va == nil:
+			c = -1
+		case vb == nil:
+			c = 1
+		default:
+			c, _ = compareValues(va, vb)
+		}
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// plainValue returns the value of v stored in MySQL, with nil for NULL
+func plainValue(v interface{}) interface{} {
+	if valuer, ok := v.(driver.Valuer); ok {
+		v, _ = valuer.Value()
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package rrsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	columns := FilterColumns(filterModel{}, "id", "points", "gender", "birthday")
+	birthday := time.Date(2001, 1, 3, 0, 0, 0, 0, time.UTC)
+	row := map[string]interface{}{
+		"id":       int64(7),
+		"points":   NullInt{Int: 100, Valid: true},
+		"gender":   NullString{},
+		"birthday": NullTime{Time: birthday, Valid: true},
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		keys, _ := ParseSort("-birthday,gender", []string{"id", "gender", "birthday"}, "id")
+		c, err := DecodeCursor(NewCursor("-birthday,gender", keys, row, true).Encode(), "-birthday,gender", keys, columns)
+		assert.Nil(t, err)
+		assert.Equal(t, Cursor{Sort: "-birthday,gender", Values: []interface{}{birthday, nil, int64(7)}, Backward: true}, c)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		keys, _ := ParseSort("points", []string{"id", "points"}, "id")
+		encoded := NewCursor("points", keys, row, false).Encode()
+		for _, tc := range []struct {
+			name    string
+			encoded string
+			sort    string
+		}{
+			{"NotBase64", "!!!", "points"},
+			{"NotJSON", "bm90IGpzb24", "points"},
+			{"OtherSort", encoded, "-points"},
+			{"WrongType", NewCursor("points", keys, map[string]interface{}{"points": "many", "id": 7}, false).Encode(), "points"},
+		} {
+			_, err := DecodeCursor(tc.encoded, tc.sort, keys, columns)
+			assert.EqualError(t, err, "Invalid cursor", tc.name)
+		}
+	})
+}
+
+func TestKeysetRestricts(t *testing.T) {
+	keys := []SortKey{{Column: "points", Desc: true}, {Column: "gender"}, {Column: "id"}}
+	for _, tc := range []struct {
+		name      string
+		cursor    Cursor
+		restricts string
+		values    []interface{}
+	}{
+		{"Forward", Cursor{Values: []interface{}{int64(100), "F", int64(7)}},
+			"(((members.points < ? OR members.points IS NULL)) OR (members.points <=> ? AND members.gender > ?) OR (members.points <=> ? AND members.gender <=> ? AND members.id > ?))",
+			[]interface{}{int64(100), int64(100), "F", int64(100), "F", int64(7)}},
+		{"ForwardNull", Cursor{Values: []interface{}{nil, nil, int64(7)}},
+			"((members.points <=> ? AND members.gender IS NOT NULL) OR (members.points <=> ? AND members.gender <=> ? AND members.id > ?))",
+			[]interface{}{nil, nil, nil, int64(7)}},
+		{"Backward", Cursor{Values: []interface{}{nil, "F", int64(7)}, Backward: true},
+			"((members.points IS NOT NULL) OR (members.points <=> ? AND (members.gender < ? OR members.gender IS NULL)) OR (members.points <=> ? AND members.gender <=> ? AND (members.id < ? OR members.id IS NULL)))",
+			[]interface{}{nil, "F", nil, "F", int64(7)}},
+	} {
+		restricts, values := KeysetRestricts(tc.cursor, keys, "members")
+		assert.Equal(t, tc.restricts, restricts, tc.name)
+		assert.Equal(t, tc.values, values, tc.name)
+	}
+}
+
+func TestCursorFollows(t *testing.T) {
+	keys := []SortKey{{Column: "points", Desc: true}, {Column: "id"}}
+	rows := []map[string]interface{}{
+		{"id": int64(1), "points": NullInt{Int: 300, Valid: true}},
+		{"id": int64(2), "points": NullInt{Int: 100, Valid: true}},
+		{"id": int64(3), "points": NullInt{Int: 100, Valid: true}},
+		{"id": int64(4), "points": NullInt{}},
+	}
+	for _, tc := range []struct {
+		name    string
+		cursor  Cursor
+		follows []bool
+	}{
+		{"Forward", NewCursor("-points", keys, rows[1], false), []bool{false, false, true, true}},
+		{"Backward", NewCursor("-points", keys, rows[2], true), []bool{true, true, false, false}},
+		{"AfterNull", NewCursor("-points", keys, rows[3], false), []bool{false, false, false, false}},
+	} {
+		for i, row := range rows {
+			assert.Equal(t, tc.follows[i], tc.cursor.Follows(keys, row), "%s row %d", tc.name, i)
+		}
+	}
+}
@@ -107,18 +107,59 @@ func OperatorHelper(ops string) (result string) {
 	return result
 }
 
-func OrderByHelper(sortMethod string) (result string) {
-	// if strings.Contains(sortMethod, )
-	tmp := strings.Split(sortMethod, ",")
-	for i, v := range tmp {
-		if v := strings.TrimSpace(v); strings.HasPrefix(v, "-") {
-			tmp[i] = v[1:] + " DESC"
-		} else {
-			tmp[i] = v
+// SortKey is a column to sort by, in descending order if Desc
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+func (k SortKey) String() string {
+	if k.Desc {
+		return k.Column + " DESC"
+	}
+	return k.Column
+}
+
+// ParseSort parses sort, columns separated by comma and prefixed by "-" for descending order, such as "-updated_at,id".
+// Every column has to be one of columns, or an error naming it is returned.
+// tiebreaker, a unique column such as id, is appended in the order of the last key unless sorted by already,
+// so rows with equal keys always come in the same order.
+func ParseSort(sort string, columns []string, tiebreaker string) (keys []SortKey, err error) {
+	valid := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		valid[c] = true
+	}
+	seen := make(map[string]bool)
+	if strings.TrimSpace(sort) != "" {
+		for _, v := range strings.Split(sort, ",") {
+			key := SortKey{Column: strings.TrimSpace(v)}
+			if strings.HasPrefix(key.Column, "-") {
+				key.Column, key.Desc = key.Column[1:], true
+			}
+			if !valid[key.Column] || seen[key.Column] {
+				return nil, fmt.Errorf("Invalid sort: %s", strings.TrimSpace(v))
+			}
+			seen[key.Column] = true
+			keys = append(keys, key)
 		}
 	}
-	result = strings.Join(tmp, ",")
-	return result
+	if !seen[tiebreaker] {
+		last := SortKey{}
+		if len(keys) > 0 {
+			last = keys[len(keys)-1]
+		}
+		keys = append(keys, SortKey{Column: tiebreaker, Desc: last.Desc})
+	}
+	return keys, nil
+}
+
+// OrderBy joins keys into the expressions of ORDER BY
+func OrderBy(keys []SortKey) string {
+	exprs := make([]string, len(keys))
+	for i, k := range keys {
+		exprs[i] = k.String()
+	}
+	return strings.Join(exprs, ", ")
 }
 
 func GetStructDBTags(mode string, input interface{}) []string {
@@ -0,0 +1,39 @@
+package rrsql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSort(t *testing.T) {
+	columns := []string{"id", "nickname", "updated_at", "points"}
+	for _, tc := range []struct {
+		name     string
+		sort     string
+		orderBy  string
+		errormsg string
+	}{
+		{"Empty", "", "id", ""},
+		{"Ascending", "nickname", "nickname, id", ""},
+		{"Descending", "-updated_at", "updated_at DESC, id DESC", ""},
+		{"Multiple", "-points, nickname", "points DESC, nickname, id", ""},
+		{"Tiebreaker", "-id", "id DESC", ""},
+		{"TiebreakerFirst", "id,-points", "id, points DESC", ""},
+		{"Unknown", "-updated_at,shoe_size", "", "Invalid sort: shoe_size"},
+		{"Injection", "id; DROP TABLE members", "", "Invalid sort: id; DROP TABLE members"},
+		{"Duplicated", "points,-points", "", "Invalid sort: -points"},
+		{"EmptyKey", "points,,id", "", "Invalid sort: "},
+		{"OnlyPrefix", "-", "", "Invalid sort: -"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := ParseSort(tc.sort, columns, "id")
+			if tc.errormsg != "" {
+				assert.EqualError(t, err, tc.errormsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.orderBy, OrderBy(keys))
+		})
+	}
+}
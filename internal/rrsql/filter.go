@@ -0,0 +1,309 @@
+package rrsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter is a condition on a column, such as points $gte 100
+type Filter struct {
+	Column   string
+	Operator string
+	// Value is int64, float64, bool, string or time.Time by the type of column,
+	// a slice of them for $in and $nin, and bool for $null
+	Value interface{}
+}
+
+// FilterColumns maps columns of input, a struct with db tags, to the types of their fields.
+// Only columns listed are filterable.
+func FilterColumns(input interface{}, columns ...string) map[string]reflect.Type {
+	result := make(map[string]reflect.Type, len(columns))
+	t := reflect.TypeOf(input)
+	for i := 0; i < t.NumField(); i++ {
+		for _, c := range columns {
+			if t.Field(i).Tag.Get("db") == c {
+				result[c] = t.Field(i).Type
+			}
+		}
+	}
+	return result
+}
+
+// ParseFilters parses filters in JSON mapping columns to operators and operands, such as
+// {"points":{"$gte":100},"gender":{"$in":["M","F"]},"birthday":{"$null":false}}.
+// Operators are those of OperatorCoverter, $like taking a pattern of LIKE, and $null taking a boolean.
+// Columns have to be in columns, and operands match their types, with time in RFC 3339.
+// Filters are sorted by column and operator, so the same JSON always makes the same SQL.
+func ParseFilters(raw string, columns map[string]reflect.Type) (filters []Filter, err error) {
+
+	parsed := map[string]map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&parsed); err != nil {
+		return nil, errors.New("Invalid filter")
+	}
+	for column, ops := range parsed {
+		t, ok := columns[column]
+		if !ok || len(ops) == 0 {
+			return nil, fmt.Errorf("Invalid filter: %s", column)
+		}
+		for op, operand := range ops {
+			value, err := filterOperand(t, op, operand)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter: %s %s", column, op)
+			}
+			filters = append(filters, Filter{Column: column, Operator: op, Value: value})
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool {
+		if filters[i].Column != filters[j].Column {
+			return filters[i].Column < filters[j].Column
+		}
+		return filters[i].Operator < filters[j].Operator
+	})
+	return filters, nil
+}
+
+// filterOperand converts operand of op to the type of values in columns of type t
+func filterOperand(t reflect.Type, op string, operand interface{}) (interface{}, error) {
+	switch op {
+	case "$null":
+		if b, ok := operand.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.New("Invalid operand")
+	case "$like":
+		if s, ok := operand.(string); ok && filterKind(t) == reflect.String {
+			return s, nil
+		}
+		return nil, errors.New("Invalid operand")
+	case "$in", "$nin":
+		list, ok := operand.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, errors.New("Invalid operand")
+		}
+		values := make([]interface{}, len(list))
+		for i, v := range list {
+			value, err := scalarOperand(t, v)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	if _, err := OperatorCoverter(op); err != nil {
+		return nil, err
+	}
+	return scalarOperand(t, operand)
+}
+
+// filterKind tells how values of columns of type t are compared, with time.Time regarded as reflect.Struct
+func filterKind(t reflect.Type) reflect.Kind {
+	switch t {
+	case reflect.TypeOf(NullTime{}), reflect.TypeOf(time.Time{}):
+		return reflect.Struct
+	case reflect.TypeOf(NullInt{}):
+		return reflect.Int64
+	case reflect.TypeOf(NullFloat{}):
+		return reflect.Float64
+	case reflect.TypeOf(NullBool{}):
+		return reflect.Bool
+	case reflect.TypeOf(NullString{}):
+		return reflect.String
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Int64
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	}
+	return t.Kind()
+}
+
+func scalarOperand(t reflect.Type, operand interface{}) (interface{}, error) {
+	switch filterKind(t) {
+	case reflect.Int64:
+		if n, ok := operand.(json.Number); ok {
+			return n.Int64()
+		}
+	case reflect.Float64:
+		if n, ok := operand.(json.Number); ok {
+			return n.Float64()
+		}
+	case reflect.Bool:
+		if b, ok := operand.(bool); ok {
+			return b, nil
+		}
+	case reflect.String:
+		if s, ok := operand.(string); ok {
+			return s, nil
+		}
+	case reflect.Struct:
+		if s, ok := operand.(string); ok {
+			return time.Parse(time.RFC3339, s)
+		}
+	}
+	return nil, errors.New("Invalid operand")
+}
+
+// FilterRestricts turns filters into conditions with placeholders and their values, on columns of table
+func FilterRestricts(filters []Filter, table string) (restricts []string, values []interface{}) {
+	for _, f := range filters {
+		column := f.Column
+		if table != "" {
+			column = table + "." + f.Column
+		}
+		switch f.Operator {
+		case "$null":
+			if f.Value.(bool) {
+				restricts = append(restricts, column+" IS NULL")
+			} else {
+				restricts = append(restricts, column+" IS NOT NULL")
+			}
+		case "$like":
+			restricts = append(restricts, column+" LIKE ?")
+			values = append(values, f.Value)
+		case "$in", "$nin":
+			list := f.Value.([]interface{})
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(list)), ", ")
+			op, _ := OperatorCoverter(f.Operator)
+			restricts = append(restricts, fmt.Sprintf("%s %s (%s)", column, op, placeholders))
+			values = append(values, list...)
+		default:
+			op, _ := OperatorCoverter(f.Operator)
+			restricts = append(restricts, fmt.Sprintf("%s %s ?", column, op))
+			values = append(values, f.Value)
+		}
+	}
+	return restricts, values
+}
+
+// Match reports whether v, the value of column of f, satisfies f the way MySQL does, so that NULL matches only $null.
+// It is for data kept out of MySQL.
+func (f Filter) Match(v interface{}) bool {
+
+	v = plainValue(v)
+	if f.Operator == "$null" {
+		return (v == nil) == f.Value.(bool)
+	}
+	if v == nil {
+		return false
+	}
+	switch f.Operator {
+	case "$like":
+		s, ok := v.(string)
+		return ok && likePattern(f.Value.(string)).MatchString(s)
+	case "$in", "$nin":
+		found := false
+		for _, operand := range f.Value.([]interface{}) {
+			if c, ok := compareValues(v, operand); ok && c == 0 {
+				found = true
+			}
+		}
+		return found == (f.Operator == "$in")
+	}
+	c, ok := compareValues(v, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Operator {
+	case "$gte":
+		return c >= 0
+	case "$gt":
+		return c > 0
+	case "$lte":
+		return c <= 0
+	case "$lt":
+		return c < 0
+	case "$neq":
+		return c != 0
+	case "$eq":
+		return c == 0
+	}
+	return false
+}
+
+// compareValues compares a to b, and reports whether they are comparable
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case int, int8, int16, int32, int64, float32, float64:
+		af, bf := toFloat(a), toFloat(b)
+		if bf == nil {
+			return 0, false
+		}
+		switch {
+		case *af < *bf:
+			return -1, true
+		case *af > *bf:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		if b, ok := b.(string); ok {
+			// Compared case insensitively like the default collation
+			return strings.Compare(strings.ToLower(a), strings.ToLower(b)), true
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) *float64 {
+	rv := reflect.ValueOf(v)
+	var f float64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(rv.Int())
+	case reflect.Float32, reflect.Float64:
+		f = rv.Float()
+	default:
+		return nil
+	}
+	return &f
+}
+
+// likePattern turns a pattern of LIKE into a case insensitive regular expression
+func likePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
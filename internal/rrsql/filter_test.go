@@ -0,0 +1,94 @@
+package rrsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type filterModel struct {
+	ID       int64      `db:"id"`
+	Points   NullInt    `db:"points"`
+	Gender   NullString `db:"gender"`
+	Birthday NullTime   `db:"birthday"`
+	Premium  NullBool   `db:"premium"`
+	Password NullString `db:"password"`
+}
+
+func TestParseFilters(t *testing.T) {
+	columns := FilterColumns(filterModel{}, "points", "gender", "birthday", "premium")
+	for _, tc := range []struct {
+		name      string
+		filter    string
+		restricts []string
+		values    []interface{}
+		errormsg  string
+	}{
+		{"Compare", `{"points":{"$gte":100,"$lt":200}}`, []string{"members.points >= ?", "members.points < ?"}, []interface{}{int64(100), int64(200)}, ""},
+		{"Equal", `{"gender":{"$eq":"F"},"premium":{"$neq":true}}`, []string{"members.gender = ?", "members.premium != ?"}, []interface{}{"F", true}, ""},
+		{"In", `{"gender":{"$in":["M","F"]},"points":{"$nin":[0]}}`, []string{"members.gender IN (?, ?)", "members.points NOT IN (?)"}, []interface{}{"M", "F", int64(0)}, ""},
+		{"Like", `{"gender":{"$like":"%F_"}}`, []string{"members.gender LIKE ?"}, []interface{}{"%F_"}, ""},
+		{"Null", `{"birthday":{"$null":true},"points":{"$null":false}}`, []string{"members.birthday IS NULL", "members.points IS NOT NULL"}, nil, ""},
+		{"Time", `{"birthday":{"$lt":"2000-01-01T00:00:00Z"}}`, []string{"members.birthday < ?"}, []interface{}{time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}, ""},
+		{"NotJSON", `points>100`, nil, nil, "Invalid filter"},
+		{"UnknownColumn", `{"shoe_size":{"$gt":40}}`, nil, nil, "Invalid filter: shoe_size"},
+		{"NotWhitelisted", `{"password":{"$like":"%"}}`, nil, nil, "Invalid filter: password"},
+		{"NoOperator", `{"points":{}}`, nil, nil, "Invalid filter: points"},
+		{"UnknownOperator", `{"points":{"$between":[1,2]}}`, nil, nil, "Invalid filter: points $between"},
+		{"WrongType", `{"points":{"$gt":"100"}}`, nil, nil, "Invalid filter: points $gt"},
+		{"Fraction", `{"points":{"$gt":1.5}}`, nil, nil, "Invalid filter: points $gt"},
+		{"InvalidTime", `{"birthday":{"$gt":"yesterday"}}`, nil, nil, "Invalid filter: birthday $gt"},
+		{"EmptyIn", `{"gender":{"$in":[]}}`, nil, nil, "Invalid filter: gender $in"},
+		{"LikeOnNumber", `{"points":{"$like":"1%"}}`, nil, nil, "Invalid filter: points $like"},
+		{"NullNotBool", `{"points":{"$null":1}}`, nil, nil, "Invalid filter: points $null"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filters, err := ParseFilters(tc.filter, columns)
+			if tc.errormsg != "" {
+				assert.EqualError(t, err, tc.errormsg)
+				return
+			}
+			assert.NoError(t, err)
+			restricts, values := FilterRestricts(filters, "members")
+			assert.Equal(t, tc.restricts, restricts)
+			assert.Equal(t, tc.values, values)
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	columns := FilterColumns(filterModel{}, "points", "gender", "birthday", "premium")
+	row := map[string]interface{}{
+		"points":   NullInt{Int: 150, Valid: true},
+		"gender":   NullString{String: "F", Valid: true},
+		"birthday": NullTime{},
+		"premium":  NullBool{Bool: true, Valid: true},
+	}
+	for _, tc := range []struct {
+		filter string
+		match  bool
+	}{
+		{`{"points":{"$gte":100,"$lt":200}}`, true},
+		{`{"points":{"$gt":150}}`, false},
+		{`{"points":{"$in":[100,150]}}`, true},
+		{`{"points":{"$nin":[100,150]}}`, false},
+		{`{"gender":{"$eq":"f"}}`, true},
+		{`{"gender":{"$like":"_"}}`, true},
+		{`{"gender":{"$like":"M%"}}`, false},
+		{`{"premium":{"$neq":false}}`, true},
+		{`{"birthday":{"$null":true}}`, true},
+		{`{"birthday":{"$lt":"2000-01-01T00:00:00Z"}}`, false},
+		{`{"birthday":{"$neq":"2000-01-01T00:00:00Z"}}`, false},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			filters, err := ParseFilters(tc.filter, columns)
+			assert.NoError(t, err)
+			match := true
+			for _, f := range filters {
+				match = match && f.Match(row[f.Column])
+			}
+			assert.Equal(t, tc.match, match)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package rrsql
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
 	"strings"
@@ -13,9 +14,9 @@ import (
 type TxFn func(*sqlx.Tx) error
 
 // WithTransaction is a wrapper function that wraps the creation of db transaction and handles rollback/commit based on the
-// error object returned by the `TxFn`
-func WithTransaction(db *sqlx.DB, fn TxFn) (err error) {
-	tx, err := db.Beginx()
+// error object returned by the `TxFn`. The transaction is rolled back if ctx is done before it commits.
+func WithTransaction(ctx context.Context, db *sqlx.DB, fn TxFn) (err error) {
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -58,7 +59,7 @@ type PipelineStmt struct {
 
 // RunPipeline runs the supplied statements within the transaction.
 // If any statement fails, the transaction will be rolled back, and the original error will be returned.
-func RunPipeline(tx *sqlx.Tx, stmts ...*PipelineStmt) (int64, sql.Result, error) {
+func RunPipeline(ctx context.Context, tx *sqlx.Tx, stmts ...*PipelineStmt) (int64, sql.Result, error) {
 	var res sql.Result
 	var err error
 	var lastInsId, rowCnt int64
@@ -71,9 +72,9 @@ func RunPipeline(tx *sqlx.Tx, stmts ...*PipelineStmt) (int64, sql.Result, error)
 		}
 
 		if ps.NamedExec {
-			res, err = tx.NamedExec(ps.Query, ps.NamedArgs)
+			res, err = tx.NamedExecContext(ctx, ps.Query, ps.NamedArgs)
 		} else {
-			res, err = tx.Exec(ps.Query, ps.Args...)
+			res, err = tx.ExecContext(ctx, ps.Query, ps.Args...)
 		}
 		if err != nil {
 			if strings.Contains(err.Error(), "Duplicate entry") {
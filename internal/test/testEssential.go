@@ -17,6 +17,9 @@ import (
 
 var r *gin.Engine
 
+// Header is added to every request made by GenericDoTest, such as Authorization of the calling member
+var Header = http.Header{}
+
 type GenericTestcase struct {
 	Name     string
 	Method   string
@@ -28,6 +31,7 @@ type GenericTestcase struct {
 
 func SetRoutes(handler router.RouterHandler) {
 	r = gin.New()
+	r.Use(router.RequestID)
 	handler.SetRoutes(r)
 }
 
@@ -70,6 +74,9 @@ func GenericDoTest(tc GenericTestcase, t *testing.T, function interface{}) {
 		} else {
 			req.Header.Set("Content-Type", "application/json")
 		}
+		for k, v := range Header {
+			req.Header[k] = v
+		}
 
 		r.ServeHTTP(w, req)
 
@@ -0,0 +1,86 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/utils"
+)
+
+const opaque_token_bytes = 32
+
+var InvalidTokenError = errors.New("Invalid Token")
+
+// Claims is the payload of access tokens.
+// The shape is shared with other readr services parsing the same tokens.
+type Claims struct {
+	ID       int64    `json:"id"`
+	UUID     string   `json:"uuid"`
+	Mail     string   `json:"mail"`
+	Nickname string   `json:"nickname"`
+	Role     int64    `json:"role"`
+	Scopes   []string `json:"scopes"`
+	jwt.RegisteredClaims
+}
+
+// Sign fills in iss, aud, iat, exp and jti, then signs claims with TokenSecret
+func Sign(claims Claims) (string, error) {
+
+	jti, err := utils.NewUUIDv4()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.Issuer = config.Config.Token.Issuer
+	claims.Audience = jwt.ClaimStrings{config.Config.Token.Audience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Duration(config.Config.Token.AccessTTL) * time.Second))
+	// ID of claims is the member, the token id is kept in RegisteredClaims
+	claims.RegisteredClaims.ID = jti.String()
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Config.TokenSecret))
+}
+
+// Parse verifies the signature, expiration, issuer and audience of tokenString and returns its claims
+func Parse(tokenString string) (*Claims, error) {
+
+	claims := &Claims{}
+	t, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
+		}
+		return []byte(config.Config.TokenSecret), nil
+	})
+	if err != nil || !t.Valid {
+		return nil, InvalidTokenError
+	}
+	if !claims.VerifyIssuer(config.Config.Token.Issuer, true) || !claims.VerifyAudience(config.Config.Token.Audience, true) {
+		return nil, InvalidTokenError
+	}
+	return claims, nil
+}
+
+// GenOpaqueToken returns a random opaque token for the client, such as refresh or password reset tokens, and its hash for storage
+func GenOpaqueToken() (token string, hash string, err error) {
+	b := make([]byte, opaque_token_bytes)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, Hash(token), nil
+}
+
+// Hash returns the hex encoded SHA-256 of an opaque token.
+// Opaque tokens carry enough entropy, so they are stored unsalted to be looked up by hash.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
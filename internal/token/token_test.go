@@ -0,0 +1,68 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	config.Config.TokenSecret = "secret"
+	config.Config.Token.Issuer = "https://www.readr.tw"
+	config.Config.Token.Audience = "readr"
+	config.Config.Token.AccessTTL = 3600
+}
+
+func TestSignAndParse(t *testing.T) {
+
+	signed, err := Sign(Claims{ID: 1, UUID: "3d64e480-3e30-11e8-b94b-cfe922eb374f", Mail: "superman@mirrormedia.mg", Role: 9, Scopes: []string{"memberManage"}})
+	assert.Nil(t, err)
+
+	claims, err := Parse(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), claims.ID)
+	assert.Equal(t, "superman@mirrormedia.mg", claims.Mail)
+	assert.Equal(t, []string{"memberManage"}, claims.Scopes)
+	assert.Equal(t, jwt.ClaimStrings{"readr"}, claims.Audience)
+	assert.NotEmpty(t, claims.RegisteredClaims.ID)
+
+	// Audiences in a list are all checked, not skipped as they were in dgrijalva/jwt-go
+	otherAudiences, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "https://www.readr.tw", "aud": []string{"other", "another"}, "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		setup func()
+	}{
+		{"Tampered", signed[:len(signed)-2] + "xx", func() {}},
+		{"WrongSecret", signed, func() { config.Config.TokenSecret = "other" }},
+		{"WrongAudience", signed, func() { config.Config.Token.Audience = "other" }},
+		{"WrongIssuer", signed, func() { config.Config.Token.Issuer = "other" }},
+		{"OtherAudiences", otherAudiences, func() {}},
+		{"AlgNone", "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJpZCI6MX0.", func() {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			secret, token := config.Config.TokenSecret, config.Config.Token
+			defer func() { config.Config.TokenSecret, config.Config.Token = secret, token }()
+
+			tc.setup()
+			_, err := Parse(tc.token)
+			assert.Equal(t, InvalidTokenError, err)
+		})
+	}
+}
+
+func TestGenOpaqueToken(t *testing.T) {
+	token, hash, err := GenOpaqueToken()
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(token), hash)
+	assert.Len(t, hash, 64)
+
+	another, _, _ := GenOpaqueToken()
+	assert.NotEqual(t, token, another)
+}
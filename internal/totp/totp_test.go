@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+
+	// Test vectors of RFC 6238 Appendix B for SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		code, err := Code(secret, Step(time.Unix(tc.unix, 0)))
+		if err != nil || code != tc.code {
+			t.Errorf("At %d expect %s but get %s, %v", tc.unix, tc.code, code, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	secret, _ := GenerateSecret()
+	now := time.Now()
+	previous, _ := Code(secret, Step(now)-1)
+	stale, _ := Code(secret, Step(now)-3)
+
+	if step, ok := Validate(secret, previous, now, 1); !ok || step != Step(now)-1 {
+		t.Errorf("Expect code of previous step to be valid with skew 1")
+	}
+	if _, ok := Validate(secret, previous, now, 0); ok && previous != mustCode(secret, Step(now)) {
+		t.Errorf("Expect code of previous step to be invalid without skew")
+	}
+	if _, ok := Validate(secret, stale, now, 1); ok {
+		t.Errorf("Expect code 3 steps ago to be invalid")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Errorf("Expect malformed code to be invalid")
+	}
+	if uri := URI(secret, "Readr", "superman@mirrormedia.mg"); !strings.HasPrefix(uri, "otpauth://totp/Readr:superman@mirrormedia.mg?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("Unexpected otpauth URI %s", uri)
+	}
+}
+
+func mustCode(secret string, step int64) string {
+	code, _ := Code(secret, step)
+	return code
+}
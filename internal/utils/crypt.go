@@ -2,21 +2,45 @@ package utils
 
 import (
 	"crypto/rand"
-	"golang.org/x/crypto/scrypt"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
 )
 
 const (
 	pw_salt_bytes = 32
 	pw_hash_bytes = 64
+
+	pw_phc_salt_bytes = 16
+	pw_phc_hash_bytes = 32
 )
 
+var InvalidHashError = errors.New("Invalid Password Hash")
+
+// phcParamRanges are parameters every hash of an algorithm must have, each bounded by [min, max],
+// so stored hashes couldn't make hashing panic or exhaust memory and CPU
+var phcParamRanges = map[string]map[string][2]int{
+	// m is memory in KiB, at least 8 KiB per thread, and at most 4 GiB
+	"argon2id": {"m": {8, 1 << 22}, "t": {1, 16}, "p": {1, 255}},
+	// N = 2^ln takes 128 * N * r bytes, at most 4 GiB
+	"scrypt": {"ln": {1, 20}, "r": {1, 32}, "p": {1, 16}},
+}
+
 func CryptGenSalt() (string, error) {
 	salt := make([]byte, pw_salt_bytes)
 	_, err := io.ReadFull(rand.Reader, salt)
 	return string(salt), err
 }
 
+// CryptGenHash is the legacy password hash, scrypt N=32768,r=8,p=1 of raw binary salt.
+// Use CryptHashPassword for new passwords.
 func CryptGenHash(pw, salt string) (string, error) {
 	hpw, err := scrypt.Key([]byte(pw), []byte(salt), 32768, 8, 1, pw_hash_bytes)
 	if err != nil {
@@ -24,3 +48,145 @@ func CryptGenHash(pw, salt string) (string, error) {
 	}
 	return string(hpw), err
 }
+
+// CryptCompareHash hashes pw with salt and compares the result with hash in constant time
+func CryptCompareHash(pw, salt, hash string) (bool, error) {
+	hpw, err := CryptGenHash(pw, salt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hpw), []byte(hash)) == 1, nil
+}
+
+// phcHash is a password hash in PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// salt and hash are base64 encoded without padding.
+type phcHash struct {
+	Algorithm string
+	Params    map[string]int
+	Salt      []byte
+	Hash      []byte
+}
+
+func (h phcHash) String() string {
+	var params string
+	switch h.Algorithm {
+	case "argon2id":
+		params = fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, h.Params["m"], h.Params["t"], h.Params["p"])
+	case "scrypt":
+		params = fmt.Sprintf("ln=%d,r=%d,p=%d", h.Params["ln"], h.Params["r"], h.Params["p"])
+	}
+	return fmt.Sprintf("$%s$%s$%s$%s", h.Algorithm, params,
+		base64.RawStdEncoding.EncodeToString(h.Salt), base64.RawStdEncoding.EncodeToString(h.Hash))
+}
+
+func (h phcHash) key(pw string, keyLen int) (key []byte, err error) {
+	switch h.Algorithm {
+	case "argon2id":
+		key = argon2.IDKey([]byte(pw), h.Salt, uint32(h.Params["t"]), uint32(h.Params["m"]), uint8(h.Params["p"]), uint32(keyLen))
+	case "scrypt":
+		key, err = scrypt.Key([]byte(pw), h.Salt, 1<<uint(h.Params["ln"]), h.Params["r"], h.Params["p"], keyLen)
+	default:
+		err = InvalidHashError
+	}
+	return key, err
+}
+
+func parsePHCHash(encoded string) (h phcHash, err error) {
+
+	parts := strings.Split(encoded, "$")
+	switch {
+	case len(parts) == 6 && parts[1] == "argon2id":
+		if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return h, InvalidHashError
+		}
+		parts = append(parts[:2], parts[3:]...)
+	case len(parts) == 5 && parts[1] == "scrypt":
+	default:
+		return h, InvalidHashError
+	}
+
+	h.Algorithm, h.Params = parts[1], make(map[string]int)
+	for _, param := range strings.Split(parts[2], ",") {
+		var k string
+		var v int
+		if _, err = fmt.Sscanf(strings.Replace(param, "=", " ", 1), "%s %d", &k, &v); err != nil {
+			return h, InvalidHashError
+		}
+		h.Params[k] = v
+	}
+	for k, r := range phcParamRanges[h.Algorithm] {
+		if v, ok := h.Params[k]; !ok || v < r[0] || v > r[1] {
+			return h, InvalidHashError
+		}
+	}
+	if h.Algorithm == "argon2id" && h.Params["m"] < 8*h.Params["p"] {
+		return h, InvalidHashError
+	}
+	if h.Salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return h, InvalidHashError
+	}
+	if h.Hash, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, InvalidHashError
+	}
+	return h, nil
+}
+
+// currentPHCHash returns an empty hash with the algorithm and parameters in config
+func currentPHCHash() phcHash {
+	c := config.Config.PasswordHash
+	if c.Algorithm == "scrypt" {
+		return phcHash{Algorithm: "scrypt", Params: map[string]int{"ln": c.Scrypt.LogN, "r": c.Scrypt.R, "p": c.Scrypt.P}}
+	}
+	return phcHash{Algorithm: "argon2id", Params: map[string]int{"m": int(c.Argon2.Memory), "t": int(c.Argon2.Time), "p": int(c.Argon2.Threads)}}
+}
+
+// CryptHashPassword hashes pw with the algorithm and parameters in config,
+// and returns the hash encoded in PHC string format, which embeds its own salt.
+func CryptHashPassword(pw string) (string, error) {
+	h := currentPHCHash()
+	h.Salt = make([]byte, pw_phc_salt_bytes)
+	if _, err := io.ReadFull(rand.Reader, h.Salt); err != nil {
+		return "", err
+	}
+	key, err := h.key(pw, pw_phc_hash_bytes)
+	if err != nil {
+		return "", err
+	}
+	h.Hash = key
+	return h.String(), nil
+}
+
+// CryptVerifyPassword verifies pw against encoded in constant time.
+// Hashes given with legacySalt, or not in PHC string format, are regarded as legacy CryptGenHash output.
+// Legacy hashes are raw bytes, which could start with "$" as well.
+// needRehash reports whether encoded is made with an algorithm or parameters other than the current ones.
+func CryptVerifyPassword(pw, encoded, legacySalt string) (ok bool, needRehash bool, err error) {
+
+	if legacySalt != "" || !strings.HasPrefix(encoded, "$") {
+		ok, err = CryptCompareHash(pw, legacySalt, encoded)
+		return ok, true, err
+	}
+
+	h, err := parsePHCHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	key, err := h.key(pw, len(h.Hash))
+	if err != nil {
+		return false, false, err
+	}
+	ok = subtle.ConstantTimeCompare(key, h.Hash) == 1
+
+	current := currentPHCHash()
+	needRehash = h.Algorithm != current.Algorithm
+	for k, v := range current.Params {
+		if h.Params[k] != v {
+			needRehash = true
+		}
+	}
+	return ok, needRehash, nil
+}
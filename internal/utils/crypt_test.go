@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/readr-media/readr-restful-member/config"
+)
+
+func TestCryptVerifyPassword(t *testing.T) {
+
+	config.Config.PasswordHash.Algorithm = "scrypt"
+	config.Config.PasswordHash.Scrypt.LogN, config.Config.PasswordHash.Scrypt.R, config.Config.PasswordHash.Scrypt.P = 10, 8, 1
+	scryptHash, _ := CryptHashPassword("angrypug")
+
+	config.Config.PasswordHash.Algorithm = "argon2id"
+	config.Config.PasswordHash.Argon2.Memory, config.Config.PasswordHash.Argon2.Time, config.Config.PasswordHash.Argon2.Threads = 1024, 1, 1
+	argonHash, _ := CryptHashPassword("angrypug")
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("Unexpected encoded hash %s", argonHash)
+	}
+
+	salt, _ := CryptGenSalt()
+	legacyHash, _ := CryptGenHash("angrypug", salt)
+
+	for _, tc := range []struct {
+		name       string
+		password   string
+		encoded    string
+		salt       string
+		ok         bool
+		needRehash bool
+		err        error
+	}{
+		{"Current", "angrypug", argonHash, "", true, false, nil},
+		{"CurrentWrongPassword", "happypug", argonHash, "", false, false, nil},
+		{"OtherAlgorithm", "angrypug", scryptHash, "", true, true, nil},
+		{"Legacy", "angrypug", legacyHash, salt, true, true, nil},
+		{"LegacyWrongPassword", "happypug", legacyHash, salt, false, true, nil},
+		{"LegacyStartingWithDollar", "angrypug", "$" + legacyHash[1:], salt, false, true, nil},
+		{"Malformed", "angrypug", "$argon2id$v=19$m=1024$salt", "", false, false, InvalidHashError},
+		{"UnknownAlgorithm", "angrypug", "$md5$ln=1$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"NoThreads", "angrypug", "$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"MissingParam", "angrypug", "$argon2id$v=19$m=1024,p=1$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"HugeMemory", "angrypug", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"MemoryUnderThreads", "angrypug", "$argon2id$v=19$m=8,t=1,p=4$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"HugeCost", "angrypug", "$scrypt$ln=62,r=8,p=1$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+		{"NoBlockSize", "angrypug", "$scrypt$ln=10,r=0,p=1$c2FsdA$aGFzaA", "", false, false, InvalidHashError},
+	} {
+		ok, needRehash, err := CryptVerifyPassword(tc.password, tc.encoded, tc.salt)
+		if ok != tc.ok || needRehash != tc.needRehash || err != tc.err {
+			t.Errorf("%s, expect %v, %v, %v but get %v, %v, %v", tc.name, tc.ok, tc.needRehash, tc.err, ok, needRehash, err)
+		}
+	}
+
+	config.Config.PasswordHash.Argon2.Time = 2
+	if _, needRehash, _ := CryptVerifyPassword("angrypug", argonHash, ""); !needRehash {
+		t.Errorf("Expect hash with outdated parameters to need rehash")
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"net/http"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/readr-media/readr-restful/config"
+	"github.com/readr-media/readr-restful-member/config"
 )
 
 func GetResourceTableInfo(resource string) (tableName string, idName string) {
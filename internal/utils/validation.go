@@ -1,9 +1,17 @@
 package utils
 
 import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/readr-media/readr-restful/config"
+	"github.com/readr-media/readr-restful-member/config"
 )
 
 func ValidateUserID(id string) bool {
@@ -14,12 +22,116 @@ func ValidateUserID(id string) bool {
 	return result
 }
 
-func ValidatePassword(id string) bool {
-	// to be implemented ...
-	if id == "" {
-		return false
+// PasswordViolation describes a rule in password policy that a password fails
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var passwordBlacklist = struct {
+	once      sync.Once
+	passwords map[string]bool
+}{}
+
+// loadPasswordBlacklist reads the breached/common password list, one password per line
+func loadPasswordBlacklist() map[string]bool {
+	passwordBlacklist.once.Do(func() {
+		passwordBlacklist.passwords = make(map[string]bool)
+		path := config.Config.PasswordPolicy.BlacklistPath
+		if path == "" {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Fail to open password blacklist %s: %v", path, err)
+			return
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" {
+				passwordBlacklist.passwords[strings.ToLower(p)] = true
+			}
+		}
+	})
+	return passwordBlacklist.passwords
+}
+
+// PasswordTooLong reports whether password is longer than the max length of password policy.
+// Passwords are checked before being hashed anywhere, to prevent long passwords from exhausting CPU and memory.
+func PasswordTooLong(password string) bool {
+	max := config.Config.PasswordPolicy.MaxLength
+	return max > 0 && len(password) > max
+}
+
+// ValidatePassword checks password against the password policy in config,
+// and returns every rule it violates. personal is the personal info of the member,
+// such as mail, nickname and member_id, which the password should not equal to.
+func ValidatePassword(password string, personal ...string) (violations []PasswordViolation) {
+
+	policy := config.Config.PasswordPolicy
+	var violate = func(rule string, format string, a ...interface{}) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, a...)})
 	}
-	return true
+
+	if password == "" {
+		violate("required", "Password is required")
+		return violations
+	}
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		violate("min_length", "Password must be at least %d characters", policy.MinLength)
+	}
+	if PasswordTooLong(password) {
+		violate("max_length", "Password must be at most %d bytes", policy.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireLower && !lower {
+		violate("lower", "Password must contain a lowercase letter")
+	}
+	if policy.RequireUpper && !upper {
+		violate("upper", "Password must contain an uppercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		violate("digit", "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		violate("symbol", "Password must contain a symbol")
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < policy.MinCharacterClasses {
+		violate("character_classes", "Password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinCharacterClasses)
+	}
+
+	if policy.RejectPersonalInfo {
+		for _, p := range personal {
+			if p != "" && strings.EqualFold(password, p) {
+				violate("personal_info", "Password must not be the same as mail, nickname or member_id")
+				break
+			}
+		}
+	}
+	if loadPasswordBlacklist()[strings.ToLower(password)] {
+		violate("common_password", "Password is too common")
+	}
+	return violations
 }
 
 func ValidateTaggingType(id int) bool {
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePassword(t *testing.T) {
+
+	config.Config.PasswordPolicy.MinLength = 8
+	config.Config.PasswordPolicy.MaxLength = 64
+	config.Config.PasswordPolicy.MinCharacterClasses = 2
+	config.Config.PasswordPolicy.RequireDigit = true
+	config.Config.PasswordPolicy.RejectPersonalInfo = true
+	config.Config.PasswordPolicy.BlacklistPath = "../../config/common_passwords.txt"
+
+	var rules = func(violations []PasswordViolation) (result []string) {
+		for _, v := range violations {
+			result = append(result, v.Rule)
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		name     string
+		password string
+		personal []string
+		expected []string
+	}{
+		{"Valid", "angrypug2020", nil, nil},
+		{"Empty", "", nil, []string{"required"}},
+		{"TooShort", "pug2020", nil, []string{"min_length"}},
+		{"TooLong", "angrypug2020angrypug2020angrypug2020angrypug2020angrypug2020angrypug2020", nil, []string{"max_length"}},
+		{"MultiByteLength", "憤怒的巴哥犬2020", nil, nil},
+		{"NoDigit", "angry-pug", nil, []string{"digit"}},
+		{"SingleClass", "angrypug", nil, []string{"digit", "character_classes"}},
+		{"SameAsMail", "Superman2020@mirrormedia.mg", []string{"superman2020@mirrormedia.mg", "readr"}, []string{"personal_info"}},
+		{"EmptyPersonalInfo", "angrypug2020", []string{"", ""}, nil},
+		{"Common", "Password123", nil, []string{"common_password"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rules(ValidatePassword(tc.password, tc.personal...)))
+		})
+	}
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/readr-media/readr-restful-member/config"
 	"github.com/readr-media/readr-restful-member/internal/router"
+	"github.com/readr-media/readr-restful-member/internal/rrredis"
 	"github.com/readr-media/readr-restful-member/internal/rrsql"
 	"github.com/readr-media/readr-restful-member/pkg/member"
 )
 
+// shutdownTimeout bounds how long requests and exports in progress are waited for on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func setRoutes(rt *gin.Engine) {
 	for _, h := range []router.RouterHandler{
 		&member.Router,
@@ -33,17 +44,37 @@ func main() {
 
 	r := gin.New()
 	r.Use(gin.Recovery())
+	r.Use(router.RequestID)
+
+	// Bound requests, and queries made for them, by timeouts in config
+	routeTimeouts := make(map[string]time.Duration)
+	for route, seconds := range config.Config.Timeout.Routes {
+		routeTimeouts[route] = time.Duration(seconds) * time.Second
+	}
+	r.Use(router.Timeout(time.Duration(config.Config.Timeout.Default)*time.Second, routeTimeouts))
 
 	// Set customed logger, specify routes skiped from logged
 	r.Use(gin.LoggerWithWriter(gin.DefaultWriter, "/metrics"))
 
-	// Include multiStatements=True for migration usage
-	dbURI := fmt.Sprintf("%s:%s@tcp(%s)/memberdb?parseTime=true&charset=utf8mb4&multiStatements=true", config.Config.SQL.User, config.Config.SQL.Password, fmt.Sprintf("%s:%v", config.Config.SQL.Host, config.Config.SQL.Port))
-	// Init Mysql connections
-	rrsql.Connect(dbURI)
+	if err = member.SetStore(config.Config.Store); err != nil {
+		panic(fmt.Errorf("Invalid application configuration: %s", err))
+	}
+	// Members kept in memory don't need MySQL, nor Redis for login attempts
+	if config.Config.Store != "memory" {
+		// Include multiStatements=True for migration usage
+		dbURI := fmt.Sprintf("%s:%s@tcp(%s)/memberdb?parseTime=true&charset=utf8mb4&multiStatements=true", config.Config.SQL.User, config.Config.SQL.Password, fmt.Sprintf("%s:%v", config.Config.SQL.Host, config.Config.SQL.Port))
+		// Init Mysql connections
+		rrsql.Connect(dbURI)
+		// Init Redis connections
+		rrredis.Connect(config.Config.Redis.ReadURL, config.Config.Redis.WriteURL, config.Config.Redis.Password)
+	}
 
 	setRoutes(r)
 
+	if config.Config.Purge.Interval > 0 {
+		go member.RunPurgeJob(time.Duration(config.Config.Purge.Interval) * time.Second)
+	}
+
 	// Implemented Prometheus metrics
 	r.GET("/metrics", func() gin.HandlerFunc {
 		return func(c *gin.Context) {
@@ -51,6 +82,28 @@ func main() {
 		}
 	}())
 
-	r.Run()
+	// Listen on PORT like gin.Engine.Run, and shut down gracefully on SIGINT and SIGTERM
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	srv := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error serving: %v\n", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v\n", err)
+	}
+	if err := member.StopExports(ctx); err != nil {
+		log.Printf("Error waiting for exports: %v\n", err)
+	}
 }
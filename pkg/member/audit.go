@@ -0,0 +1,215 @@
+package member
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	rt "github.com/readr-media/readr-restful-member/internal/router"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+const (
+	auditActionCreate         = "create"
+	auditActionUpdate         = "update"
+	auditActionPasswordChange = "password_change"
+	auditActionDelete         = "delete"
+	auditActionActivate       = "activate"
+	auditActionBulkUpdate     = "bulk_update"
+	auditActionRestore        = "restore"
+	auditActionPurge          = "purge"
+	auditActionAnonymize      = "anonymize"
+)
+
+var auditActions = []string{auditActionCreate, auditActionUpdate, auditActionPasswordChange, auditActionDelete, auditActionActivate,
+	auditActionBulkUpdate, auditActionRestore, auditActionPurge, auditActionAnonymize}
+
+// redactedFields never show their values in audit trail
+var redactedFields = map[string]bool{"password": true, "salt": true}
+
+// bookkeepingFields change along with every write, they are already told by the actor and time of audits
+var bookkeepingFields = map[string]bool{"id": true, "updated_at": true, "updated_by": true}
+
+const redacted = "[REDACTED]"
+
+// AuditMeta tells who makes a change to members and why, recorded along with the change.
+// Action is left empty for the default action of each write, such as create for InsertMember.
+type AuditMeta struct {
+	ActorID   int64
+	Action    string
+	RequestID string
+}
+
+// auditMeta returns AuditMeta of a change requested in c, made by the caller if there is one
+func auditMeta(c *gin.Context, action string) AuditMeta {
+	caller, _ := callerFrom(c)
+	return AuditMeta{ActorID: caller.ID, Action: action, RequestID: rt.GetRequestID(c)}
+}
+
+// AuditChange is the value of a field before and after a change
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditChanges maps changed fields to their changes, stored as JSON
+type AuditChanges map[string]AuditChange
+
+func (a AuditChanges) Value() (driver.Value, error) {
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+func (a *AuditChanges) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	default:
+		return fmt.Errorf("Unsupported audit changes type %T", value)
+	}
+}
+
+// MemberAudit maps the schema of table 'member_audit'.
+// Every row is a change to a member, written in the same transaction as the change.
+type MemberAudit struct {
+	ID        int64            `json:"id" db:"id"`
+	MemberID  int64            `json:"member_id" db:"member_id"`
+	ActorID   rrsql.NullInt    `json:"actor_id" db:"actor_id"`
+	Action    string           `json:"action" db:"action"`
+	Changes   AuditChanges     `json:"changes" db:"changes"`
+	RequestID rrsql.NullString `json:"request_id" db:"request_id"`
+	CreatedAt rrsql.NullTime   `json:"created_at" db:"created_at"`
+}
+
+// newAudit records fields of after which differ from before, as a change to member id with action,
+// unless meta specifies another action.
+func newAudit(id int64, meta AuditMeta, action string, before Member, after Member, fields []string) MemberAudit {
+
+	if meta.Action != "" {
+		action = meta.Action
+	}
+	audit := MemberAudit{
+		MemberID:  id,
+		ActorID:   rrsql.NullInt{Int: meta.ActorID, Valid: meta.ActorID != 0},
+		Action:    action,
+		Changes:   AuditChanges{},
+		RequestID: rrsql.NullString{String: meta.RequestID, Valid: meta.RequestID != ""},
+	}
+	beforeValues, afterValues := memberValues(before), memberValues(after)
+	for _, field := range fields {
+		if bookkeepingFields[field] {
+			continue
+		}
+		b, _ := json.Marshal(beforeValues[field])
+		a, _ := json.Marshal(afterValues[field])
+		switch {
+		case string(b) == string(a):
+		case redactedFields[field]:
+			audit.Changes[field] = AuditChange{Before: redacted, After: redacted}
+		default:
+			audit.Changes[field] = AuditChange{Before: beforeValues[field], After: afterValues[field]}
+		}
+	}
+	return audit
+}
+
+// memberValues maps columns of m to their values
+func memberValues(m Member) map[string]interface{} {
+	values := make(map[string]interface{})
+	v := reflect.ValueOf(m)
+	for i := 0; i < v.NumField(); i++ {
+		values[v.Type().Field(i).Tag.Get("db")] = v.Field(i).Interface()
+	}
+	return values
+}
+
+// insertAudit writes audit in tx, skipping changes without any field changed
+func insertAudit(ctx context.Context, tx *sqlx.Tx, audit MemberAudit) error {
+	if len(audit.Changes) == 0 {
+		return nil
+	}
+	_, err := tx.NamedExecContext(ctx, `INSERT INTO member_audit (member_id, actor_id, action, changes, request_id)
+		VALUES (:member_id, :actor_id, :action, :changes, :request_id)`, audit)
+	return err
+}
+
+type GetHistoryArgs struct {
+	MemberID  int64
+	MaxResult uint8  `form:"max_result"`
+	Page      uint16 `form:"page"`
+	Action    string `form:"action"`
+	ActorID   int64  `form:"actor"`
+	Total     bool   `form:"total"`
+}
+
+func (a *GetHistoryArgs) SetDefault() {
+	a.MaxResult = 20
+	a.Page = 1
+}
+
+func (a *GetHistoryArgs) Validate() error {
+	if a.Action != "" {
+		valid := false
+		for _, action := range auditActions {
+			if a.Action == action {
+				valid = true
+			}
+		}
+		if !valid {
+			return ErrInvalidAction
+		}
+	}
+	if a.MaxResult == 0 || a.Page == 0 {
+		return ErrInvalidPage
+	}
+	return nil
+}
+
+func (a *GetHistoryArgs) parseRestricts() (restricts string, values []interface{}) {
+	where := []string{"member_id = ?"}
+	values = append(values, a.MemberID)
+	if a.Action != "" {
+		where = append(where, "action = ?")
+		values = append(values, a.Action)
+	}
+	if a.ActorID != 0 {
+		where = append(where, "actor_id = ?")
+		values = append(values, a.ActorID)
+	}
+	return strings.Join(where, " AND "), values
+}
+
+type auditAPI struct{}
+
+var AuditAPI AuditInterface = new(auditAPI)
+
+type AuditInterface interface {
+	GetHistory(ctx context.Context, args *GetHistoryArgs) ([]MemberAudit, error)
+	CountHistory(ctx context.Context, args *GetHistoryArgs) (int, error)
+}
+
+// GetHistory lists changes to a member, latest first
+func (a *auditAPI) GetHistory(ctx context.Context, args *GetHistoryArgs) (result []MemberAudit, err error) {
+	restricts, values := args.parseRestricts()
+	query := fmt.Sprintf(`SELECT * FROM member_audit WHERE %s ORDER BY id DESC LIMIT ? OFFSET ?`, restricts)
+	values = append(values, args.MaxResult, pageOffset(args.Page, args.MaxResult))
+	result = []MemberAudit{}
+	err = rrsql.DB.SelectContext(ctx, &result, query, values...)
+	return result, err
+}
+
+func (a *auditAPI) CountHistory(ctx context.Context, args *GetHistoryArgs) (result int, err error) {
+	restricts, values := args.parseRestricts()
+	err = rrsql.DB.GetContext(ctx, &result, fmt.Sprintf(`SELECT COUNT(*) FROM member_audit WHERE %s`, restricts), values...)
+	return result, err
+}
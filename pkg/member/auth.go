@@ -0,0 +1,204 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/readr-media/readr-restful-member/config"
+	rt "github.com/readr-media/readr-restful-member/internal/router"
+	"github.com/readr-media/readr-restful-member/internal/token"
+)
+
+const (
+	callerKey = "caller"
+	claimsKey = "claims"
+)
+
+// TokenPair is returned to members after a successful authentication
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// issueTokens signs an access token for member, and persists a new refresh token for it.
+// Members yet to turn on the two-factor authentication required of them only get an access token
+// to enroll, which is all authenticate lets it do.
+func issueTokens(ctx context.Context, member Member) (pair TokenPair, err error) {
+
+	scopes := scopesOf(member)
+	enrollOnly := twoFactorSetupRequired(member)
+	if enrollOnly {
+		scopes = []string{scopeTwoFactorEnroll}
+	}
+	pair.Token, err = token.Sign(token.Claims{
+		ID:       member.ID,
+		UUID:     member.UUID,
+		Mail:     member.Mail.String,
+		Nickname: member.Nickname.String,
+		Role:     member.Role.Int,
+		Scopes:   scopes,
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if enrollOnly {
+		return pair, nil
+	}
+
+	refreshToken, hash, err := token.GenOpaqueToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = TokenAPI.InsertToken(ctx, MemberToken{
+		MemberID:  member.ID,
+		Purpose:   tokenPurposeRefresh,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(time.Duration(config.Config.Token.RefreshTTL) * time.Second),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	pair.RefreshToken = refreshToken
+	return pair, nil
+}
+
+// twoFactorEnrollRoutes are the only routes open to callers yet to turn on the two-factor authentication required of them
+var twoFactorEnrollRoutes = map[string]bool{
+	"/member/2fa/enroll":  true,
+	"/member/2fa/confirm": true,
+}
+
+// authenticate validates the bearer token if there is one, and sets the calling member into context.
+// Requests without Authorization header pass through as anonymous.
+// Callers who have to turn on two-factor authentication are refused anywhere but twoFactorEnrollRoutes,
+// whatever scopes their tokens carry.
+func (r *memberHandler) authenticate(c *gin.Context) {
+
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		c.Next()
+		return
+	}
+	if !strings.HasPrefix(header, "Bearer ") {
+		rt.RespondError(c, ErrInvalidToken)
+		return
+	}
+	claims, err := token.Parse(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		rt.RespondError(c, ErrInvalidToken)
+		return
+	}
+	caller, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{
+		ID:     strconv.FormatInt(claims.ID, 10),
+		IDType: "id",
+	})
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		rt.RespondError(c, err)
+		return
+	}
+	if err != nil || caller.Active.Int != int64(config.Config.Models.Members["active"]) {
+		rt.RespondError(c, ErrInvalidToken)
+		return
+	}
+	if twoFactorSetupRequired(caller) && !twoFactorEnrollRoutes[c.FullPath()] {
+		rt.RespondError(c, ErrTwoFactorSetupRequired)
+		return
+	}
+	c.Set(callerKey, caller)
+	c.Set(claimsKey, claims)
+	c.Next()
+}
+
+// callerFrom returns the member authenticated for this request, if any
+func callerFrom(c *gin.Context) (caller Member, ok bool) {
+	v, exists := c.Get(callerKey)
+	if !exists {
+		return Member{}, false
+	}
+	caller, ok = v.(Member)
+	return caller, ok
+}
+
+// Scopes granted by role_scopes, the same names other readr services expect in tokens
+const (
+	scopeMemberManage  = "memberManage"
+	scopeUpdateAccount = "updateAccount"
+	scopeDeleteAccount = "deleteAccount"
+	// scopeTwoFactorEnroll is the only scope in tokens of members yet to turn on required two-factor authentication
+	scopeTwoFactorEnroll = "twoFactorEnroll"
+)
+
+// scopesOf returns scopes of the role of m, configured in role_scopes by role name
+func scopesOf(m Member) []string {
+	if !m.Role.Valid {
+		return nil
+	}
+	for name, role := range config.Config.Models.MemberRole {
+		if int64(role) == m.Role.Int {
+			return config.Config.RoleScopes[name]
+		}
+	}
+	return nil
+}
+
+// hasScopes reports whether m is granted all of scopes
+func hasScopes(m Member, scopes ...string) bool {
+	granted := scopesOf(m)
+	for _, scope := range scopes {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireScopes aborts requests unless the caller is granted all of scopes.
+// Scopes follow the current role of caller, instead of the role when its token was signed.
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, ok := callerFrom(c)
+		switch {
+		case !ok:
+			rt.RespondError(c, ErrUnauthorized)
+		case !hasScopes(caller, scopes...):
+			rt.RespondError(c, ErrForbidden)
+		default:
+			c.Next()
+		}
+	}
+}
+
+// ownerOrManager reports whether the caller could act on member id, either on itself with scope,
+// or on anyone with memberManage. Otherwise it responds 401 or 403.
+func ownerOrManager(c *gin.Context, id int64, scope string) bool {
+	caller, ok := callerFrom(c)
+	switch {
+	case !ok:
+		rt.RespondError(c, ErrUnauthorized)
+		return false
+	case hasScopes(caller, scopeMemberManage):
+		return true
+	case caller.ID == id && hasScopes(caller, scope):
+		return true
+	default:
+		rt.RespondError(c, ErrForbidden)
+		return false
+	}
+}
+
+// isManager reports whether the caller of c is granted memberManage
+func isManager(c *gin.Context) bool {
+	caller, ok := callerFrom(c)
+	return ok && hasScopes(caller, scopeMemberManage)
+}
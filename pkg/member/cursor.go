@@ -0,0 +1,124 @@
+package member
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// memberSortTypes are types of columns members could be sorted by, which values of cursors are decoded into
+var memberSortTypes = rrsql.FilterColumns(Member{}, memberSortColumns...)
+
+// parseMemberCursor decodes a cursor given by memberCursors, of members sorted by sort
+func parseMemberCursor(encoded string, sort string) (*rrsql.Cursor, error) {
+	keys, err := rrsql.ParseSort(sort, memberSortColumns, "id")
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := rrsql.DecodeCursor(encoded, sort, keys, memberSortTypes)
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// keysetQuery returns the condition of members after cursor and the ORDER BY expressions to fetch them,
+// of members sorted by sort. Without cursor, there is no condition and members are fetched in the order of sort.
+// Members before backward cursors are fetched in reverse order, and have to be reversed back.
+func keysetQuery(sort string, cursor *rrsql.Cursor) (restricts string, values []interface{}, orderBy string, err error) {
+	keys, err := rrsql.ParseSort(sort, memberSortColumns, "id")
+	if err != nil {
+		return "", nil, "", err
+	}
+	if cursor == nil {
+		return "", nil, rrsql.OrderBy(keys), nil
+	}
+	restricts, values = rrsql.KeysetRestricts(*cursor, keys, "members")
+	if cursor.Backward {
+		keys = rrsql.ReverseSort(keys)
+	}
+	return restricts, values, rrsql.OrderBy(keys), nil
+}
+
+// memberCursors returns cursors to the pages after and before rows, columns mapped to values, sorted by sort.
+// rows are fetched from cursor, or page if there is no cursor. There is no next page once rows are fewer than maxResult,
+// and no previous page for the first page.
+func memberCursors(sort string, rows []map[string]interface{}, maxResult int, cursor *rrsql.Cursor, page int) (next string, prev string) {
+	keys, err := rrsql.ParseSort(sort, memberSortColumns, "id")
+	if err != nil || len(rows) == 0 {
+		return "", ""
+	}
+	full := len(rows) >= maxResult
+	hasNext, hasPrev := full, page > 1
+	if cursor != nil {
+		hasNext, hasPrev = full || cursor.Backward, !cursor.Backward || full
+	}
+	if hasNext {
+		next = rrsql.NewCursor(sort, keys, rows[len(rows)-1], false).Encode()
+	}
+	if hasPrev {
+		prev = rrsql.NewCursor(sort, keys, rows[0], true).Encode()
+	}
+	return next, prev
+}
+
+// joinRestricts joins non-empty conditions with AND
+func joinRestricts(restricts ...string) string {
+	where := []string{}
+	for _, r := range restricts {
+		if r != "" {
+			where = append(where, r)
+		}
+	}
+	return strings.Join(where, " AND ")
+}
+
+// stuntValues maps columns of s to their values, with nil for those not selected or NULL
+func stuntValues(s Stunt) map[string]interface{} {
+	values := make(map[string]interface{})
+	v := reflect.ValueOf(s)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() != reflect.Ptr {
+			continue
+		}
+		if f.IsNil() {
+			values[v.Type().Field(i).Tag.Get("db")] = nil
+		} else {
+			values[v.Type().Field(i).Tag.Get("db")] = f.Elem().Interface()
+		}
+	}
+	return values
+}
+
+// projectStunt leaves only fields of s, clearing other columns selected along with them
+func projectStunt(s Stunt, fields []string) Stunt {
+	v := reflect.ValueOf(&s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		selected := false
+		for _, f := range fields {
+			selected = selected || f == v.Type().Field(i).Tag.Get("db")
+		}
+		if !selected && v.Field(i).Kind() == reflect.Ptr {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+	return s
+}
+
+// withSortColumns appends columns sorted by to fields if they are not selected, so cursors could be made of them
+func withSortColumns(fields rrsql.Sqlfields, sort string) rrsql.Sqlfields {
+	keys, _ := rrsql.ParseSort(sort, memberSortColumns, "id")
+	result := append(rrsql.Sqlfields{}, fields...)
+NextKey:
+	for _, k := range keys {
+		for _, f := range result {
+			if f == k.Column {
+				continue NextKey
+			}
+		}
+		result = append(result, k.Column)
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package member
+
+import (
+	"github.com/readr-media/readr-restful-member/internal/apierror"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// Errors responded by member APIs. Handlers respond them as they are with rt.RespondError,
+// so each one has the same status and code wherever it happens.
+var (
+	ErrInvalidInput         = apierror.New(apierror.Invalid, "invalid_input", "Invalid Input")
+	ErrInvalidQuery         = apierror.New(apierror.Invalid, "invalid_query", "Invalid Query")
+	ErrInvalidRequestBody   = apierror.New(apierror.Invalid, "invalid_request_body", "Invalid Request Body")
+	ErrInvalidUser          = apierror.New(apierror.Invalid, "invalid_user", "Invalid User")
+	ErrInvalidMemberData    = apierror.New(apierror.Invalid, "invalid_member_data", "Invalid Member Data")
+	ErrInvalidIdentity      = apierror.New(apierror.Invalid, "invalid_identity", "Invalid Identity")
+	ErrInvalidFields        = apierror.New(apierror.Invalid, "invalid_fields", "Invalid fields")
+	ErrInvalidKeyword       = apierror.New(apierror.Invalid, "invalid_keyword", "Invalid keyword")
+	ErrInvalidRoles         = apierror.New(apierror.Invalid, "invalid_roles", "Invalid roles")
+	ErrInvalidPage          = apierror.New(apierror.Invalid, "invalid_page", "Invalid Page")
+	ErrInvalidAction        = apierror.New(apierror.Invalid, "invalid_action", "Invalid Action")
+	ErrIDListEmpty          = apierror.New(apierror.Invalid, "id_list_empty", "ID List Empty")
+	ErrOldPasswordRequired  = apierror.New(apierror.Invalid, "old_password_required", "Old Password Required")
+	ErrTwoFactorNotEnrolled = apierror.New(apierror.Invalid, "two_factor_not_enrolled", "Two Factor Not Enrolled")
+	ErrPasswordTooLong      = apierror.New(apierror.Invalid, "password_too_long", "Password Too Long")
+	ErrPasswordPolicy       = apierror.New(apierror.Unprocessable, "password_policy_violation", "Password Policy Violation")
+
+	ErrUnauthorized           = apierror.New(apierror.Unauthorized, "unauthorized", "Unauthorized")
+	ErrInvalidToken           = apierror.New(apierror.Unauthorized, "invalid_token", "Invalid Token")
+	ErrTokenExpired           = apierror.New(apierror.Unauthorized, "token_expired", "Token Expired")
+	ErrWrongPassword          = apierror.New(apierror.Unauthorized, "wrong_password", "Wrong Password")
+	ErrTwoFactorRequired      = apierror.New(apierror.Unauthorized, "two_factor_required", "Two Factor Required")
+	ErrInvalidCode            = apierror.New(apierror.Unauthorized, "invalid_code", "Invalid Code")
+	ErrForbidden              = apierror.New(apierror.Forbidden, "forbidden", "Forbidden")
+	ErrForbiddenFields        = apierror.New(apierror.Forbidden, "forbidden_fields", "Forbidden Fields")
+	ErrTwoFactorSetupRequired = apierror.New(apierror.Forbidden, "two_factor_setup_required", "Two Factor Setup Required")
+	ErrUserNotVerified        = apierror.New(apierror.Forbidden, "user_not_verified", "User Not Verified")
+	ErrUserDeactivated        = apierror.New(apierror.Forbidden, "user_deactivated", "User Deactivated")
+	ErrTooManyAttempts        = apierror.New(apierror.TooManyRequests, "too_many_attempts", "Too Many Attempts")
+	ErrTooManyExports         = apierror.New(apierror.TooManyRequests, "too_many_exports", "Too Many Exports")
+
+	ErrUserNotFound         = apierror.New(apierror.NotFound, "user_not_found", "User Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrMembersNotFound      = apierror.New(apierror.NotFound, "members_not_found", "Members Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrTokenNotFound        = apierror.New(apierror.NotFound, "token_not_found", "Token Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrTwoFactorNotFound    = apierror.New(apierror.NotFound, "two_factor_not_found", "Two Factor Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrRecoveryCodeNotFound = apierror.New(apierror.NotFound, "recovery_code_not_found", "Recovery Code Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrIdentityNotFound     = apierror.New(apierror.NotFound, "identity_not_found", "Identity Not Found").Wrap(rrsql.ItemNotFoundError)
+	ErrExportNotFound       = apierror.New(apierror.NotFound, "export_not_found", "Export Not Found").Wrap(rrsql.ItemNotFoundError)
+
+	ErrUserExisted           = apierror.New(apierror.Conflict, "user_already_existed", "User Already Existed").Wrap(rrsql.DuplicateError)
+	ErrIdentityAlreadyLinked = apierror.New(apierror.Conflict, "identity_already_linked", "Identity Already Linked").Wrap(rrsql.DuplicateError)
+	ErrUserNotDeleted        = apierror.New(apierror.Conflict, "user_not_deleted", "User Not Deleted")
+	ErrUserAnonymized        = apierror.New(apierror.Conflict, "user_anonymized", "User Anonymized")
+	ErrMemberIDTaken         = apierror.New(apierror.Conflict, "member_id_taken", "Member ID Taken")
+	ErrMailTaken             = apierror.New(apierror.Conflict, "mail_taken", "Mail Taken")
+	ErrTwoFactorEnabled      = apierror.New(apierror.Conflict, "two_factor_enabled", "Two Factor Enabled")
+	ErrCodeAlreadyUsed       = apierror.New(apierror.Conflict, "code_already_used", "Code Already Used")
+	ErrLastLoginMethod       = apierror.New(apierror.Conflict, "last_login_method", "Last Login Method")
+	ErrExportNotReady        = apierror.New(apierror.Conflict, "export_not_ready", "Export Not Ready")
+	ErrUserDeleted           = apierror.New(apierror.Gone, "user_deleted", "User Deleted")
+	ErrExportExpired         = apierror.New(apierror.Gone, "export_expired", "Export Expired")
+	ErrExportFailed          = apierror.New(apierror.Internal, "export_failed", "Export Failed")
+)
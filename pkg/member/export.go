@@ -0,0 +1,395 @@
+package member
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+const (
+	exportStatusPending = "pending"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+)
+
+// MemberExport maps the schema of table 'member_exports'.
+// Every export is an archive of data kept about a member, built in background for large accounts.
+type MemberExport struct {
+	ID          int64          `json:"id" db:"id"`
+	MemberID    int64          `json:"member_id" db:"member_id"`
+	RequestedBy rrsql.NullInt  `json:"requested_by" db:"requested_by"`
+	Status      string         `json:"status" db:"status"`
+	Archive     []byte         `json:"-" db:"archive"`
+	Size        int64          `json:"size" db:"size"`
+	CreatedAt   rrsql.NullTime `json:"created_at" db:"created_at"`
+	FinishedAt  rrsql.NullTime `json:"finished_at" db:"finished_at"`
+	ExpiresAt   rrsql.NullTime `json:"expires_at" db:"expires_at"`
+}
+
+// exportBuilds counts archives building in background, bounded by config.Config.Export.Workers.
+// Once stopped, no more exports are built, and StopExports waits for those still building.
+var exportBuilds = struct {
+	sync.Mutex
+	running int
+	stopped bool
+	done    sync.WaitGroup
+}{}
+
+// exportColumns are columns of member_exports except the archive, which is loaded only for downloads
+const exportColumns = `id, member_id, requested_by, status, size, created_at, finished_at, expires_at`
+
+type exportAPI struct{}
+
+var ExportAPI ExportInterface = new(exportAPI)
+
+type ExportInterface interface {
+	// InsertExport adds a pending export, replacing earlier exports of the same member
+	InsertExport(ctx context.Context, e MemberExport) (int64, error)
+	// FinishExport saves the status, and archive if it is ready, of an export
+	FinishExport(ctx context.Context, e MemberExport) error
+	GetExport(ctx context.Context, memberID int64, id int64) (MemberExport, error)
+	GetLatestExport(ctx context.Context, memberID int64) (MemberExport, error)
+	GetArchive(ctx context.Context, memberID int64, id int64) ([]byte, error)
+}
+
+func (a *exportAPI) InsertExport(ctx context.Context, e MemberExport) (id int64, err error) {
+	err = rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM member_exports WHERE member_id = ?`, e.MemberID); err != nil {
+			return err
+		}
+		result, err := tx.NamedExecContext(ctx, `INSERT INTO member_exports (member_id, requested_by, status, created_at)
+			VALUES (:member_id, :requested_by, :status, :created_at)`, e)
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+func (a *exportAPI) FinishExport(ctx context.Context, e MemberExport) error {
+	_, err := rrsql.DB.NamedExecContext(ctx, `UPDATE member_exports SET status = :status, archive = :archive, size = :size,
+		finished_at = :finished_at, expires_at = :expires_at WHERE id = :id`, e)
+	return err
+}
+
+func (a *exportAPI) GetExport(ctx context.Context, memberID int64, id int64) (result MemberExport, err error) {
+	err = rrsql.DB.GetContext(ctx, &result, `SELECT `+exportColumns+` FROM member_exports WHERE member_id = ? AND id = ?`, memberID, id)
+	if err == sql.ErrNoRows {
+		return MemberExport{}, ErrExportNotFound
+	}
+	return result, err
+}
+
+func (a *exportAPI) GetLatestExport(ctx context.Context, memberID int64) (result MemberExport, err error) {
+	err = rrsql.DB.GetContext(ctx, &result, `SELECT `+exportColumns+` FROM member_exports WHERE member_id = ? ORDER BY id DESC LIMIT 1`, memberID)
+	if err == sql.ErrNoRows {
+		return MemberExport{}, ErrExportNotFound
+	}
+	return result, err
+}
+
+func (a *exportAPI) GetArchive(ctx context.Context, memberID int64, id int64) (result []byte, err error) {
+	err = rrsql.DB.GetContext(ctx, &result, `SELECT archive FROM member_exports WHERE member_id = ? AND id = ?`, memberID, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrExportNotFound
+	}
+	return result, err
+}
+
+// RequestExport returns the archive of member right away if it is small enough.
+// Otherwise it returns an export building the archive in background, or the one already requested
+// if it is still building or downloadable. ErrTooManyExports is returned if all workers are busy.
+func RequestExport(ctx context.Context, member Member, requestedBy int64) (archive []byte, export MemberExport, err error) {
+
+	total, err := AuditAPI.CountHistory(ctx, &GetHistoryArgs{MemberID: member.ID})
+	if err != nil {
+		return nil, MemberExport{}, err
+	}
+	if total <= config.Config.Export.SyncLimit {
+		archive, err = BuildArchive(ctx, member)
+		return archive, MemberExport{}, err
+	}
+
+	now := time.Now()
+	latest, err := ExportAPI.GetLatestExport(ctx, member.ID)
+	switch {
+	case err == nil && latest.Status == exportStatusPending && !exportExpired(latest.CreatedAt, now):
+		return nil, latest, nil
+	case err == nil && latest.Status == exportStatusReady && latest.ExpiresAt.Time.After(now):
+		return nil, latest, nil
+	case err != nil && !errors.Is(err, ErrExportNotFound):
+		return nil, MemberExport{}, err
+	}
+
+	if !startExportBuild() {
+		return nil, MemberExport{}, ErrTooManyExports
+	}
+	export = MemberExport{
+		MemberID:    member.ID,
+		RequestedBy: rrsql.NullInt{Int: requestedBy, Valid: requestedBy != 0},
+		Status:      exportStatusPending,
+		CreatedAt:   rrsql.NullTime{Time: now, Valid: true},
+	}
+	if export.ID, err = ExportAPI.InsertExport(ctx, export); err != nil {
+		finishExportBuild()
+		return nil, MemberExport{}, err
+	}
+	go func() {
+		defer finishExportBuild()
+		// ctx of the request is canceled once it is answered, long before the archive is built
+		buildExport(context.Background(), member, export)
+	}()
+	return nil, export, nil
+}
+
+// startExportBuild takes a worker for building an archive, reporting false if none is left
+func startExportBuild() bool {
+	exportBuilds.Lock()
+	defer exportBuilds.Unlock()
+	if exportBuilds.stopped || exportBuilds.running >= config.Config.Export.Workers {
+		return false
+	}
+	exportBuilds.running++
+	exportBuilds.done.Add(1)
+	return true
+}
+
+// finishExportBuild gives back the worker taken by startExportBuild
+func finishExportBuild() {
+	exportBuilds.Lock()
+	exportBuilds.running--
+	exportBuilds.Unlock()
+	exportBuilds.done.Done()
+}
+
+// StopExports refuses exports requested afterwards, and waits for archives still building until ctx is done.
+// Exports left pending are expired after TTL, and could be requested again then.
+func StopExports(ctx context.Context) error {
+	exportBuilds.Lock()
+	exportBuilds.stopped = true
+	exportBuilds.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		exportBuilds.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exportExpired reports whether an export started at createdAt is left pending for too long,
+// such as when the process building it exits
+func exportExpired(createdAt rrsql.NullTime, now time.Time) bool {
+	return createdAt.Time.Add(time.Duration(config.Config.Export.TTL) * time.Second).Before(now)
+}
+
+// buildExport builds the archive of a pending export, and saves it to be downloaded until TTL expires
+func buildExport(ctx context.Context, member Member, export MemberExport) {
+
+	archive, err := BuildArchive(ctx, member)
+	now := time.Now()
+	export.FinishedAt = rrsql.NullTime{Time: now, Valid: true}
+	if err != nil {
+		log.Printf("Error exporting member %d: %v\n", member.ID, err)
+		export.Status = exportStatusFailed
+	} else {
+		export.Status = exportStatusReady
+		export.Archive, export.Size = archive, int64(len(archive))
+		export.ExpiresAt = rrsql.NullTime{Time: now.Add(time.Duration(config.Config.Export.TTL) * time.Second), Valid: true}
+	}
+	if err = ExportAPI.FinishExport(ctx, export); err != nil {
+		log.Printf("Error saving export %d of member %d: %v\n", export.ID, member.ID, err)
+	}
+}
+
+// GetExportArchive returns the archive of export id of member once it is ready and not expired
+func GetExportArchive(ctx context.Context, memberID int64, id int64) ([]byte, error) {
+
+	export, err := ExportAPI.GetExport(ctx, memberID, id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case export.Status == exportStatusPending:
+		return nil, ErrExportNotReady
+	case export.Status == exportStatusFailed:
+		return nil, ErrExportFailed
+	case !export.ExpiresAt.Time.After(time.Now()):
+		return nil, ErrExportExpired
+	}
+	return ExportAPI.GetArchive(ctx, memberID, id)
+}
+
+// exportManifest describes an archive, written as manifest.json
+type exportManifest struct {
+	MemberID    int64     `json:"member_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Files       []string  `json:"files"`
+}
+
+// exportPoints is the points section of an archive
+type exportPoints struct {
+	MemberID      int64          `json:"member_id"`
+	Points        rrsql.NullInt  `json:"points"`
+	PremiumBefore rrsql.NullTime `json:"premium_before"`
+}
+
+// exportNotifications is the notification preferences section of an archive
+type exportNotifications struct {
+	MemberID    int64          `json:"member_id"`
+	ProfilePush rrsql.NullBool `json:"profile_push"`
+	PostPush    rrsql.NullBool `json:"post_push"`
+	DailyPush   rrsql.NullBool `json:"daily_push"`
+	CommentPush rrsql.NullBool `json:"comment_push"`
+}
+
+// BuildArchive zips the member record, linked identities, audit trail, points, follows and notification preferences
+// of member, each as JSON and CSV. Fields hidden from API responses, such as password and salt, are left out.
+func BuildArchive(ctx context.Context, member Member) ([]byte, error) {
+
+	identities, err := IdentityAPI.GetIdentities(ctx, member.ID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := exportHistory(ctx, member.ID)
+	if err != nil {
+		return nil, err
+	}
+	follows, err := FollowAPI.GetFollows(ctx, member.ID)
+	if err != nil {
+		return nil, err
+	}
+	sections := []struct {
+		name string
+		rows interface{}
+	}{
+		{"member", []Member{member}},
+		{"identities", identities},
+		{"history", history},
+		{"points", []exportPoints{{MemberID: member.ID, Points: member.Points, PremiumBefore: member.PremiumBefore}}},
+		{"follows", follows},
+		{"notifications", []exportNotifications{{MemberID: member.ID, ProfilePush: member.ProfilePush, PostPush: member.PostPush,
+			DailyPush: member.DailyPush, CommentPush: member.CommentPush}}},
+	}
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	manifest := exportManifest{MemberID: member.ID, GeneratedAt: time.Now()}
+	for _, section := range sections {
+		f, err := w.Create(section.name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(section.rows); err != nil {
+			return nil, err
+		}
+		if f, err = w.Create(section.name + ".csv"); err != nil {
+			return nil, err
+		}
+		if err = writeCSV(f, section.rows); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, section.name+".json", section.name+".csv")
+	}
+	f, err := w.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	if err = json.NewEncoder(f).Encode(manifest); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportHistory returns the whole audit trail of member, latest first
+func exportHistory(ctx context.Context, memberID int64) ([]MemberAudit, error) {
+	history := []MemberAudit{}
+	args := &GetHistoryArgs{MemberID: memberID, MaxResult: math.MaxUint8, Page: 1}
+	for {
+		page, err := AuditAPI.GetHistory(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, page...)
+		if len(page) < int(args.MaxResult) {
+			return history, nil
+		}
+		args.Page++
+	}
+}
+
+// writeCSV writes rows, a slice of structs, as CSV headed by their JSON names.
+// Fields hidden from JSON are left out, and values are written as JSON, with strings unquoted.
+func writeCSV(w io.Writer, rows interface{}) error {
+
+	v := reflect.ValueOf(rows)
+	t := v.Type().Elem()
+	header, fields := []string{}, []int{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		header, fields = append(header, name), append(fields, i)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		record := make([]string, len(fields))
+		for n, field := range fields {
+			b, err := json.Marshal(v.Index(i).Field(field).Interface())
+			if err != nil {
+				return err
+			}
+			record[n] = csvValue(b)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvValue turns JSON value b into a CSV cell, empty for null
+func csvValue(b []byte) string {
+	var s string
+	switch {
+	case string(b) == "null":
+		return ""
+	case json.Unmarshal(b, &s) == nil:
+		return s
+	default:
+		return string(b)
+	}
+}
@@ -0,0 +1,92 @@
+package member
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// parseFields parses fields of members to respond, a list in JSON such as ["id","nickname"],
+// or the name of a preset in config such as card. Fields have to be shown in responses.
+func parseFields(raw string) (fields rrsql.Sqlfields, err error) {
+	if strings.HasPrefix(raw, "[") {
+		if err = json.Unmarshal([]byte(raw), &fields); err != nil {
+			return nil, ErrInvalidFields
+		}
+	} else if preset, ok := config.Config.FieldPresets[raw]; ok {
+		fields = preset
+	} else {
+		return nil, ErrInvalidFields.WithDetails([]string{raw})
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidFields
+	}
+	validFields := visibleColumns(Stunt{})
+CheckEachFieldLoop:
+	for _, f := range fields {
+		for _, F := range validFields {
+			if f == F {
+				continue CheckEachFieldLoop
+			}
+		}
+		return nil, ErrInvalidFields.WithDetails([]string{f})
+	}
+	return fields, nil
+}
+
+// selectedColumns returns the columns to select for fields, all of them if there are no fields
+func selectedColumns(fields rrsql.Sqlfields) string {
+	if len(fields) == 0 {
+		return "*"
+	}
+	return fields.GetFields(`%s "%s"`)
+}
+
+// stuntOf projects fields of m into Stunt, the way FilterMembers selects only fields asked for.
+// NULL columns are left nil like they are scanned.
+func stuntOf(m Member, fields []string) (s Stunt) {
+	values := memberValues(m)
+	sv := reflect.ValueOf(&s).Elem()
+	for i := 0; i < sv.NumField(); i++ {
+		tag := sv.Type().Field(i).Tag.Get("db")
+		selected := false
+		for _, f := range fields {
+			selected = selected || f == tag
+		}
+		if valuer, ok := values[tag].(driver.Valuer); !selected || ok && isNull(valuer) {
+			continue
+		}
+		v, f := reflect.ValueOf(values[tag]), sv.Field(i)
+		if f.Kind() == reflect.Ptr {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			f.Set(p)
+		} else {
+			f.Set(v)
+		}
+	}
+	return s
+}
+
+func isNull(v driver.Valuer) bool {
+	value, _ := v.Value()
+	return value == nil
+}
+
+// hiddenFields returns fields not in visible
+func hiddenFields(fields rrsql.Sqlfields, visible []string) (hidden []string) {
+CheckEachFieldLoop:
+	for _, f := range fields {
+		for _, v := range visible {
+			if f == v {
+				continue CheckEachFieldLoop
+			}
+		}
+		hidden = append(hidden, f)
+	}
+	return hidden
+}
@@ -0,0 +1,33 @@
+package member
+
+import (
+	"context"
+
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// MemberFollow maps the schema of table 'following', shared with the main readr-restful service.
+// Every row is a member following, liking or disliking a target, with Type of config following_type
+// and Emotion of config emotions.
+type MemberFollow struct {
+	MemberID  int64          `json:"member_id" db:"member_id"`
+	TargetID  int64          `json:"target_id" db:"target_id"`
+	Type      int            `json:"type" db:"type"`
+	Emotion   int            `json:"emotion" db:"emotion"`
+	CreatedAt rrsql.NullTime `json:"created_at" db:"created_at"`
+}
+
+type followAPI struct{}
+
+var FollowAPI FollowInterface = new(followAPI)
+
+type FollowInterface interface {
+	GetFollows(ctx context.Context, memberID int64) ([]MemberFollow, error)
+}
+
+func (a *followAPI) GetFollows(ctx context.Context, memberID int64) (result []MemberFollow, err error) {
+	result = []MemberFollow{}
+	err = rrsql.DB.SelectContext(ctx, &result, `SELECT member_id, target_id, type, emotion, created_at FROM following
+		WHERE member_id = ? ORDER BY created_at`, memberID)
+	return result, err
+}
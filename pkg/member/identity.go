@@ -0,0 +1,116 @@
+package member
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// MemberIdentity maps the schema of table 'member_identities'.
+// Every identity links an account of a social login provider, such as oauth-fb or oauth-goo, to a member.
+type MemberIdentity struct {
+	ID        int64          `json:"id" db:"id"`
+	MemberID  int64          `json:"member_id" db:"member_id"`
+	Provider  string         `json:"provider" db:"provider"`
+	Subject   string         `json:"subject" db:"subject"`
+	CreatedAt rrsql.NullTime `json:"created_at" db:"created_at"`
+}
+
+type identityAPI struct{}
+
+var IdentityAPI IdentityInterface = new(identityAPI)
+
+type IdentityInterface interface {
+	GetIdentities(ctx context.Context, memberID int64) ([]MemberIdentity, error)
+	InsertIdentity(ctx context.Context, i MemberIdentity) (int64, error)
+	// DeleteIdentity unlinks provider from member, unless keep says the remaining identities are not enough
+	DeleteIdentity(ctx context.Context, memberID int64, provider string, keep func(remaining []MemberIdentity) error) error
+}
+
+func (a *identityAPI) GetIdentities(ctx context.Context, memberID int64) (result []MemberIdentity, err error) {
+	result = []MemberIdentity{}
+	err = rrsql.DB.SelectContext(ctx, &result, `SELECT * FROM member_identities WHERE member_id = ? ORDER BY id`, memberID)
+	return result, err
+}
+
+func (a *identityAPI) InsertIdentity(ctx context.Context, i MemberIdentity) (int64, error) {
+	result, err := rrsql.DB.NamedExecContext(ctx, `INSERT INTO member_identities (member_id, provider, subject)
+		VALUES (:member_id, :provider, :subject)`, i)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return 0, ErrIdentityAlreadyLinked
+		}
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (a *identityAPI) DeleteIdentity(ctx context.Context, memberID int64, provider string, keep func(remaining []MemberIdentity) error) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		// Lock identities of member, so concurrent unlinks couldn't remove the last two together
+		identities := []MemberIdentity{}
+		if err := tx.SelectContext(ctx, &identities, `SELECT * FROM member_identities WHERE member_id = ? FOR UPDATE`, memberID); err != nil {
+			return err
+		}
+		remaining, found := []MemberIdentity{}, false
+		for _, i := range identities {
+			if i.Provider == provider {
+				found = true
+			} else {
+				remaining = append(remaining, i)
+			}
+		}
+		if !found {
+			return ErrIdentityNotFound
+		}
+		if err := keep(remaining); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM member_identities WHERE member_id = ? AND provider = ?`, memberID, provider)
+		return err
+	})
+}
+
+func validateProvider(provider string) bool {
+	for _, p := range config.Config.IdentityProviders {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPassword reports whether member could log in with password
+func hasPassword(member Member) bool {
+	return member.Password.Valid && member.Password.String != ""
+}
+
+// LinkIdentity links the account subject of provider to member.
+// An account links to only one member, and a member links only one account of each provider.
+func LinkIdentity(ctx context.Context, member Member, provider string, subject string) (MemberIdentity, error) {
+
+	if !validateProvider(provider) || subject == "" {
+		return MemberIdentity{}, ErrInvalidIdentity
+	}
+	identity := MemberIdentity{MemberID: member.ID, Provider: provider, Subject: subject}
+	id, err := IdentityAPI.InsertIdentity(ctx, identity)
+	if err != nil {
+		return MemberIdentity{}, err
+	}
+	identity.ID = id
+	return identity, nil
+}
+
+// UnlinkIdentity removes the identity of provider from member.
+// The last way to log in, either an identity or password, couldn't be removed.
+func UnlinkIdentity(ctx context.Context, member Member, provider string) error {
+	return IdentityAPI.DeleteIdentity(ctx, member.ID, provider, func(remaining []MemberIdentity) error {
+		if len(remaining) == 0 && !hasPassword(member) {
+			return ErrLastLoginMethod
+		}
+		return nil
+	})
+}
@@ -0,0 +1,261 @@
+package member
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// PurgeCandidate is a deleted member erased, or to be erased, by the purge
+type PurgeCandidate struct {
+	ID        int64          `json:"id" db:"id"`
+	MemberID  string         `json:"member_id" db:"member_id"`
+	DeletedAt rrsql.NullTime `json:"deleted_at" db:"deleted_at"`
+}
+
+// memberTables are tables keeping rows of members by member_id, erased along with members
+var memberTables = []string{"member_tokens", "member_identities", "member_two_factor", "member_recovery_codes", "member_audit", "member_exports", "following"}
+
+// credentialTables are tables keeping credentials, linked accounts and exports of members by member_id,
+// erased when members are anonymized
+var credentialTables = []string{"member_tokens", "member_identities", "member_two_factor", "member_recovery_codes", "member_exports"}
+
+// personalFields are scrubbed from members by anonymization, and from their audit trail
+var personalFields = []string{"member_id", "name", "nickname", "mail", "phone", "birthday", "social_id", "talk_id",
+	"profile_image", "description", "password", "salt", "password_changed_at", "two_factor_enabled"}
+
+// RestoreMember brings a deleted member back to the state before deletion.
+// It fails if member_id or mail of the member is taken by another member since.
+func (a *memberAPI) RestoreMember(ctx context.Context, id int64, meta AuditMeta) (member Member, err error) {
+	err = rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		before := Member{}
+		if err := tx.GetContext(ctx, &before, `SELECT * FROM members WHERE id = ? FOR UPDATE`, id); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		if before.AnonymizedAt.Valid {
+			return ErrUserAnonymized
+		}
+		if before.Active.Int != int64(config.Config.Models.Members["delete"]) {
+			return ErrUserNotDeleted
+		}
+
+		taken := 0
+		err := tx.GetContext(ctx, &taken, `SELECT COUNT(*) FROM members WHERE id != ? AND active != ? AND member_id = ?`,
+			id, config.Config.Models.Members["delete"], before.MemberID)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrMemberIDTaken
+		}
+		if before.Mail.String != "" {
+			err = tx.GetContext(ctx, &taken, `SELECT COUNT(*) FROM members WHERE id != ? AND active != ? AND mail = ?`,
+				id, config.Config.Models.Members["delete"], before.Mail.String)
+			if err != nil {
+				return err
+			}
+			if taken > 0 {
+				return ErrMailTaken
+			}
+		}
+
+		member = before
+		member.Active = restoredActive(before)
+		member.DeletedAt, member.PrevActive = rrsql.NullTime{}, rrsql.NullInt{}
+		if _, err = tx.ExecContext(ctx, `UPDATE members SET active = ?, deleted_at = NULL, prev_active = NULL WHERE id = ?`, member.Active, id); err != nil {
+			return err
+		}
+		return insertAudit(ctx, tx, newAudit(id, meta, auditActionRestore, before, member, []string{"active", "deleted_at"}))
+	})
+	if err != nil {
+		return Member{}, err
+	}
+	return member, nil
+}
+
+// restoredActive returns the state m was in before deletion, or active if it is unknown
+func restoredActive(m Member) rrsql.NullInt {
+	if m.PrevActive.Valid && m.PrevActive.Int != int64(config.Config.Models.Members["delete"]) {
+		return m.PrevActive
+	}
+	return rrsql.NullInt{Int: int64(config.Config.Models.Members["active"]), Valid: true}
+}
+
+// PurgeMembers erases at most limit members deleted before deletedBefore, with their tokens, identities, exports,
+// two-factor secrets and audit trail. Only an audit of the purge itself is kept.
+// With dryRun, it returns the members to erase without erasing them.
+func (a *memberAPI) PurgeMembers(ctx context.Context, deletedBefore time.Time, limit int, dryRun bool, meta AuditMeta) (purged []PurgeCandidate, err error) {
+	err = rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		purged = []PurgeCandidate{}
+		query := `SELECT id, member_id, deleted_at FROM members WHERE active = ? AND deleted_at < ? ORDER BY deleted_at LIMIT ?`
+		if !dryRun {
+			query += ` FOR UPDATE`
+		}
+		if err := tx.SelectContext(ctx, &purged, query, config.Config.Models.Members["delete"], deletedBefore, limit); err != nil {
+			return err
+		}
+		if dryRun || len(purged) == 0 {
+			return nil
+		}
+
+		ids := make([]int64, len(purged))
+		for i, p := range purged {
+			ids[i] = p.ID
+		}
+		for _, table := range append(memberTables, "members") {
+			column := "member_id"
+			if table == "members" {
+				column = "id"
+			}
+			query, args, err := sqlx.In(`DELETE FROM `+table+` WHERE `+column+` IN (?)`, ids)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+				return err
+			}
+		}
+		for _, p := range purged {
+			audit := newAudit(p.ID, meta, auditActionPurge, Member{DeletedAt: p.DeletedAt}, Member{}, []string{"deleted_at"})
+			if err := insertAudit(ctx, tx, audit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// PurgeDeletedMembers erases a batch of members deleted longer than the grace period, or reports them with dryRun
+func PurgeDeletedMembers(ctx context.Context, dryRun bool, meta AuditMeta) ([]PurgeCandidate, error) {
+	deletedBefore := time.Now().Add(-time.Duration(config.Config.Purge.GracePeriod) * time.Second)
+	return MemberAPI.PurgeMembers(ctx, deletedBefore, config.Config.Purge.BatchSize, dryRun, meta)
+}
+
+// RunPurgeJob purges deleted members every interval, until the process exits.
+// Every run erases one batch, the rest are left to following runs.
+func RunPurgeJob(interval time.Duration) {
+	for range time.Tick(interval) {
+		purged, err := PurgeDeletedMembers(context.Background(), false, AuditMeta{})
+		if err != nil {
+			log.Printf("Error purging deleted members: %v\n", err)
+			continue
+		}
+		if len(purged) > 0 {
+			log.Printf("Purged %d deleted members\n", len(purged))
+		}
+	}
+}
+
+// anonymized returns m with personal data and credentials scrubbed, and member_id replaced by a tombstone.
+// id and uuid are kept, so references from elsewhere still work.
+func anonymized(m Member, now time.Time) Member {
+	tombstone := "anonymized-" + m.UUID
+	if m.UUID == "" {
+		tombstone = fmt.Sprintf("anonymized-%d", m.ID)
+	}
+	after := m
+	after.MemberID = tombstone
+	after.Name, after.Nickname, after.Mail, after.Phone = rrsql.NullString{}, rrsql.NullString{}, rrsql.NullString{}, rrsql.NullString{}
+	after.SocialID, after.TalkID, after.ProfileImage, after.Description = rrsql.NullString{}, rrsql.NullString{}, rrsql.NullString{}, rrsql.NullString{}
+	after.Birthday, after.PasswordChangedAt = rrsql.NullTime{}, rrsql.NullTime{}
+	after.Password, after.Salt = rrsql.NullString{}, rrsql.NullString{}
+	after.TwoFactorEnabled = rrsql.NullBool{Bool: false, Valid: true}
+	after.Active = rrsql.NullInt{Int: int64(config.Config.Models.Members["delete"]), Valid: true}
+	after.DeletedAt, after.PrevActive = rrsql.NullTime{}, rrsql.NullInt{}
+	after.AnonymizedAt = rrsql.NullTime{Time: now, Valid: true}
+	after.UpdatedAt = rrsql.NullTime{Time: now, Valid: true}
+	return after
+}
+
+// anonymizeAudit records the anonymization of before, without the personal data scrubbed
+func anonymizeAudit(meta AuditMeta, before Member, after Member) MemberAudit {
+	audit := newAudit(before.ID, meta, auditActionAnonymize, before, after, append(personalFields, "active", "deleted_at", "anonymized_at"))
+	redactPersonal(audit.Changes)
+	return audit
+}
+
+// redactPersonal hides values of personal fields in changes, and reports whether there are any
+func redactPersonal(changes AuditChanges) (redactedAny bool) {
+	for _, field := range personalFields {
+		if change, ok := changes[field]; ok && (change.Before != redacted || change.After != redacted) {
+			changes[field] = AuditChange{Before: redacted, After: redacted}
+			redactedAny = true
+		}
+	}
+	return redactedAny
+}
+
+// AnonymizeMembers scrubs personal data and credentials of members of ids, as an alternative to deletion
+// keeping their id and uuid referred elsewhere. Linked accounts and exports are erased, and personal data
+// in their audit trail redacted. Anonymized members stay deleted, and are skipped if anonymized again.
+func (a *memberAPI) AnonymizeMembers(ctx context.Context, ids []int64, meta AuditMeta) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		query, args, err := sqlx.In(`SELECT * FROM members WHERE id IN (?) FOR UPDATE`, ids)
+		if err != nil {
+			return err
+		}
+		before := []Member{}
+		if err = tx.SelectContext(ctx, &before, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return ErrMembersNotFound
+		}
+
+		now := time.Now()
+		for _, m := range before {
+			if m.AnonymizedAt.Valid {
+				continue
+			}
+			after := anonymized(m, now)
+			if _, err = tx.NamedExecContext(ctx, `UPDATE members SET member_id = :member_id, name = NULL, nickname = NULL, mail = NULL,
+				phone = NULL, birthday = NULL, social_id = NULL, talk_id = NULL, profile_image = NULL, description = NULL,
+				password = NULL, salt = NULL, password_changed_at = NULL, two_factor_enabled = 0, active = :active,
+				deleted_at = NULL, prev_active = NULL, anonymized_at = :anonymized_at, updated_at = :updated_at WHERE id = :id`, after); err != nil {
+				return err
+			}
+			for _, table := range credentialTables {
+				if _, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE member_id = ?`, m.ID); err != nil {
+					return err
+				}
+			}
+			if err = scrubAudits(ctx, tx, m.ID); err != nil {
+				return err
+			}
+			if err = insertAudit(ctx, tx, anonymizeAudit(meta, m, after)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scrubAudits redacts personal data in the audit trail of member id
+func scrubAudits(ctx context.Context, tx *sqlx.Tx, id int64) error {
+	audits := []MemberAudit{}
+	if err := tx.SelectContext(ctx, &audits, `SELECT * FROM member_audit WHERE member_id = ? FOR UPDATE`, id); err != nil {
+		return err
+	}
+	for _, audit := range audits {
+		if !redactPersonal(audit.Changes) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE member_audit SET changes = ? WHERE id = ?`, audit.Changes, audit.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/mail"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+	"github.com/readr-media/readr-restful-member/internal/token"
+)
+
+// tokenMail describes a mail carrying a link with a single-use token
+type tokenMail struct {
+	Purpose  string
+	TTL      time.Duration
+	URL      string
+	Template string
+	Subject  string
+}
+
+func passwordResetMail() tokenMail {
+	return tokenMail{
+		Purpose:  tokenPurposePasswordReset,
+		TTL:      time.Duration(config.Config.Token.PasswordResetTTL) * time.Second,
+		URL:      config.Config.Mail.ResetPasswordURL,
+		Template: "resetPassword.html",
+		Subject:  "Readr 密碼重設",
+	}
+}
+
+func verificationMail() tokenMail {
+	return tokenMail{
+		Purpose:  tokenPurposeVerifyMail,
+		TTL:      time.Duration(config.Config.Token.VerifyMailTTL) * time.Second,
+		URL:      config.Config.Mail.VerifyMailURL,
+		Template: "verifyMail.html",
+		Subject:  "Readr 信箱驗證",
+	}
+}
+
+// sendTokenMail issues a new token for member and mails the link with it.
+// Tokens issued before for the same purpose are revoked, so only the latest link works.
+func sendTokenMail(ctx context.Context, member Member, m tokenMail) error {
+
+	opaque, hash, err := token.GenOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err = TokenAPI.RevokeTokens(ctx, member.ID, m.Purpose); err != nil {
+		return err
+	}
+	err = TokenAPI.InsertToken(ctx, MemberToken{
+		MemberID:  member.ID,
+		Purpose:   m.Purpose,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(m.TTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(m.URL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", opaque)
+	link.RawQuery = query.Encode()
+
+	body, err := mail.Render(m.Template, struct {
+		Nickname  string
+		Link      string
+		ExpiresIn int
+	}{member.Nickname.String, link.String(), int(m.TTL.Minutes())})
+	if err != nil {
+		return err
+	}
+	return mail.MailAPI.Send(mail.MailArgs{
+		Receiver: []string{member.Mail.String},
+		Subject:  m.Subject,
+		Payload:  body,
+	})
+}
+
+// memberByMail returns the member owning address in state, or "User Not Found" error
+func memberByMail(ctx context.Context, address string, state string) (Member, error) {
+	member, err := MemberAPI.GetMember(ctx, GetMemberArgs{ID: address, IDType: "mail"})
+	if err != nil {
+		return Member{}, err
+	}
+	if member.Active.Int != int64(config.Config.Models.Members[state]) || !member.Mail.Valid {
+		return Member{}, ErrUserNotFound
+	}
+	return member, nil
+}
+
+// RequestPasswordReset mails a single-use, expiring password reset link to the active member owning address.
+// Nothing is sent to unknown or inactive members, and no error tells so.
+func RequestPasswordReset(ctx context.Context, address string) error {
+
+	member, err := memberByMail(ctx, address, "active")
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return err
+	}
+	return sendTokenMail(ctx, member, passwordResetMail())
+}
+
+// requiresVerification reports whether a new member has to verify the mail before being activated.
+// Only ordinary registrations do, members signing up with Facebook or Google come with verified mails.
+func requiresVerification(member Member) bool {
+	return config.Config.Mail.RequireVerification &&
+		member.RegisterMode.String == "ordinary" && !member.SocialID.Valid
+}
+
+// SendVerification mails a verification link to a pending member
+func SendVerification(ctx context.Context, member Member) error {
+	return sendTokenMail(ctx, member, verificationMail())
+}
+
+// ResendVerification mails a new verification link to the pending member owning address.
+// Like RequestPasswordReset, it doesn't tell whether such member exists.
+func ResendVerification(ctx context.Context, address string) error {
+
+	member, err := memberByMail(ctx, address, "pending")
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return err
+	}
+	return SendVerification(ctx, member)
+}
+
+// checkMailChange checks the mail which m is updated to, and reports whether the member has to verify it again.
+// No other member may own the mail, deleted ones included. Members changing their own mail have to verify it
+// if verification is required, while managers are trusted.
+func checkMailChange(ctx context.Context, m Member, manager bool) (reverify bool, err error) {
+
+	current, err := MemberAPI.GetMember(ctx, GetMemberArgs{ID: strconv.FormatInt(m.ID, 10), IDType: "id"})
+	if err != nil {
+		return false, err
+	}
+	if m.Mail.String == "" || strings.EqualFold(m.Mail.String, current.Mail.String) {
+		return false, nil
+	}
+	owner, err := MemberAPI.GetMember(ctx, GetMemberArgs{ID: m.Mail.String, IDType: "mail"})
+	switch {
+	case err == nil && owner.ID != m.ID:
+		return false, ErrMailTaken
+	case err != nil && !errors.Is(err, ErrUserNotFound):
+		return false, err
+	}
+	return config.Config.Mail.RequireVerification && !manager, nil
+}
+
+// VerifyMail consumes a verification token and activates the pending member it is issued to.
+// Verifying an active member again is a no-op. The activation is recorded as made by the member itself.
+func VerifyMail(ctx context.Context, verifyToken string, meta AuditMeta) (Member, error) {
+
+	t, err := TokenAPI.ConsumeToken(ctx, tokenPurposeVerifyMail, token.Hash(verifyToken))
+	if err != nil {
+		return Member{}, err
+	}
+	member, err := MemberAPI.GetMember(ctx, GetMemberArgs{
+		ID:     strconv.FormatInt(t.MemberID, 10),
+		IDType: "id",
+	})
+	if err != nil {
+		return Member{}, err
+	}
+
+	switch member.Active.Int {
+	case int64(config.Config.Models.Members["active"]):
+		return member, nil
+	case int64(config.Config.Models.Members["pending"]):
+	default:
+		return Member{}, ErrUserDeactivated
+	}
+
+	member.Active = rrsql.NullInt{Int: int64(config.Config.Models.Members["active"]), Valid: true}
+	member.UpdatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	err = MemberAPI.UpdateMember(ctx, Member{
+		ID:        member.ID,
+		MemberID:  member.MemberID,
+		Active:    member.Active,
+		UpdatedAt: member.UpdatedAt,
+	}, AuditMeta{ActorID: member.ID, Action: auditActionActivate, RequestID: meta.RequestID})
+	if err != nil {
+		return Member{}, err
+	}
+	return member, nil
+}
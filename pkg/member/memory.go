@@ -0,0 +1,1045 @@
+package member
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/args"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// memoryAPI keeps members in memory instead of MySQL, for tests and local development.
+// Rows kept along with members, such as the audit trail, tokens, identities, two-factor secrets, exports and follows,
+// are kept as well, and served as AuditInterface, TokenInterface, IdentityInterface, TwoFactorInterface, ExportInterface
+// and FollowInterface.
+// Conditions of queries are turned into rrsql.Filter, so values are compared and sorted the way MySQL does.
+type memoryAPI struct {
+	// mu guards everything kept
+	mu            sync.RWMutex
+	members       []Member
+	audits        []MemberAudit
+	tokens        []MemberToken
+	identities    []MemberIdentity
+	twoFactors    map[int64]TwoFactor
+	recoveryCodes []RecoveryCode
+	exports       []MemberExport
+	follows       []MemberFollow
+	// lastIDs are the last ids given to rows of tables other than members, which are never reused like AUTO_INCREMENT
+	lastIDs map[string]int64
+}
+
+func newMemoryAPI() *memoryAPI {
+	return &memoryAPI{
+		members:       []Member{},
+		audits:        []MemberAudit{},
+		tokens:        []MemberToken{},
+		identities:    []MemberIdentity{},
+		twoFactors:    map[int64]TwoFactor{},
+		recoveryCodes: []RecoveryCode{},
+		exports:       []MemberExport{},
+		follows:       []MemberFollow{},
+		lastIDs:       map[string]int64{},
+	}
+}
+
+// filters turns restricts of m into filters on members, the way parseRestricts does in SQL
+func (m *GetMembersArgs) filters() (filters []rrsql.Filter) {
+	if m.CustomEditor {
+		filters = append(filters, rrsql.Filter{Column: "custom_editor", Operator: "$eq", Value: true})
+	}
+	for op, list := range m.Active {
+		filters = append(filters, rrsql.Filter{Column: "active", Operator: listOperator(op), Value: intOperands(list)})
+	}
+	if m.Role != nil {
+		filters = append(filters, rrsql.Filter{Column: "role", Operator: "$eq", Value: *m.Role})
+	}
+	if len(m.IDs) > 0 {
+		ids := []interface{}{}
+		for _, id := range m.IDs {
+			// Like MySQL casting them, ids not in numbers match none
+			i, _ := strconv.ParseInt(id, 10, 64)
+			ids = append(ids, i)
+		}
+		filters = append(filters, rrsql.Filter{Column: "id", Operator: "$in", Value: ids})
+	}
+	if len(m.UUIDs) > 0 {
+		uuids := []interface{}{}
+		for _, uuid := range m.UUIDs {
+			uuids = append(uuids, uuid)
+		}
+		filters = append(filters, rrsql.Filter{Column: "uuid", Operator: "$in", Value: uuids})
+	}
+	return append(filters, m.Filters...)
+}
+
+// filters turns restricts of m into filters on members, the way parseFilterRestricts does in SQL.
+// ID is matched as a part of id, which filters could not tell.
+func (m *FilterMemberArgs) filters() (filters []rrsql.Filter) {
+	if m.Mail != "" {
+		filters = append(filters, rrsql.Filter{Column: "mail", Operator: "$like", Value: "%" + m.Mail + "%"})
+	}
+	if m.Nickname != "" {
+		filters = append(filters, rrsql.Filter{Column: "nickname", Operator: "$like", Value: "%" + m.Nickname + "%"})
+	}
+	for column, timeRange := range map[string]map[string]time.Time{"created_at": m.CreatedAt, "updated_at": m.UpdatedAt} {
+		if v, ok := timeRange["$gt"]; ok {
+			filters = append(filters, rrsql.Filter{Column: column, Operator: "$gte", Value: v})
+		}
+		if v, ok := timeRange["$lt"]; ok {
+			filters = append(filters, rrsql.Filter{Column: column, Operator: "$lte", Value: v})
+		}
+	}
+	return append(filters, m.Filters...)
+}
+
+// listOperator returns the operator of lists such as active, IN unless it is $nin like OperatorHelper
+func listOperator(op string) string {
+	if op == "$nin" {
+		return "$nin"
+	}
+	return "$in"
+}
+
+func intOperands(list []int) []interface{} {
+	operands := make([]interface{}, len(list))
+	for i, v := range list {
+		operands[i] = int64(v)
+	}
+	return operands
+}
+
+// matchFilters reports whether m satisfies all filters, the way FilterRestricts does in MySQL
+func matchFilters(m Member, filters []rrsql.Filter) bool {
+	values := memberValues(m)
+	for _, f := range filters {
+		if !f.Match(values[f.Column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// columnEquals reports whether column of m is value, compared as text case insensitively like the default collation
+func columnEquals(m Member, column string, value string) bool {
+	v := memberValues(m)[column]
+	if valuer, ok := v.(driver.Valuer); ok {
+		v, _ = valuer.Value()
+	}
+	return v != nil && strings.EqualFold(fmt.Sprint(v), value)
+}
+
+// sortMembers sorts members by sorting, with id as tiebreaker
+func sortMembers(members []Member, sorting string) {
+	keys, _ := rrsql.ParseSort(sorting, memberSortColumns, "id")
+	sort.SliceStable(members, func(i, j int) bool {
+		return rrsql.CompareRows(keys, memberValues(members[i]), memberValues(members[j])) < 0
+	})
+}
+
+// pageMembers returns a page of sorted members, from keyset if there is one, or page otherwise
+func pageMembers(members []Member, keyset *rrsql.Cursor, sorting string, page int, maxResult int) []Member {
+	if keyset == nil {
+		offset := (page - 1) * maxResult
+		if offset > len(members) {
+			offset = len(members)
+		}
+		members = members[offset:]
+		if len(members) > maxResult {
+			members = members[:maxResult]
+		}
+		return members
+	}
+	keys, _ := rrsql.ParseSort(sorting, memberSortColumns, "id")
+	result := []Member{}
+	for _, m := range members {
+		if keyset.Follows(keys, memberValues(m)) {
+			result = append(result, m)
+		}
+	}
+	switch {
+	case len(result) <= maxResult:
+	case keyset.Backward:
+		result = result[len(result)-maxResult:]
+	default:
+		result = result[:maxResult]
+	}
+	return result
+}
+
+// mergeMember copies fields set in m onto member, the way UpdateMember only updates columns picked by GetStructDBTags
+func mergeMember(member Member, m Member) Member {
+	set := make(map[string]bool)
+	for _, tag := range rrsql.GetStructDBTags("partial", m) {
+		set[tag] = true
+	}
+	dst, src := reflect.ValueOf(&member).Elem(), reflect.ValueOf(m)
+	for i := 0; i < src.NumField(); i++ {
+		if set[src.Type().Field(i).Tag.Get("db")] {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return member
+}
+
+// selectMember leaves only fields of m, the way only those columns are selected, or all of them if there are no fields
+func selectMember(m Member, fields rrsql.Sqlfields) Member {
+	if len(fields) == 0 {
+		return m
+	}
+	selected := Member{}
+	dst, src := reflect.ValueOf(&selected).Elem(), reflect.ValueOf(m)
+	for i := 0; i < src.NumField(); i++ {
+		for _, f := range fields {
+			if f == src.Type().Field(i).Tag.Get("db") {
+				dst.Field(i).Set(src.Field(i))
+			}
+		}
+	}
+	return selected
+}
+
+// find returns members matching filters, in the order of id. Callers hold mu.
+func (a *memoryAPI) find(filters []rrsql.Filter) []Member {
+	result := []Member{}
+	for _, m := range a.members {
+		if matchFilters(m, filters) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// indexOf returns the index of member id in members, or -1 if there is none. Callers hold mu.
+func (a *memoryAPI) indexOf(id int64) int {
+	for i, m := range a.members {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// keepAudit keeps audit the way insertAudit does, skipping changes without any field changed. Callers hold mu.
+func (a *memoryAPI) keepAudit(audit MemberAudit) {
+	if len(audit.Changes) == 0 {
+		return
+	}
+	audit.ID = 1
+	if len(a.audits) > 0 {
+		audit.ID = a.audits[len(a.audits)-1].ID + 1
+	}
+	audit.CreatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	a.audits = append(a.audits, audit)
+}
+
+func (a *memoryAPI) GetMembers(ctx context.Context, req *GetMembersArgs) (result []Member, err error) {
+	if err = ctx.Err(); err != nil {
+		return []Member{}, err
+	}
+	if _, err = rrsql.ParseSort(req.Sorting, memberSortColumns, "id"); err != nil {
+		return []Member{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	members := a.find(req.filters())
+	sortMembers(members, req.Sorting)
+	result = []Member{}
+	for _, m := range pageMembers(members, req.Keyset, req.Sorting, int(req.Page), int(req.MaxResult)) {
+		if len(req.Fields) > 0 {
+			m = selectMember(m, withSortColumns(req.Fields, req.Sorting))
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// GetMember returns the first member registered matching req. Members linked to accounts of providers
+// are found by their identities.
+func (a *memoryAPI) GetMember(ctx context.Context, req GetMemberArgs) (Member, error) {
+	if err := ctx.Err(); err != nil {
+		return Member{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, m := range a.members {
+		switch {
+		case req.ID != "" && req.IDType != "" && !columnEquals(m, req.IDType, req.ID):
+		case req.Active != nil && m.Active.Int != int64(*req.Active):
+		case req.Provider != "":
+			for _, i := range a.identities {
+				if i.MemberID == m.ID && i.Provider == req.Provider && i.Subject == req.Subject {
+					return selectMember(m, req.Fields), nil
+				}
+			}
+		default:
+			return selectMember(m, req.Fields), nil
+		}
+	}
+	return Member{}, ErrUserNotFound
+}
+
+// filter returns members matching args, sorted by args
+func (a *memoryAPI) filter(args *FilterMemberArgs) []Member {
+	result := []Member{}
+	for _, m := range a.find(args.filters()) {
+		if args.ID == 0 || strings.Contains(strconv.FormatInt(m.ID, 10), strconv.FormatInt(args.ID, 10)) {
+			result = append(result, m)
+		}
+	}
+	sortMembers(result, args.Sorting)
+	return result
+}
+
+func (a *memoryAPI) FilterMembers(ctx context.Context, args *FilterMemberArgs) (result []Stunt, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err = memberOrderBy(args.Sorting); err != nil {
+		return nil, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, m := range pageMembers(a.filter(args), args.Keyset, args.Sorting, args.Page, args.MaxResult) {
+		result = append(result, stuntOf(m, args.Fields))
+	}
+	return result, nil
+}
+
+func (a *memoryAPI) InsertMember(ctx context.Context, m Member, meta AuditMeta) (id int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lastID := int64(0)
+	for _, member := range a.members {
+		if m.ID != 0 && member.ID == m.ID || strings.EqualFold(member.MemberID, m.MemberID) {
+			return 0, ErrUserExisted
+		}
+		if member.ID > lastID {
+			lastID = member.ID
+		}
+	}
+	tags := rrsql.GetStructDBTags("partial", m)
+	// Members are given ids after the last one
+	if m.ID == 0 {
+		m.ID = lastID + 1
+	}
+	a.members = append(a.members, m)
+	sort.SliceStable(a.members, func(i, j int) bool { return a.members[i].ID < a.members[j].ID })
+	a.keepAudit(newAudit(m.ID, meta, auditActionCreate, Member{}, m, tags))
+	return int(m.ID), nil
+}
+
+func (a *memoryAPI) UpdateMember(ctx context.Context, m Member, meta AuditMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := a.indexOf(m.ID)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	before := a.members[i]
+	a.members[i] = mergeMember(before, m)
+	a.keepAudit(newAudit(m.ID, meta, auditActionUpdate, before, m, rrsql.GetStructDBTags("partial", m)))
+	return nil
+}
+
+func (a *memoryAPI) DeleteMember(ctx context.Context, idType string, id string, meta AuditMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, before := range a.members {
+		if !columnEquals(before, idType, id) {
+			continue
+		}
+		deleted := int64(config.Config.Models.Members["delete"])
+		if before.Active.Int == deleted {
+			// Deleting again keeps the state to restore to
+			return nil
+		}
+		after := Member{
+			Active:     rrsql.NullInt{Int: deleted, Valid: true},
+			DeletedAt:  rrsql.NullTime{Time: time.Now(), Valid: true},
+			PrevActive: before.Active,
+		}
+		a.members[i].Active, a.members[i].DeletedAt, a.members[i].PrevActive = after.Active, after.DeletedAt, after.PrevActive
+		a.keepAudit(newAudit(before.ID, meta, auditActionDelete, before, after, []string{"active", "deleted_at"}))
+		return nil
+	}
+	return ErrUserNotFound
+}
+
+func (a *memoryAPI) UpdateAll(ctx context.Context, ids []int64, active int, meta AuditMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := false
+	deleted := config.Config.Models.Members["delete"]
+	now := rrsql.NullTime{Time: time.Now(), Valid: true}
+	for i, m := range a.members {
+		if !containsID(ids, m.ID) {
+			continue
+		}
+		found = true
+		after := Member{Active: rrsql.NullInt{Int: int64(active), Valid: true}}
+		switch {
+		case m.Active.Int == int64(active), m.AnonymizedAt.Valid:
+			// Anonymized members stay deleted
+			continue
+		case active == deleted:
+			// Deleted members keep the state to restore to
+			after.DeletedAt, after.PrevActive = now, m.Active
+		}
+		a.members[i].Active, a.members[i].DeletedAt, a.members[i].PrevActive = after.Active, after.DeletedAt, after.PrevActive
+		a.keepAudit(newAudit(m.ID, meta, auditActionBulkUpdate, m, after, []string{"active", "deleted_at"}))
+	}
+	if !found {
+		return ErrMembersNotFound
+	}
+	return nil
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *memoryAPI) RestoreMember(ctx context.Context, id int64, meta AuditMeta) (Member, error) {
+	if err := ctx.Err(); err != nil {
+		return Member{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := a.indexOf(id)
+	if i < 0 {
+		return Member{}, ErrUserNotFound
+	}
+	before := a.members[i]
+	deleted := int64(config.Config.Models.Members["delete"])
+	if before.AnonymizedAt.Valid {
+		return Member{}, ErrUserAnonymized
+	}
+	if before.Active.Int != deleted {
+		return Member{}, ErrUserNotDeleted
+	}
+	for _, other := range a.members {
+		switch {
+		case other.ID == id || other.Active.Int == deleted:
+		case strings.EqualFold(other.MemberID, before.MemberID):
+			return Member{}, ErrMemberIDTaken
+		case before.Mail.String != "" && strings.EqualFold(other.Mail.String, before.Mail.String):
+			return Member{}, ErrMailTaken
+		}
+	}
+	member := before
+	member.Active = restoredActive(before)
+	member.DeletedAt, member.PrevActive = rrsql.NullTime{}, rrsql.NullInt{}
+	a.members[i] = member
+	a.keepAudit(newAudit(id, meta, auditActionRestore, before, member, []string{"active", "deleted_at"}))
+	return member, nil
+}
+
+func (a *memoryAPI) PurgeMembers(ctx context.Context, deletedBefore time.Time, limit int, dryRun bool, meta AuditMeta) ([]PurgeCandidate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	candidates := a.find([]rrsql.Filter{
+		{Column: "active", Operator: "$eq", Value: int64(config.Config.Models.Members["delete"])},
+		{Column: "deleted_at", Operator: "$lt", Value: deletedBefore},
+	})
+	sortMembers(candidates, "deleted_at")
+	purged := []PurgeCandidate{}
+	for _, m := range candidates {
+		if len(purged) < limit {
+			purged = append(purged, PurgeCandidate{ID: m.ID, MemberID: m.MemberID, DeletedAt: m.DeletedAt})
+		}
+	}
+	if dryRun || len(purged) == 0 {
+		return purged, nil
+	}
+
+	ids := make([]int64, len(purged))
+	for i, p := range purged {
+		ids[i] = p.ID
+	}
+	members, audits, follows := []Member{}, []MemberAudit{}, []MemberFollow{}
+	for _, m := range a.members {
+		if !containsID(ids, m.ID) {
+			members = append(members, m)
+		}
+	}
+	for _, audit := range a.audits {
+		if !containsID(ids, audit.MemberID) {
+			audits = append(audits, audit)
+		}
+	}
+	for _, f := range a.follows {
+		if !containsID(ids, f.MemberID) {
+			follows = append(follows, f)
+		}
+	}
+	a.members, a.audits, a.follows = members, audits, follows
+	for _, p := range purged {
+		a.erase(p.ID)
+		a.keepAudit(newAudit(p.ID, meta, auditActionPurge, Member{DeletedAt: p.DeletedAt}, Member{}, []string{"deleted_at"}))
+	}
+	return purged, nil
+}
+
+func (a *memoryAPI) AnonymizeMembers(ctx context.Context, ids []int64, meta AuditMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := false
+	now := time.Now()
+	for i, m := range a.members {
+		if !containsID(ids, m.ID) {
+			continue
+		}
+		found = true
+		if m.AnonymizedAt.Valid {
+			continue
+		}
+		after := anonymized(m, now)
+		a.members[i] = after
+		a.erase(m.ID)
+		for _, audit := range a.audits {
+			if audit.MemberID == m.ID {
+				redactPersonal(audit.Changes)
+			}
+		}
+		a.keepAudit(anonymizeAudit(meta, m, after))
+	}
+	if !found {
+		return ErrMembersNotFound
+	}
+	return nil
+}
+
+// Count counts members of GetMembersArgs or FilterMemberArgs, regardless of paging
+func (a *memoryAPI) Count(ctx context.Context, req args.ArgsParser) (result int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	switch req := req.(type) {
+	case *GetMembersArgs:
+		if !req.anyFilter() {
+			return len(a.members), nil
+		}
+		return len(a.find(req.filters())), nil
+	case *FilterMemberArgs:
+		return len(a.filter(req)), nil
+	}
+	return 0, fmt.Errorf("Unsupported count of %T", req)
+}
+
+// GetIDsByNickname returns active members of which nickname starts with the keyword
+func (a *memoryAPI) GetIDsByNickname(ctx context.Context, params GetMembersKeywordsArgs) (result []Stunt, err error) {
+	if err = ctx.Err(); err != nil {
+		return []Stunt{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	filters := []rrsql.Filter{
+		{Column: "active", Operator: "$eq", Value: int64(config.Config.Models.Members["active"])},
+		{Column: "nickname", Operator: "$like", Value: params.Keywords + "%"},
+	}
+	for op, list := range params.Roles {
+		filters = append(filters, rrsql.Filter{Column: "role", Operator: listOperator(op), Value: intOperands(list)})
+	}
+	for _, m := range a.find(filters) {
+		result = append(result, stuntOf(m, params.Fields))
+	}
+	return result, nil
+}
+
+// history returns audits of members matching args, latest first
+func (a *memoryAPI) history(args *GetHistoryArgs) []MemberAudit {
+	result := []MemberAudit{}
+	for i := len(a.audits) - 1; i >= 0; i-- {
+		audit := a.audits[i]
+		if audit.MemberID != args.MemberID || (args.Action != "" && audit.Action != args.Action) || (args.ActorID != 0 && audit.ActorID.Int != args.ActorID) {
+			continue
+		}
+		result = append(result, audit)
+	}
+	return result
+}
+
+func (a *memoryAPI) GetHistory(ctx context.Context, args *GetHistoryArgs) ([]MemberAudit, error) {
+	if err := ctx.Err(); err != nil {
+		return []MemberAudit{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	result := a.history(args)
+	offset := int(args.Page-1) * int(args.MaxResult)
+	if offset > len(result) {
+		return []MemberAudit{}, nil
+	}
+	result = result[offset:]
+	if len(result) > int(args.MaxResult) {
+		result = result[:args.MaxResult]
+	}
+	return result, nil
+}
+
+func (a *memoryAPI) CountHistory(ctx context.Context, args *GetHistoryArgs) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.history(args)), nil
+}
+
+// erase removes tokens, identities, two-factor secrets, recovery codes and exports of member id,
+// the way rows of credentialTables are deleted in MySQL. Callers hold mu.
+func (a *memoryAPI) erase(id int64) {
+	tokens, identities, codes, exports := []MemberToken{}, []MemberIdentity{}, []RecoveryCode{}, []MemberExport{}
+	for _, t := range a.tokens {
+		if t.MemberID != id {
+			tokens = append(tokens, t)
+		}
+	}
+	for _, i := range a.identities {
+		if i.MemberID != id {
+			identities = append(identities, i)
+		}
+	}
+	for _, c := range a.recoveryCodes {
+		if c.MemberID != id {
+			codes = append(codes, c)
+		}
+	}
+	for _, e := range a.exports {
+		if e.MemberID != id {
+			exports = append(exports, e)
+		}
+	}
+	a.tokens, a.identities, a.recoveryCodes, a.exports = tokens, identities, codes, exports
+	delete(a.twoFactors, id)
+}
+
+// nextID returns the id of a row added to table, after both the last id given and last, the largest id kept.
+// Callers hold mu.
+func (a *memoryAPI) nextID(table string, last int64) int64 {
+	if a.lastIDs[table] > last {
+		last = a.lastIDs[table]
+	}
+	a.lastIDs[table] = last + 1
+	return last + 1
+}
+
+// setTwoFactorEnabled sets two_factor_enabled of member id, without an audit like twoFactorAPI. Callers hold mu.
+func (a *memoryAPI) setTwoFactorEnabled(id int64, enabled bool) {
+	if i := a.indexOf(id); i >= 0 {
+		a.members[i].TwoFactorEnabled = rrsql.NullBool{Bool: enabled, Valid: true}
+	}
+}
+
+func (a *memoryAPI) InsertToken(ctx context.Context, t MemberToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	last := int64(0)
+	for _, v := range a.tokens {
+		if v.ID > last {
+			last = v.ID
+		}
+	}
+	t.ID = a.nextID("member_tokens", last)
+	t.CreatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	a.tokens = append(a.tokens, t)
+	return nil
+}
+
+// findToken returns the index of the unused, unexpired token of purpose and hash. Callers hold mu.
+func (a *memoryAPI) findToken(purpose string, hash string) (int, error) {
+	for i, t := range a.tokens {
+		switch {
+		case t.Purpose != purpose || t.TokenHash != hash:
+		case t.UsedAt.Valid:
+			return -1, ErrTokenNotFound
+		case time.Now().After(t.ExpiresAt):
+			return -1, ErrTokenExpired
+		default:
+			return i, nil
+		}
+	}
+	return -1, ErrTokenNotFound
+}
+
+func (a *memoryAPI) GetToken(ctx context.Context, purpose string, hash string) (MemberToken, error) {
+	if err := ctx.Err(); err != nil {
+		return MemberToken{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	i, err := a.findToken(purpose, hash)
+	if err != nil {
+		return MemberToken{}, err
+	}
+	return a.tokens[i], nil
+}
+
+func (a *memoryAPI) ConsumeToken(ctx context.Context, purpose string, hash string) (MemberToken, error) {
+	if err := ctx.Err(); err != nil {
+		return MemberToken{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i, err := a.findToken(purpose, hash)
+	if err != nil {
+		return MemberToken{}, err
+	}
+	a.tokens[i].UsedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	return a.tokens[i], nil
+}
+
+func (a *memoryAPI) RevokeTokens(ctx context.Context, memberID int64, purpose string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, t := range a.tokens {
+		if t.MemberID == memberID && t.Purpose == purpose && !t.UsedAt.Valid {
+			a.tokens[i].UsedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+func (a *memoryAPI) GetIdentities(ctx context.Context, memberID int64) ([]MemberIdentity, error) {
+	if err := ctx.Err(); err != nil {
+		return []MemberIdentity{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	result := []MemberIdentity{}
+	for _, i := range a.identities {
+		if i.MemberID == memberID {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+func (a *memoryAPI) InsertIdentity(ctx context.Context, identity MemberIdentity) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	last := int64(0)
+	for _, i := range a.identities {
+		if (i.Provider == identity.Provider && i.Subject == identity.Subject) || (i.MemberID == identity.MemberID && i.Provider == identity.Provider) {
+			return 0, ErrIdentityAlreadyLinked
+		}
+		if i.ID > last {
+			last = i.ID
+		}
+	}
+	identity.ID = a.nextID("member_identities", last)
+	identity.CreatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	a.identities = append(a.identities, identity)
+	return identity.ID, nil
+}
+
+func (a *memoryAPI) DeleteIdentity(ctx context.Context, memberID int64, provider string, keep func(remaining []MemberIdentity) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	index, remaining := -1, []MemberIdentity{}
+	for n, i := range a.identities {
+		switch {
+		case i.MemberID != memberID:
+		case i.Provider == provider:
+			index = n
+		default:
+			remaining = append(remaining, i)
+		}
+	}
+	if index < 0 {
+		return ErrIdentityNotFound
+	}
+	if err := keep(remaining); err != nil {
+		return err
+	}
+	a.identities = append(a.identities[:index:index], a.identities[index+1:]...)
+	return nil
+}
+
+func (a *memoryAPI) GetTwoFactor(ctx context.Context, memberID int64) (TwoFactor, error) {
+	if err := ctx.Err(); err != nil {
+		return TwoFactor{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	tf, ok := a.twoFactors[memberID]
+	if !ok {
+		return TwoFactor{}, ErrTwoFactorNotFound
+	}
+	return tf, nil
+}
+
+func (a *memoryAPI) SetSecret(ctx context.Context, memberID int64, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.twoFactors[memberID] = TwoFactor{MemberID: memberID, Secret: secret, CreatedAt: rrsql.NullTime{Time: time.Now(), Valid: true}}
+	return nil
+}
+
+func (a *memoryAPI) Enable(ctx context.Context, memberID int64, codes []RecoveryCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tf, ok := a.twoFactors[memberID]
+	if !ok {
+		return ErrTwoFactorNotFound
+	}
+	now := rrsql.NullTime{Time: time.Now(), Valid: true}
+	tf.EnabledAt = now
+	a.twoFactors[memberID] = tf
+
+	kept, last := []RecoveryCode{}, int64(0)
+	for _, code := range a.recoveryCodes {
+		if code.MemberID != memberID {
+			kept = append(kept, code)
+		}
+		if code.ID > last {
+			last = code.ID
+		}
+	}
+	for _, code := range codes {
+		code.ID, code.MemberID, code.CreatedAt = a.nextID("member_recovery_codes", last), memberID, now
+		kept = append(kept, code)
+	}
+	a.recoveryCodes = kept
+	a.setTwoFactorEnabled(memberID, true)
+	return nil
+}
+
+func (a *memoryAPI) Disable(ctx context.Context, memberID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.twoFactors, memberID)
+	kept := []RecoveryCode{}
+	for _, code := range a.recoveryCodes {
+		if code.MemberID != memberID {
+			kept = append(kept, code)
+		}
+	}
+	a.recoveryCodes = kept
+	a.setTwoFactorEnabled(memberID, false)
+	return nil
+}
+
+func (a *memoryAPI) UseStep(ctx context.Context, memberID int64, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tf, ok := a.twoFactors[memberID]
+	if !ok || tf.LastUsedStep >= step {
+		return ErrCodeAlreadyUsed
+	}
+	tf.LastUsedStep = step
+	a.twoFactors[memberID] = tf
+	return nil
+}
+
+func (a *memoryAPI) GetRecoveryCodes(ctx context.Context, memberID int64) (result []RecoveryCode, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, code := range a.recoveryCodes {
+		if code.MemberID == memberID && !code.UsedAt.Valid {
+			result = append(result, code)
+		}
+	}
+	return result, nil
+}
+
+func (a *memoryAPI) UseRecoveryCode(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, code := range a.recoveryCodes {
+		if code.ID == id && !code.UsedAt.Valid {
+			a.recoveryCodes[i].UsedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+			return nil
+		}
+	}
+	return ErrRecoveryCodeNotFound
+}
+
+func (a *memoryAPI) InsertExport(ctx context.Context, e MemberExport) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kept, last := []MemberExport{}, int64(0)
+	for _, v := range a.exports {
+		if v.MemberID != e.MemberID {
+			kept = append(kept, v)
+		}
+		if v.ID > last {
+			last = v.ID
+		}
+	}
+	e.ID = a.nextID("member_exports", last)
+	a.exports = append(kept, e)
+	return e.ID, nil
+}
+
+func (a *memoryAPI) FinishExport(ctx context.Context, e MemberExport) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, v := range a.exports {
+		if v.ID == e.ID {
+			v.Status, v.Archive, v.Size, v.FinishedAt, v.ExpiresAt = e.Status, e.Archive, e.Size, e.FinishedAt, e.ExpiresAt
+			a.exports[i] = v
+		}
+	}
+	return nil
+}
+
+// findExport returns export id of member, or the latest one with id 0. Callers hold mu.
+func (a *memoryAPI) findExport(memberID int64, id int64) (found MemberExport, err error) {
+	err = ErrExportNotFound
+	for _, e := range a.exports {
+		if e.MemberID == memberID && (e.ID == id || id == 0 && e.ID > found.ID) {
+			found, err = e, nil
+		}
+	}
+	return found, err
+}
+
+// GetExport returns export id of member without the archive, which is loaded only by GetArchive
+func (a *memoryAPI) GetExport(ctx context.Context, memberID int64, id int64) (MemberExport, error) {
+	if err := ctx.Err(); err != nil {
+		return MemberExport{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	e, err := a.findExport(memberID, id)
+	e.Archive = nil
+	return e, err
+}
+
+func (a *memoryAPI) GetLatestExport(ctx context.Context, memberID int64) (MemberExport, error) {
+	if err := ctx.Err(); err != nil {
+		return MemberExport{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	e, err := a.findExport(memberID, 0)
+	e.Archive = nil
+	return e, err
+}
+
+func (a *memoryAPI) GetArchive(ctx context.Context, memberID int64, id int64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	e, err := a.findExport(memberID, id)
+	return e.Archive, err
+}
+
+func (a *memoryAPI) GetFollows(ctx context.Context, memberID int64) ([]MemberFollow, error) {
+	if err := ctx.Err(); err != nil {
+		return []MemberFollow{}, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	result := []MemberFollow{}
+	for _, f := range a.follows {
+		if f.MemberID == memberID {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
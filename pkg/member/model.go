@@ -1,16 +1,21 @@
 package member
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/readr-media/readr-restful-member/config"
 	"github.com/readr-media/readr-restful-member/internal/args"
+	"github.com/readr-media/readr-restful-member/internal/lockout"
 	"github.com/readr-media/readr-restful-member/internal/rrsql"
+	"github.com/readr-media/readr-restful-member/internal/utils"
 )
 
 // var MemberStatus map[string]interface{}
@@ -40,6 +45,13 @@ type Member struct {
 	Salt          rrsql.NullString `json:"-" db:"salt"`
 	PremiumBefore rrsql.NullTime   `json:"premium_before" db:"premium_before"`
 	// Ignore password JSON marshall for now
+	PasswordChangedAt rrsql.NullTime `json:"password_changed_at" db:"password_changed_at"`
+	TwoFactorEnabled  rrsql.NullBool `json:"two_factor_enabled" db:"two_factor_enabled"`
+	// DeletedAt is when the member is deleted, and PrevActive the state it is restored to
+	DeletedAt  rrsql.NullTime `json:"deleted_at" db:"deleted_at"`
+	PrevActive rrsql.NullInt  `json:"-" db:"prev_active"`
+	// AnonymizedAt is when personal data of the member is scrubbed, the member is never restored since
+	AnonymizedAt rrsql.NullTime `json:"anonymized_at" db:"anonymized_at"`
 
 	Description  rrsql.NullString `json:"description" db:"description"`
 	ProfileImage rrsql.NullString `json:"profile_image" db:"profile_image"`
@@ -84,6 +96,12 @@ type Stunt struct {
 	Password  rrsql.NullString `json:"-" db:"password"`
 	Salt      rrsql.NullString `json:"-" db:"salt"`
 
+	PasswordChangedAt *rrsql.NullTime `json:"password_changed_at,omitempty" db:"password_changed_at"`
+	TwoFactorEnabled  *rrsql.NullBool `json:"two_factor_enabled,omitempty" db:"two_factor_enabled"`
+	DeletedAt         *rrsql.NullTime `json:"deleted_at,omitempty" db:"deleted_at"`
+	PrevActive        rrsql.NullInt   `json:"-" db:"prev_active"`
+	AnonymizedAt      *rrsql.NullTime `json:"anonymized_at,omitempty" db:"anonymized_at"`
+
 	Description  *rrsql.NullString `json:"description,omitempty" db:"description"`
 	ProfileImage *rrsql.NullString `json:"profile_image,omitempty" db:"profile_image"`
 	Identity     *rrsql.NullString `json:"identity,omitempty" db:"identity"`
@@ -104,22 +122,55 @@ type memberAPI struct{}
 
 var MemberAPI MemberInterface = new(memberAPI)
 
+// SetStore selects where members, and everything kept about them, are kept by name in config.
+// It is mysql if name is empty, or memory to keep them in memory of the process,
+// along with login attempts which are otherwise kept in Redis.
+func SetStore(name string) error {
+	switch name {
+	case "", "mysql":
+		MemberAPI, AuditAPI = new(memberAPI), new(auditAPI)
+		TokenAPI, IdentityAPI, TwoFactorAPI, ExportAPI = new(tokenAPI), new(identityAPI), new(twoFactorAPI), new(exportAPI)
+		FollowAPI = new(followAPI)
+	case "memory":
+		store := newMemoryAPI()
+		MemberAPI, AuditAPI = store, store
+		TokenAPI, IdentityAPI, TwoFactorAPI, ExportAPI, FollowAPI = store, store, store, store, store
+		lockout.DefaultStore = lockout.NewMemoryStore()
+	default:
+		return fmt.Errorf("Unknown store %s", name)
+	}
+	return nil
+}
+
+// MemberInterface reads and writes members. Queries are bounded by ctx, and abandoned once it is done,
+// such as when the request times out or the client goes away.
 type MemberInterface interface {
-	DeleteMember(idType string, id string) error
-	GetMember(req GetMemberArgs) (Member, error)
-	GetMembers(req *GetMembersArgs) ([]Member, error)
-	FilterMembers(args *FilterMemberArgs) ([]Stunt, error)
-	InsertMember(m Member) (id int, err error)
-	UpdateAll(ids []int64, active int) error
-	UpdateMember(m Member) error
-	Count(req args.ArgsParser) (result int, err error)
-	GetIDsByNickname(params GetMembersKeywordsArgs) (result []Stunt, err error)
+	DeleteMember(ctx context.Context, idType string, id string, meta AuditMeta) error
+	GetMember(ctx context.Context, req GetMemberArgs) (Member, error)
+	GetMembers(ctx context.Context, req *GetMembersArgs) ([]Member, error)
+	FilterMembers(ctx context.Context, args *FilterMemberArgs) ([]Stunt, error)
+	InsertMember(ctx context.Context, m Member, meta AuditMeta) (id int, err error)
+	UpdateAll(ctx context.Context, ids []int64, active int, meta AuditMeta) error
+	UpdateMember(ctx context.Context, m Member, meta AuditMeta) error
+	RestoreMember(ctx context.Context, id int64, meta AuditMeta) (Member, error)
+	PurgeMembers(ctx context.Context, deletedBefore time.Time, limit int, dryRun bool, meta AuditMeta) ([]PurgeCandidate, error)
+	AnonymizeMembers(ctx context.Context, ids []int64, meta AuditMeta) error
+	Count(ctx context.Context, req args.ArgsParser) (result int, err error)
+	GetIDsByNickname(ctx context.Context, params GetMembersKeywordsArgs) (result []Stunt, err error)
 }
 
 type GetMemberArgs struct {
 	IDType string
 	ID     string
-	Mode   string
+
+	// Provider and Subject find the member linked to an account of social login provider
+	Provider string
+	Subject  string
+
+	// Fields are the only columns selected, or all of them if empty
+	Fields rrsql.Sqlfields
+	// Active restricts members to those in the state if given
+	Active *int
 }
 
 func (m *GetMemberArgs) parseRestricts() (restricts string, values []interface{}) {
@@ -130,9 +181,13 @@ func (m *GetMemberArgs) parseRestricts() (restricts string, values []interface{}
 		values = append(values, m.ID)
 	}
 
-	if m.Mode != "" {
-		where = append(where, "register_mode = ?")
-		values = append(values, m.Mode)
+	if m.Provider != "" {
+		where = append(where, "id IN (SELECT member_id FROM member_identities WHERE provider = ? AND subject = ?)")
+		values = append(values, m.Provider, m.Subject)
+	}
+	if m.Active != nil {
+		where = append(where, "active = ?")
+		values = append(values, *m.Active)
 	}
 
 	if len(where) > 1 {
@@ -143,6 +198,201 @@ func (m *GetMemberArgs) parseRestricts() (restricts string, values []interface{}
 	return restricts, values
 }
 
+type LoginArgs struct {
+	ID       string `json:"id"`
+	MemberID string `json:"member_id"`
+	Mail     string `json:"mail"`
+	Password string `json:"password"`
+
+	// Second factor for members with two-factor authentication turned on, either one is required
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// memberArgs picks the first identifier provided in the order of id, member_id and mail
+func (l *LoginArgs) memberArgs() (args GetMemberArgs, err error) {
+	switch {
+	case l.ID != "":
+		args = GetMemberArgs{IDType: "id", ID: l.ID}
+	case l.MemberID != "":
+		args = GetMemberArgs{IDType: "member_id", ID: l.MemberID}
+	case l.Mail != "":
+		args = GetMemberArgs{IDType: "mail", ID: l.Mail}
+	default:
+		err = ErrInvalidInput
+	}
+	return args, err
+}
+
+// LockedError is returned when a member or client is locked out after too many failed attempts
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return "Too Many Attempts"
+}
+
+// Authenticate finds the member identified in args and verifies the password against its stored hash.
+// Password is checked before member state, so only callers with valid credentials learn that
+// a member is deleted or deactivated. meta is recorded for the rehash of outdated password hash.
+func Authenticate(ctx context.Context, args LoginArgs, meta AuditMeta) (member Member, err error) {
+
+	req, err := args.memberArgs()
+	if err != nil {
+		return Member{}, err
+	}
+	if args.Password == "" {
+		return Member{}, ErrInvalidInput
+	}
+	if utils.PasswordTooLong(args.Password) {
+		return Member{}, ErrPasswordTooLong
+	}
+
+	member, err = MemberAPI.GetMember(ctx, req)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			// Unknown identifiers are locked out like members, or only existing ones would get locked
+			unknownKey := lockout.UnknownKey(req.IDType, req.ID)
+			if record := lockout.Check(unknownKey); record.Locked(time.Now()) {
+				return Member{}, &LockedError{Until: record.LockedUntil}
+			}
+			// Hash anyway so unknown members take as long as existing ones
+			utils.CryptHashPassword(args.Password)
+			lockout.Fail(unknownKey, config.Config.Lockout.MemberThreshold)
+		}
+		return Member{}, err
+	}
+
+	// Locked members are refused before checking password, so guessing during a lock tells nothing
+	lockKey := lockout.MemberKey(member.ID)
+	record := lockout.Check(lockKey)
+	if record.Locked(time.Now()) {
+		return Member{}, &LockedError{Until: record.LockedUntil}
+	}
+
+	needRehash, err := verifyPassword(member, args.Password)
+	if err != nil {
+		if errors.Is(err, ErrWrongPassword) {
+			lockout.Fail(lockKey, config.Config.Lockout.MemberThreshold)
+		}
+		return Member{}, err
+	}
+	if needRehash {
+		// Upgrade the stored hash to the current algorithm and parameters while the password is at hand.
+		// Failing to do so doesn't fail the login.
+		if err := rehashPassword(ctx, member, args.Password, meta); err != nil {
+			log.Printf("Error rehashing password of member %d: %v\n", member.ID, err)
+		}
+	}
+
+	switch member.Active.Int {
+	case int64(config.Config.Models.Members["active"]):
+	case int64(config.Config.Models.Members["delete"]):
+		return Member{}, ErrUserDeleted
+	case int64(config.Config.Models.Members["pending"]):
+		return Member{}, ErrUserNotVerified
+	default:
+		return Member{}, ErrUserDeactivated
+	}
+
+	if err = verifySecondFactor(ctx, member, args.OTP, args.RecoveryCode); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			lockout.Fail(lockKey, config.Config.Lockout.MemberThreshold)
+		}
+		return Member{}, err
+	}
+	// Failures are cleared only after all factors pass, or codes could be guessed along with a known password
+	if record.Failures > 0 {
+		if err := lockout.Clear(lockKey); err != nil {
+			log.Printf("Error clearing lockout of member %d: %v\n", member.ID, err)
+		}
+	}
+	return member, nil
+}
+
+// verifyPassword returns "Wrong Password" error if password doesn't match the one stored for member.
+// needRehash reports whether the stored hash is legacy or made with outdated parameters.
+func verifyPassword(member Member, password string) (needRehash bool, err error) {
+	// No password longer than the policy allows is hashed, the stored one included
+	if utils.PasswordTooLong(password) {
+		return false, ErrPasswordTooLong
+	}
+	if !member.Password.Valid || member.Password.String == "" {
+		utils.CryptHashPassword(password)
+		return false, ErrWrongPassword
+	}
+	ok, needRehash, err := utils.CryptVerifyPassword(password, member.Password.String, member.Salt.String)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrWrongPassword
+	}
+	return needRehash, nil
+}
+
+// hashedPassword returns the Password and Salt fields storing password in current hash format.
+// The encoded hash embeds its salt, so the salt column is emptied.
+func hashedPassword(password string) (hpw rrsql.NullString, salt rrsql.NullString, err error) {
+	encoded, err := utils.CryptHashPassword(password)
+	if err != nil {
+		return hpw, salt, err
+	}
+	return rrsql.NullString{String: encoded, Valid: true}, rrsql.NullString{String: "", Valid: true}, nil
+}
+
+// rehashPassword stores password of member in current hash format without touching anything else.
+// It is recorded as an update made by member itself.
+func rehashPassword(ctx context.Context, member Member, password string, meta AuditMeta) error {
+	hpw, salt, err := hashedPassword(password)
+	if err != nil {
+		return err
+	}
+	meta.ActorID, meta.Action = member.ID, auditActionUpdate
+	return MemberAPI.UpdateMember(ctx, Member{
+		ID:       member.ID,
+		MemberID: member.MemberID,
+		Password: hpw,
+		Salt:     salt,
+	}, meta)
+}
+
+// SetPassword hashes password in current hash format and stores it for member.
+// Refresh tokens issued before are revoked, so other sessions have to log in again,
+// and so are pending password reset links.
+func SetPassword(ctx context.Context, member Member, password string, meta AuditMeta) error {
+
+	hpw, salt, err := hashedPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := rrsql.NullTime{Time: time.Now(), Valid: true}
+	err = MemberAPI.UpdateMember(ctx, Member{
+		ID:                member.ID,
+		MemberID:          member.MemberID,
+		Password:          hpw,
+		Salt:              salt,
+		PasswordChangedAt: now,
+		UpdatedAt:         now,
+	}, AuditMeta{ActorID: meta.ActorID, Action: auditActionPasswordChange, RequestID: meta.RequestID})
+	if err != nil {
+		return err
+	}
+	for _, purpose := range []string{tokenPurposeRefresh, tokenPurposePasswordReset} {
+		if err = TokenAPI.RevokeTokens(ctx, member.ID, purpose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passwordViolations validates password against the password policy with personal info of member
+func passwordViolations(member Member, password string) []utils.PasswordViolation {
+	return utils.ValidatePassword(password, member.Mail.String, member.Nickname.String, member.MemberID)
+}
+
 type GetMembersArgs struct {
 	MaxResult    uint8            `form:"max_result"`
 	Page         uint16           `form:"page"`
@@ -153,6 +403,13 @@ type GetMembersArgs struct {
 	IDs          []string         `form:"ids"`
 	UUIDs        []string         `form:"uuids"`
 	Total        bool             `form:"total"`
+	// Filters are parsed from filter in JSON, on columns of memberFilterColumns
+	Filters []rrsql.Filter `form:"-"`
+	// Cursor is given in _meta of the previous response, and Page is ignored with it
+	Cursor string        `form:"cursor"`
+	Keyset *rrsql.Cursor `form:"-"`
+	// Fields are the only columns selected, along with those sorted by, or all of them if empty
+	Fields rrsql.Sqlfields `form:"-"`
 }
 
 func (m *GetMembersArgs) SetDefault() {
@@ -161,9 +418,10 @@ func (m *GetMembersArgs) SetDefault() {
 	m.Sorting = "-updated_at"
 }
 
+// DefaultActive leaves out deleted members, and pending ones who haven't verified their mail yet
 func (m *GetMembersArgs) DefaultActive() {
 	// m.Active = map[string][]int{"$nin": []int{int(MemberStatus["delete"].(float64))}}
-	m.Active = map[string][]int{"$nin": []int{config.Config.Models.Members["delete"]}}
+	m.Active = map[string][]int{"$nin": []int{config.Config.Models.Members["delete"], config.Config.Models.Members["pending"]}}
 }
 
 func (m *GetMembersArgs) ParseCountQuery() (query string, values []interface{}) {
@@ -177,7 +435,7 @@ func (m *GetMembersArgs) ParseCountQuery() (query string, values []interface{})
 }
 
 func (m *GetMembersArgs) anyFilter() bool {
-	return m.Active != nil || m.CustomEditor == true
+	return m.Active != nil || m.CustomEditor == true || len(m.Filters) > 0
 }
 
 func (m *GetMembersArgs) parseRestricts() (restricts string, values []interface{}) {
@@ -217,6 +475,11 @@ func (m *GetMembersArgs) parseRestricts() (restricts string, values []interface{
 			values = append(values, m.UUIDs[i])
 		}
 	}
+	if len(m.Filters) > 0 {
+		filterWhere, filterValues := rrsql.FilterRestricts(m.Filters, "members")
+		where = append(where, filterWhere...)
+		values = append(values, filterValues...)
+	}
 	if len(where) > 1 {
 		restricts = strings.Join(where, " AND ")
 	} else if len(where) == 1 {
@@ -225,18 +488,29 @@ func (m *GetMembersArgs) parseRestricts() (restricts string, values []interface{
 	return restricts, values
 }
 
+// pageOffset returns rows skipped before page, computed in uint64 so late pages couldn't wrap back to the first ones
+func pageOffset(page uint16, maxResult uint8) uint64 {
+	if page == 0 {
+		return 0
+	}
+	return uint64(page-1) * uint64(maxResult)
+}
+
 func (m *GetMembersArgs) parseLimit() (restricts string, values []interface{}) {
 
-	if m.Sorting != "" {
-		restricts = fmt.Sprintf("%s ORDER BY %s", restricts, rrsql.OrderByHelper(m.Sorting))
+	// Sort is validated ahead, invalid ones are left to the tiebreaker
+	orderBy, _ := memberOrderBy(m.Sorting)
+	if orderBy == "" {
+		orderBy = "id"
 	}
+	restricts = fmt.Sprintf("%s ORDER BY %s", restricts, orderBy)
 
 	if m.MaxResult > 0 {
 		restricts = fmt.Sprintf("%s LIMIT ?", restricts)
 		values = append(values, m.MaxResult)
 		if m.Page > 0 {
 			restricts = fmt.Sprintf("%s OFFSET ?", restricts)
-			values = append(values, (m.Page-1)*uint16(m.MaxResult))
+			values = append(values, pageOffset(m.Page, m.MaxResult))
 		}
 	}
 	return restricts, values
@@ -244,7 +518,75 @@ func (m *GetMembersArgs) parseLimit() (restricts string, values []interface{}) {
 
 type FilterMemberArgs struct {
 	args.FilterArgs
-	Fields rrsql.Sqlfields
+	Fields  rrsql.Sqlfields `form:"-"`
+	Total   bool            `form:"total"`
+	Filters []rrsql.Filter  `form:"-"`
+	Cursor  string          `form:"cursor"`
+	Keyset  *rrsql.Cursor   `form:"-"`
+}
+
+func (m *FilterMemberArgs) SetDefault() {
+	m.MaxResult = 20
+	m.Page = 1
+	m.Sorting = "-updated_at"
+}
+
+// Validate checks paging, sort and fields, and selects all fields of Stunt shown in responses if there is none
+func (m *FilterMemberArgs) Validate() error {
+	if m.MaxResult <= 0 || m.Page <= 0 {
+		return ErrInvalidPage
+	}
+	if _, err := memberOrderBy(m.Sorting); err != nil {
+		return err
+	}
+	if m.Cursor != "" {
+		var err error
+		if m.Keyset, err = parseMemberCursor(m.Cursor, m.Sorting); err != nil {
+			return err
+		}
+	}
+	validFields := visibleColumns(Stunt{})
+	if len(m.Fields) == 0 {
+		m.Fields = validFields
+		return nil
+	}
+CheckEachFieldLoop:
+	for _, f := range m.Fields {
+		for _, F := range validFields {
+			if f == F {
+				continue CheckEachFieldLoop
+			}
+		}
+		return ErrInvalidFields.WithDetails([]string{f})
+	}
+	return nil
+}
+
+// visibleColumns are columns of v, a struct mapping members, except those never shown in responses such as password
+func visibleColumns(v interface{}) (columns rrsql.Sqlfields) {
+	t := reflect.TypeOf(v)
+	for i, tag := range rrsql.GetStructDBTags("full", v) {
+		if t.Field(i).Tag.Get("json") != "-" {
+			columns = append(columns, tag)
+		}
+	}
+	return columns
+}
+
+// memberFilterColumns are columns members could be filtered by with operators in filter
+var memberFilterColumns = rrsql.FilterColumns(Member{}, "points", "role", "premium_before", "birthday", "gender",
+	"register_mode", "custom_editor", "hide_profile", "created_at", "updated_at")
+
+// memberSortColumns are columns members could be sorted by
+var memberSortColumns = visibleColumns(Member{})
+
+// memberOrderBy validates sort against memberSortColumns, and returns the expressions of ORDER BY with id as tiebreaker
+func memberOrderBy(sort string) (string, error) {
+	keys, err := rrsql.ParseSort(sort, memberSortColumns, "id")
+	if err != nil {
+		return "", err
+	}
+	return rrsql.OrderBy(keys), nil
 }
 
 func (p FilterMemberArgs) ParseQuery() (query string, values []interface{}) {
@@ -258,6 +600,16 @@ func (m *FilterMemberArgs) parse(doCount bool) (query string, values []interface
 	selectedFields := m.Fields.GetFields(`%s "%s"`)
 
 	restricts, restrictVals := m.parseFilterRestricts()
+	if !doCount && m.Keyset != nil {
+		// Sort is validated along with the cursor
+		keyset, keysetVals, _, _ := keysetQuery(m.Sorting, m.Keyset)
+		if restricts == "" {
+			restricts = "WHERE " + keyset
+		} else {
+			restricts = restricts + " AND " + keyset
+		}
+		restrictVals = append(restrictVals, keysetVals...)
+	}
 	limit, limitVals := m.parseLimit()
 	values = append(values, restrictVals...)
 	values = append(values, limitVals...)
@@ -314,6 +666,11 @@ func (m *FilterMemberArgs) parseFilterRestricts() (restrictString string, values
 			values = append(values, v)
 		}
 	}
+	if len(m.Filters) > 0 {
+		filterRestricts, filterValues := rrsql.FilterRestricts(m.Filters, "members")
+		restricts = append(restricts, filterRestricts...)
+		values = append(values, filterValues...)
+	}
 	if len(restricts) > 1 {
 		restrictString = fmt.Sprintf("WHERE %s", strings.Join(restricts, " AND "))
 	} else if len(restricts) == 1 {
@@ -324,14 +681,17 @@ func (m *FilterMemberArgs) parseFilterRestricts() (restrictString string, values
 
 func (m *FilterMemberArgs) parseLimit() (restricts string, values []interface{}) {
 
-	if m.Sorting != "" {
-		restricts = fmt.Sprintf("%s ORDER BY %s", restricts, rrsql.OrderByHelper(m.Sorting))
+	// Sort is validated ahead, invalid ones are left to the tiebreaker
+	_, _, orderBy, _ := keysetQuery(m.Sorting, m.Keyset)
+	if orderBy == "" {
+		orderBy = "id"
 	}
+	restricts = fmt.Sprintf("%s ORDER BY %s", restricts, orderBy)
 
 	if m.MaxResult > 0 {
 		restricts = fmt.Sprintf("%s LIMIT ?", restricts)
 		values = append(values, m.MaxResult)
-		if m.Page > 0 {
+		if m.Page > 0 && m.Keyset == nil {
 			restricts = fmt.Sprintf("%s OFFSET ?", restricts)
 			values = append(values, (m.Page-1)*m.MaxResult)
 		}
@@ -348,7 +708,7 @@ type GetMembersKeywordsArgs struct {
 func (a *GetMembersKeywordsArgs) Validate() (err error) {
 	// Validate keyword
 	if a.Keywords == "" {
-		return errors.New("Invalid keyword")
+		return ErrInvalidKeyword
 	}
 	// Validate field
 	validFields := rrsql.GetStructDBTags("full", Stunt{})
@@ -360,7 +720,7 @@ CheckEachFieldLoop:
 				continue CheckEachFieldLoop
 			}
 		}
-		return fmt.Errorf("Invalid fields: %s", f)
+		return ErrInvalidFields.WithDetails([]string{f})
 	}
 	var containfield = func(field string) bool {
 		for _, f := range a.Fields {
@@ -379,54 +739,72 @@ CheckEachFieldLoop:
 	return err
 }
 
-func (a *memberAPI) GetMembers(req *GetMembersArgs) (result []Member, err error) {
+func (a *memberAPI) GetMembers(ctx context.Context, req *GetMembersArgs) (result []Member, err error) {
 
 	restricts, values := req.parseRestricts()
-	query := fmt.Sprintf(`SELECT * FROM members where %s `, restricts)
+	keyset, keysetValues, orderBy, err := keysetQuery(req.Sorting, req.Keyset)
+	if err != nil {
+		return []Member{}, err
+	}
+	columns := selectedColumns(req.Fields)
+	if len(req.Fields) > 0 {
+		columns = selectedColumns(withSortColumns(req.Fields, req.Sorting))
+	}
+	query := fmt.Sprintf(`SELECT %s FROM members where %s `, columns, joinRestricts(restricts, keyset))
 
-	query, args, err := sqlx.In(query, values...)
+	query, args, err := sqlx.In(query, append(values, keysetValues...)...)
 	if err != nil {
 		return []Member{}, err
 	}
 	query = rrsql.DB.Rebind(query)
-	query = query + fmt.Sprintf(`ORDER BY %s LIMIT ? OFFSET ?`, rrsql.OrderByHelper(req.Sorting))
-	args = append(args, req.MaxResult, (req.Page-1)*uint16(req.MaxResult))
-	err = rrsql.DB.Select(&result, query, args...)
+	query = query + fmt.Sprintf(`ORDER BY %s LIMIT ? OFFSET ?`, orderBy)
+	offset := pageOffset(req.Page, req.MaxResult)
+	if req.Keyset != nil {
+		offset = 0
+	}
+	args = append(args, req.MaxResult, offset)
+	err = rrsql.DB.SelectContext(ctx, &result, query, args...)
 	if err != nil {
 		return []Member{}, err
 	}
 	if len(result) == 0 {
 		return []Member{}, nil
 	}
+	if req.Keyset != nil && req.Keyset.Backward {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
 	return result, err
 }
 
-func (a *memberAPI) GetMember(req GetMemberArgs) (Member, error) {
+func (a *memberAPI) GetMember(ctx context.Context, req GetMemberArgs) (Member, error) {
 	member := Member{}
 	restricts, values := req.parseRestricts()
-	query := fmt.Sprintf("SELECT * FROM members where %s", restricts)
+	// Members sharing a nickname come in the order they registered
+	query := fmt.Sprintf("SELECT %s FROM members where %s ORDER BY id LIMIT 1", selectedColumns(req.Fields), restricts)
 
-	err := rrsql.DB.QueryRowx(query, values...).StructScan(&member)
+	err := rrsql.DB.QueryRowxContext(ctx, query, values...).StructScan(&member)
 	switch {
 	case err == sql.ErrNoRows:
-		err = errors.New("User Not Found")
-		member = Member{}
+		return Member{}, ErrUserNotFound
 	case err != nil:
-		log.Fatal(err)
-		member = Member{}
-	default:
-		err = nil
+		return Member{}, err
 	}
-	return member, err
+	return member, nil
 }
 
-func (a *memberAPI) FilterMembers(args *FilterMemberArgs) (result []Stunt, err error) {
+func (a *memberAPI) FilterMembers(ctx context.Context, args *FilterMemberArgs) (result []Stunt, err error) {
+	if _, err = memberOrderBy(args.Sorting); err != nil {
+		return nil, err
+	}
 	query, values := args.ParseQuery()
 
-	rows, err := rrsql.DB.Queryx(query, values...)
+	rows, err := rrsql.DB.QueryxContext(ctx, query, values...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var asset Stunt
 		if err = rows.StructScan(&asset); err != nil {
@@ -434,105 +812,160 @@ func (a *memberAPI) FilterMembers(args *FilterMemberArgs) (result []Stunt, err e
 		}
 		result = append(result, asset)
 	}
+	// Rows stop early if ctx is done, which must not pass for all of them
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if args.Keyset != nil && args.Keyset.Backward {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
 	return result, nil
 }
 
-func (a *memberAPI) InsertMember(m Member) (id int, err error) {
-	existedID := 0
-	err = rrsql.DB.Get(&existedID, `SELECT id FROM members WHERE id=? OR member_id=? LIMIT 1;`, m.ID, m.MemberID)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return 0, err
+func (a *memberAPI) InsertMember(ctx context.Context, m Member, meta AuditMeta) (id int, err error) {
+	err = rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		existedID := 0
+		err := tx.GetContext(ctx, &existedID, `SELECT id FROM members WHERE id=? OR member_id=? LIMIT 1;`, m.ID, m.MemberID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+		if existedID != 0 {
+			return ErrUserExisted
 		}
-	}
-	if existedID != 0 {
-		return 0, errors.New("Duplicate entry")
-	}
 
-	tags := rrsql.GetStructDBTags("partial", m)
-	query := fmt.Sprintf(`INSERT INTO members (%s) VALUES (:%s)`,
-		strings.Join(tags, ","), strings.Join(tags, ",:"))
-	result, err := rrsql.DB.NamedExec(query, m)
-	if err != nil {
-		if strings.Contains(err.Error(), "Duplicate entry") {
-			return 0, errors.New("Duplicate entry")
+		tags := rrsql.GetStructDBTags("partial", m)
+		query := fmt.Sprintf(`INSERT INTO members (%s) VALUES (:%s)`,
+			strings.Join(tags, ","), strings.Join(tags, ",:"))
+		result, err := tx.NamedExecContext(ctx, query, m)
+		if err != nil {
+			if strings.Contains(err.Error(), "Duplicate entry") {
+				return ErrUserExisted
+			}
+			return err
 		}
-		return 0, err
-	}
-	rowCnt, err := result.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if rowCnt > 1 {
-		return 0, errors.New("More Than One Rows Affected")
-	} else if rowCnt == 0 {
-		return 0, errors.New("No Row Inserted")
-	}
-	lastID, err := result.LastInsertId()
+		rowCnt, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowCnt > 1 {
+			return rrsql.MultipleRowAffectedError
+		} else if rowCnt == 0 {
+			return errors.New("No Row Inserted")
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			log.Printf("Fail to get last inserted ID when insert a member: %v", err)
+			return err
+		}
+		id = int(lastID)
+		return insertAudit(ctx, tx, newAudit(lastID, meta, auditActionCreate, Member{}, m, tags))
+	})
 	if err != nil {
-		log.Printf("Fail to get last inserted ID when insert a member: %v", err)
 		return 0, err
 	}
-	return int(lastID), nil
+	return id, nil
 }
 
-func (a *memberAPI) UpdateMember(m Member) error {
-	// query, _ := rrsql.GenerateSQLStmt("partial_update", "members", m)
-	tags := rrsql.GetStructDBTags("partial", m)
-	fields := rrsql.MakeFieldString("update", `%s = :%s`, tags)
-	query := fmt.Sprintf(`UPDATE members SET %s WHERE id = :id`, strings.Join(fields, ", "))
-	result, err := rrsql.DB.NamedExec(query, m)
-
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	rowCnt, err := result.RowsAffected()
-	if rowCnt > 1 {
-		return errors.New("More Than One Rows Affected")
-	} else if rowCnt == 0 {
-		return errors.New("User Not Found")
-	}
-	return nil
+func (a *memberAPI) UpdateMember(ctx context.Context, m Member, meta AuditMeta) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		before := Member{}
+		if err := tx.GetContext(ctx, &before, `SELECT * FROM members WHERE id = ? FOR UPDATE`, m.ID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		// query, _ := rrsql.GenerateSQLStmt("partial_update", "members", m)
+		tags := rrsql.GetStructDBTags("partial", m)
+		fields := rrsql.MakeFieldString("update", `%s = :%s`, tags)
+		query := fmt.Sprintf(`UPDATE members SET %s WHERE id = :id`, strings.Join(fields, ", "))
+		result, err := tx.NamedExecContext(ctx, query, m)
+		if err != nil {
+			return err
+		}
+		// Rows with nothing changed are not counted as affected, so only check for too many
+		if rowCnt, _ := result.RowsAffected(); rowCnt > 1 {
+			return rrsql.MultipleRowAffectedError
+		}
+		return insertAudit(ctx, tx, newAudit(m.ID, meta, auditActionUpdate, before, m, tags))
+	})
 }
 
-func (a *memberAPI) DeleteMember(idType string, id string) error {
-
-	// result, err := rrsql.DB.Exec(fmt.Sprintf("UPDATE members SET active = %d WHERE %s = ?", int(MemberStatus["delete"].(float64)), idType), id)
-	result, err := rrsql.DB.Exec(fmt.Sprintf("UPDATE members SET active = %d WHERE %s = ?", config.Config.Models.Members["delete"], idType), id)
-	if err != nil {
-		return err
-	}
-	rowCnt, err := result.RowsAffected()
-	if rowCnt > 1 {
-		return errors.New("More Than One Rows Affected")
-	} else if rowCnt == 0 {
-		return errors.New("User Not Found")
-	}
-	return err
+func (a *memberAPI) DeleteMember(ctx context.Context, idType string, id string, meta AuditMeta) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		before := Member{}
+		if err := tx.GetContext(ctx, &before, fmt.Sprintf("SELECT * FROM members WHERE %s = ? FOR UPDATE", idType), id); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		deleted := int64(config.Config.Models.Members["delete"])
+		if before.Active.Int == deleted {
+			// Deleting again keeps the state to restore to
+			return nil
+		}
+		after := Member{
+			Active:     rrsql.NullInt{Int: deleted, Valid: true},
+			DeletedAt:  rrsql.NullTime{Time: time.Now(), Valid: true},
+			PrevActive: before.Active,
+		}
+		// result, err := rrsql.DB.Exec(fmt.Sprintf("UPDATE members SET active = %d WHERE %s = ?", int(MemberStatus["delete"].(float64)), idType), id)
+		result, err := tx.ExecContext(ctx, "UPDATE members SET active = ?, deleted_at = ?, prev_active = ? WHERE id = ?",
+			after.Active, after.DeletedAt, after.PrevActive, before.ID)
+		if err != nil {
+			return err
+		}
+		if rowCnt, _ := result.RowsAffected(); rowCnt > 1 {
+			return rrsql.MultipleRowAffectedError
+		}
+		return insertAudit(ctx, tx, newAudit(before.ID, meta, auditActionDelete, before, after, []string{"active", "deleted_at"}))
+	})
 }
 
-func (a *memberAPI) UpdateAll(ids []int64, active int) (err error) {
-	prep := fmt.Sprintf("UPDATE members SET active = %d WHERE id IN (?);", active)
-	query, args, err := sqlx.In(prep, ids)
-	if err != nil {
-		return err
-	}
-	query = rrsql.DB.Rebind(query)
-	result, err := rrsql.DB.Exec(query, args...)
-	if err != nil {
-		return err
-	}
-	rowCnt, err := result.RowsAffected()
-	if rowCnt > int64(len(ids)) {
-		return errors.New("More Rows Affected")
-	} else if rowCnt == 0 {
-		return errors.New("Members Not Found")
-	}
-	return err
+func (a *memberAPI) UpdateAll(ctx context.Context, ids []int64, active int, meta AuditMeta) (err error) {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		query, args, err := sqlx.In(`SELECT * FROM members WHERE id IN (?) FOR UPDATE`, ids)
+		if err != nil {
+			return err
+		}
+		before := []Member{}
+		if err = tx.SelectContext(ctx, &before, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return ErrMembersNotFound
+		}
+
+		deleted := config.Config.Models.Members["delete"]
+		now := rrsql.NullTime{Time: time.Now(), Valid: true}
+		for _, m := range before {
+			after := Member{Active: rrsql.NullInt{Int: int64(active), Valid: true}}
+			switch {
+			case m.Active.Int == int64(active), m.AnonymizedAt.Valid:
+				// Anonymized members stay deleted
+				continue
+			case active == deleted:
+				// Deleted members keep the state to restore to
+				after.DeletedAt, after.PrevActive = now, m.Active
+			}
+			if _, err = tx.ExecContext(ctx, "UPDATE members SET active = ?, deleted_at = ?, prev_active = ? WHERE id = ?",
+				after.Active, after.DeletedAt, after.PrevActive, m.ID); err != nil {
+				return err
+			}
+			if err = insertAudit(ctx, tx, newAudit(m.ID, meta, auditActionBulkUpdate, m, after, []string{"active", "deleted_at"})); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (a *memberAPI) Count(req args.ArgsParser) (result int, err error) {
+func (a *memberAPI) Count(ctx context.Context, req args.ArgsParser) (result int, err error) {
 
 	query, values := req.ParseCountQuery()
 
@@ -541,22 +974,23 @@ func (a *memberAPI) Count(req args.ArgsParser) (result int, err error) {
 		return 0, err
 	}
 	query = rrsql.DB.Rebind(query)
-	count, err := rrsql.DB.Queryx(query, args...)
+	count, err := rrsql.DB.QueryxContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
+	defer count.Close()
 	for count.Next() {
 		if err = count.Scan(&result); err != nil {
 			return 0, err
 		}
 	}
 
-	return result, err
+	return result, count.Err()
 }
 
 // GetMembersByNickname select nickname and uuid from active members only
 // when their nickname fits certain keyword
-func (a *memberAPI) GetIDsByNickname(params GetMembersKeywordsArgs) (result []Stunt, err error) {
+func (a *memberAPI) GetIDsByNickname(ctx context.Context, params GetMembersKeywordsArgs) (result []Stunt, err error) {
 
 	query := fmt.Sprintf(`SELECT %s FROM members WHERE active = ? AND nickname LIKE ?`, strings.Join(params.Fields, ", "))
 	values := []interface{}{}
@@ -570,7 +1004,7 @@ func (a *memberAPI) GetIDsByNickname(params GetMembersKeywordsArgs) (result []St
 	}
 	query, values, err = sqlx.In(query, values...)
 	query = rrsql.DB.Rebind(query)
-	if err = rrsql.DB.Select(&result, query, values...); err != nil {
+	if err = rrsql.DB.SelectContext(ctx, &result, query, values...); err != nil {
 		return []Stunt{}, err
 	}
 	return result, err
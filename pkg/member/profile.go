@@ -0,0 +1,48 @@
+package member
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/readr-media/readr-restful-member/config"
+	rt "github.com/readr-media/readr-restful-member/internal/router"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// profileFields are fields of members shown to anyone. Contacts, birthday, social accounts and points
+// are never in public profiles.
+var profileFields = rrsql.Sqlfields{"id", "uuid", "nickname", "profile_image", "description", "role", "created_at"}
+
+// hiddenProfileFields are the only fields shown of members hiding their profiles
+var hiddenProfileFields = rrsql.Sqlfields{"uuid", "nickname", "profile_image", "hide_profile"}
+
+// publicProfile returns the profile of m shown to others, only the minimal identity if m hides its profile
+func publicProfile(m Member) Stunt {
+	if m.HideProfile.Bool {
+		return stuntOf(m, hiddenProfileFields)
+	}
+	return stuntOf(m, profileFields)
+}
+
+// Profile responds the public profile of an active member by uuid, or by nickname prefixed with @ such as @readr.
+// Deleted, deactivated and pending members are not found. Responses are cached with ETag.
+func (r *memberHandler) Profile(c *gin.Context) {
+
+	active := config.Config.Models.Members["active"]
+	args := GetMemberArgs{ID: c.Param("handle"), IDType: "uuid", Active: &active}
+	if strings.HasPrefix(args.ID, "@") {
+		args.ID, args.IDType = strings.TrimPrefix(args.ID, "@"), "nickname"
+	}
+	if args.ID == "" {
+		rt.RespondError(c, ErrUserNotFound)
+		return
+	}
+	// hiddenProfileFields are among profileFields, except hide_profile itself
+	args.Fields = append(append(rrsql.Sqlfields{}, profileFields...), "hide_profile")
+	member, err := MemberAPI.GetMember(c.Request.Context(), args)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	rt.CacheableJSON(c, gin.H{"_items": []Stunt{publicProfile(member)}})
+}
@@ -11,8 +11,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/apierror"
+	"github.com/readr-media/readr-restful-member/internal/lockout"
 	rt "github.com/readr-media/readr-restful-member/internal/router"
 	"github.com/readr-media/readr-restful-member/internal/rrsql"
+	"github.com/readr-media/readr-restful-member/internal/token"
 	"github.com/readr-media/readr-restful-member/internal/utils"
 )
 
@@ -50,22 +53,43 @@ func (r *memberHandler) bindQuery(c *gin.Context, args *GetMembersArgs) (err err
 			return err
 		}
 	}
+	if c.Query("filter") != "" {
+		if args.Filters, err = rrsql.ParseFilters(c.Query("filter"), memberFilterColumns); err != nil {
+			return err
+		}
+	}
+	if args.MaxResult == 0 || args.Page == 0 {
+		return ErrInvalidPage
+	}
+	if _, err = memberOrderBy(args.Sorting); err != nil {
+		return err
+	}
+	if args.Cursor != "" {
+		if args.Keyset, err = parseMemberCursor(args.Cursor, args.Sorting); err != nil {
+			return err
+		}
+	}
+	if c.Query("fields") != "" {
+		if args.Fields, err = parseFields(c.Query("fields")); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func bindKeywordsArgs(c *gin.Context, params *GetMembersKeywordsArgs) (err error) {
 	if err = c.ShouldBindQuery(params); err != nil {
 		log.Printf("Bind Keyword args error:%s\n", err.Error())
-		return errors.New("Invalid keyword")
+		return ErrInvalidKeyword
 	}
 	if c.Query("fields") != "" {
 		if err = json.Unmarshal([]byte(c.Query("fields")), &params.Fields); err != nil {
-			return errors.New("Invalid fields")
+			return ErrInvalidFields
 		}
 	}
 	if c.Query("roles") != "" {
 		if err = json.Unmarshal([]byte(c.Query("roles")), &params.Roles); err != nil {
-			return errors.New("Invalid roles")
+			return ErrInvalidRoles
 		}
 	}
 	if err = params.Validate(); err != nil {
@@ -73,35 +97,83 @@ func bindKeywordsArgs(c *gin.Context, params *GetMembersKeywordsArgs) (err error
 	}
 	return err
 }
+
+// bindFilterArgs binds query of member filter. Time ranges, fields and filter are given in JSON,
+// such as created_at={"$gt":"2018-01-01T00:00:00Z"}, fields=["id","nickname"] and filter={"points":{"$gte":100}}.
+func bindFilterArgs(c *gin.Context, args *FilterMemberArgs) (err error) {
+
+	// Time ranges are parsed ahead, gin couldn't bind them
+	timeRanges := map[string]map[string]time.Time{}
+	for _, key := range []string{"created_at", "updated_at"} {
+		if c.Query(key) != "" {
+			timeRange := map[string]time.Time{}
+			if err = json.Unmarshal([]byte(c.Query(key)), &timeRange); err != nil {
+				return fmt.Errorf("Invalid %s", key)
+			}
+			timeRanges[key] = timeRange
+		}
+	}
+	args.SetDefault()
+	if err = c.ShouldBindQuery(args); err != nil && err.Error() != "Unknown type" {
+		return ErrInvalidQuery
+	}
+	args.CreatedAt, args.UpdatedAt = timeRanges["created_at"], timeRanges["updated_at"]
+	if c.Query("fields") != "" {
+		if err = json.Unmarshal([]byte(c.Query("fields")), &args.Fields); err != nil {
+			return ErrInvalidFields
+		}
+	}
+	if c.Query("filter") != "" {
+		if args.Filters, err = rrsql.ParseFilters(c.Query("filter"), memberFilterColumns); err != nil {
+			return err
+		}
+	}
+	return args.Validate()
+}
+
 func (r *memberHandler) GetAll(c *gin.Context) {
 
 	var args = &GetMembersArgs{}
 	err := r.bindQuery(c, args)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
 		return
 	}
 	if args.Active == nil {
 		args.DefaultActive()
 	}
 	var results struct {
-		Items []Member         `json:"_items"`
+		Items interface{}      `json:"_items"`
 		Meta  *rt.ResponseMeta `json:"_meta,omitempty"`
 	}
-	results.Items, err = MemberAPI.GetMembers(args)
+	members, err := MemberAPI.GetMembers(c.Request.Context(), args)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		rt.RespondError(c, err)
 		return
 	}
+	results.Items = members
+	if len(args.Fields) > 0 {
+		stunts := make([]Stunt, len(members))
+		for i, m := range members {
+			stunts[i] = stuntOf(m, args.Fields)
+		}
+		results.Items = stunts
+	}
+	var MemberMeta = rt.ResponseMeta{}
 	if args.Total {
-		totalMembers, err := MemberAPI.Count(args)
+		totalMembers, err := MemberAPI.Count(c.Request.Context(), args)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+			rt.RespondError(c, err)
 			return
 		}
-		var MemberMeta = rt.ResponseMeta{
-			Total: &totalMembers,
-		}
+		MemberMeta.Total = &totalMembers
+	}
+	rows := make([]map[string]interface{}, len(members))
+	for i, m := range members {
+		rows[i] = memberValues(m)
+	}
+	MemberMeta.NextCursor, MemberMeta.PrevCursor = memberCursors(args.Sorting, rows, int(args.MaxResult), args.Keyset, int(args.Page))
+	if MemberMeta.Total != nil || MemberMeta.NextCursor != "" || MemberMeta.PrevCursor != "" {
 		results.Meta = &MemberMeta
 	}
 	c.JSON(http.StatusOK, results)
@@ -117,21 +189,42 @@ func (r *memberHandler) Get(c *gin.Context) {
 		idType = "id"
 	}
 
-	member, err := MemberAPI.GetMember(GetMemberArgs{
+	args := GetMemberArgs{
 		ID:     id,
 		IDType: idType,
-	})
-	if err != nil {
-		switch err.Error() {
-		case "User Not Found":
-			c.JSON(http.StatusNotFound, gin.H{"Error": "User Not Found"})
-			return
-
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": "Internal Server Error"})
+	}
+	// With provider, id is the account of that social login provider
+	if provider := c.Query("provider"); provider != "" {
+		args = GetMemberArgs{Provider: provider, Subject: id}
+	}
+	if c.Query("fields") != "" {
+		var err error
+		if args.Fields, err = parseFields(c.Query("fields")); err != nil {
+			rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
 			return
 		}
 	}
+	// Members only read their own accounts, profiles of others are public in /profile
+	if _, ok := callerFrom(c); !ok {
+		rt.RespondError(c, ErrUnauthorized)
+		return
+	}
+	member, err := MemberAPI.GetMember(c.Request.Context(), args)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) && !isManager(c) {
+			// Or members could tell who exists
+			err = ErrForbidden
+		}
+		rt.RespondError(c, err)
+		return
+	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
+	}
+	if len(args.Fields) > 0 {
+		c.JSON(http.StatusOK, gin.H{"_items": []Stunt{stuntOf(member, args.Fields)}})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"_items": []Member{member}})
 }
 
@@ -141,23 +234,31 @@ func (r *memberHandler) Post(c *gin.Context) {
 	c.Bind(&member)
 
 	// Pre-request test
-	// Must have MemberID, ID would be generated by database
+	// Must have MemberID, ID would be generated by database and is rejected by rejectedFields
 	log.Println(member.Mail)
 	if member.MemberID == "" && member.Mail.String == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid User"})
+		rt.RespondError(c, ErrInvalidUser)
 		return
 	}
 	if member.MemberID == "" {
 		member.MemberID = member.Mail.String
 	}
-
-	if !member.CreatedAt.Valid {
-		member.CreatedAt.Time = time.Now()
-		member.CreatedAt.Valid = true
+	// Registrations get default role and state, only managers create members with others
+	if rejected := rejectedFields(member, isManager(c), true); len(rejected) > 0 {
+		rt.RespondError(c, ErrForbiddenFields.WithDetails(rejected))
+		return
 	}
-	if !member.UpdatedAt.Valid {
-		member.UpdatedAt.Time = time.Now()
-		member.UpdatedAt.Valid = true
+
+	member.CreatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	member.UpdatedAt = member.CreatedAt
+	// Ordinary registrations stay pending until the mail is verified, whatever active is given
+	pending := requiresVerification(member)
+	if pending {
+		if !member.Mail.Valid || member.Mail.String == "" {
+			rt.RespondError(c, ErrInvalidUser)
+			return
+		}
+		member.Active = rrsql.NullInt{Int: int64(config.Config.Models.Members["pending"]), Valid: true}
 	}
 	if !member.Active.Valid {
 		member.Active = rrsql.NullInt{1, true}
@@ -167,19 +268,25 @@ func (r *memberHandler) Post(c *gin.Context) {
 	}
 	uuid, err := utils.NewUUIDv4()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": "Unable to generate uuid for user"})
+		rt.RespondError(c, err)
 		return
 	}
 	member.UUID = uuid.String()
-	lastID, err := MemberAPI.InsertMember(member)
+	lastID, err := MemberAPI.InsertMember(c.Request.Context(), member, auditMeta(c, auditActionCreate))
 	if err != nil {
-		switch err.Error() {
-		case "Duplicate entry":
-			c.JSON(http.StatusBadRequest, gin.H{"Error": "User Already Existed"})
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
-			return
+		rt.RespondError(c, err)
+		return
+	}
+	member.ID = int64(lastID)
+	if member.SocialID.Valid && validateProvider(member.RegisterMode.String) {
+		if _, err = LinkIdentity(c.Request.Context(), member, member.RegisterMode.String, member.SocialID.String); err != nil {
+			log.Printf("Error linking identity of member %d: %v\n", member.ID, err)
+		}
+	}
+	if pending {
+		// Member is created anyway, the link could be resent
+		if err = SendVerification(c.Request.Context(), member); err != nil {
+			log.Printf("Error sending verification mail to member %d: %v\n", member.ID, err)
 		}
 	}
 	resp := map[string]int{"last_id": lastID}
@@ -193,28 +300,46 @@ func (r *memberHandler) Put(c *gin.Context) {
 	// Use id field to check if Member Struct was binded successfully
 	// If the binding failed, id would be emtpy string
 	if member.ID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid Member Data"})
+		rt.RespondError(c, ErrInvalidMemberData)
 		return
 	}
-	if member.CreatedAt.Valid {
-		member.CreatedAt.Time = time.Time{}
-		member.CreatedAt.Valid = false
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
 	}
-	if !member.UpdatedAt.Valid {
-		member.UpdatedAt.Time = time.Now()
-		member.UpdatedAt.Valid = true
+	if rejected := rejectedFields(member, isManager(c), false); len(rejected) > 0 {
+		rt.RespondError(c, ErrForbiddenFields.WithDetails(rejected))
+		return
 	}
-	err := MemberAPI.UpdateMember(member)
-	if err != nil {
-		switch err.Error() {
-		case "User Not Found":
-			c.JSON(http.StatusBadRequest, gin.H{"Error": "User Not Found"})
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": "Internal Server Error"})
+	var reverify bool
+	if member.Mail.Valid {
+		var err error
+		if reverify, err = checkMailChange(c.Request.Context(), member, isManager(c)); err != nil {
+			rt.RespondError(c, err)
 			return
 		}
 	}
+	if reverify {
+		// Like ordinary registrations, the member is pending until the new mail is verified
+		member.Active = rrsql.NullInt{Int: int64(config.Config.Models.Members["pending"]), Valid: true}
+	}
+	caller, _ := callerFrom(c)
+	member.UpdatedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+	member.UpdatedBy = rrsql.NullInt{Int: caller.ID, Valid: true}
+	err := MemberAPI.UpdateMember(c.Request.Context(), member, auditMeta(c, auditActionUpdate))
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	if reverify {
+		// Mail is changed anyway, the link could be resent
+		updated, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{ID: strconv.FormatInt(member.ID, 10), IDType: "id"})
+		if err == nil {
+			err = SendVerification(c.Request.Context(), updated)
+		}
+		if err != nil {
+			log.Printf("Error sending verification mail to member %d: %v\n", member.ID, err)
+		}
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -222,25 +347,19 @@ func (r *memberHandler) DeleteAll(c *gin.Context) {
 	ids := []int64{}
 	err := json.Unmarshal([]byte(c.Query("ids")), &ids)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
 		return
 	}
 	if len(ids) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "ID List Empty"})
+		rt.RespondError(c, ErrIDListEmpty)
 		return
 	}
 
-	// err = MemberAPI.UpdateAll(ids, int(MemberStatus["delete"].(float64)))
-	err = MemberAPI.UpdateAll(ids, config.Config.Models.Members["delete"])
+	// err = MemberAPI.UpdateAll(c.Request.Context(), ids, int(MemberStatus["delete"].(float64)))
+	err = MemberAPI.UpdateAll(c.Request.Context(), ids, config.Config.Models.Members["delete"], auditMeta(c, auditActionBulkUpdate))
 	if err != nil {
-		switch err.Error() {
-		case "Members Not Found":
-			c.JSON(http.StatusBadRequest, gin.H{"Error": "Members Not Found"})
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
-			return
-		}
+		rt.RespondError(c, err)
+		return
 	}
 	c.Status(http.StatusOK)
 }
@@ -248,16 +367,14 @@ func (r *memberHandler) DeleteAll(c *gin.Context) {
 func (r *memberHandler) Delete(c *gin.Context) {
 
 	id := c.Param("id")
-	err := MemberAPI.DeleteMember("id", id)
+	intID, _ := strconv.ParseInt(id, 10, 64)
+	if !ownerOrManager(c, intID, scopeDeleteAccount) {
+		return
+	}
+	err := MemberAPI.DeleteMember(c.Request.Context(), "id", id, auditMeta(c, auditActionDelete))
 	if err != nil {
-		switch err.Error() {
-		case "User Not Found":
-			c.JSON(http.StatusNotFound, gin.H{"Error": "User Not Found"})
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
-			return
-		}
+		rt.RespondError(c, err)
+		return
 	}
 	c.Status(http.StatusOK)
 }
@@ -268,116 +385,723 @@ func (r *memberHandler) ActivateAll(c *gin.Context) {
 	}{}
 	err := c.Bind(&payload)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidRequestBody.Code, err))
 		return
 	}
 	if payload.IDs == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid Request Body"})
+		rt.RespondError(c, ErrInvalidRequestBody)
 		return
 	}
-	// err = MemberAPI.UpdateAll(payload.IDs, int(MemberStatus["active"].(float64)))
-	err = MemberAPI.UpdateAll(payload.IDs, config.Config.Models.Members["active"])
+	// err = MemberAPI.UpdateAll(c.Request.Context(), payload.IDs, int(MemberStatus["active"].(float64)))
+	err = MemberAPI.UpdateAll(c.Request.Context(), payload.IDs, config.Config.Models.Members["active"], auditMeta(c, auditActionBulkUpdate))
 	if err != nil {
-		switch err.Error() {
-		case "Members Not Found":
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Members Not Found"})
-			return
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
-			return
-		}
+		rt.RespondError(c, err)
+		return
 	}
 	c.Status(http.StatusOK)
 }
 
-// MemberPutPasswordHandler let caller to update a member's password.
-//
+// PutPassword let caller to update a member's password.
+// Members changing their own password have to provide the current one as old_password, unless they have none yet,
+// while managers could override password of other members without it.
 func (r *memberHandler) PutPassword(c *gin.Context) {
 
 	input := struct {
 		ID          string `json:"id"`
 		NewPassword string `json:"password"`
-		//OldPassword string `json="o"`
+		OldPassword string `json:"old_password"`
 	}{}
 	c.Bind(&input)
 
-	if !utils.ValidateUserID(input.ID) || !utils.ValidatePassword(input.NewPassword) {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": "Invalid Input"})
+	id, err := strconv.ParseInt(input.ID, 10, 64)
+	if !utils.ValidateUserID(input.ID) || err != nil || input.NewPassword == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+	// Authorize before looking up, so callers couldn't tell which ids exist
+	if !ownerOrManager(c, id, scopeUpdateAccount) {
 		return
 	}
 
-	member, err := MemberAPI.GetMember(GetMemberArgs{
+	member, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{
 		ID:     input.ID,
 		IDType: "id",
 	})
 	if err != nil {
-		switch err.Error() {
-		case "User Not Found":
-			c.JSON(http.StatusNotFound, gin.H{"Error": "User Not Found"})
+		rt.RespondError(c, err)
+		return
+	}
+
+	// Manager override applies only to passwords of other members.
+	// Members without password yet, such as those registered with social logins, set the first one without it.
+	if caller, _ := callerFrom(c); caller.ID == member.ID && hasPassword(member) {
+		if input.OldPassword == "" {
+			rt.RespondError(c, ErrOldPasswordRequired)
 			return
-		default:
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": fmt.Sprintf("Internal Server Error. %s", err.Error())})
+		}
+		if _, err = verifyPassword(member, input.OldPassword); err != nil {
+			rt.RespondError(c, err)
 			return
 		}
 	}
 
-	/*
-		oldHPW, err := utils.CryptGenHash(input.OldPassword, string(salt))
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": "Internal Server Error"})
-			return
+	if violations := passwordViolations(member, input.NewPassword); len(violations) > 0 {
+		rt.RespondError(c, ErrPasswordPolicy.WithDetails(violations))
+		return
+	}
+
+	if err = SetPassword(c.Request.Context(), member, input.NewPassword, auditMeta(c, auditActionPasswordChange)); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// CheckPassword validates a candidate password against the password policy without saving it,
+// so signup forms could show the violated rules before submitting.
+func (r *memberHandler) CheckPassword(c *gin.Context) {
+
+	input := struct {
+		Password string `json:"password"`
+		MemberID string `json:"member_id"`
+		Mail     string `json:"mail"`
+		Nickname string `json:"nickname"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+	if violations := utils.ValidatePassword(input.Password, input.Mail, input.Nickname, input.MemberID); len(violations) > 0 {
+		rt.RespondError(c, ErrPasswordPolicy.WithDetails(violations))
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// ForgotPassword mails a password reset link to the member owning mail.
+// It responds the same whether the member exists or not, so it couldn't be used to probe members.
+func (r *memberHandler) ForgotPassword(c *gin.Context) {
+
+	input := struct {
+		Mail string `json:"mail"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Mail == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+	if err := RequestPasswordReset(c.Request.Context(), input.Mail); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// ResetPassword sets a new password for the member a reset token is issued to, and consumes the token.
+// The token is kept if the new password violates the policy, so members could try another one.
+func (r *memberHandler) ResetPassword(c *gin.Context) {
+
+	input := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Token == "" || input.Password == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+
+	hash := token.Hash(input.Token)
+	t, err := TokenAPI.GetToken(c.Request.Context(), tokenPurposePasswordReset, hash)
+	if err != nil {
+		rt.RespondError(c, tokenError(err))
+		return
+	}
+	member, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{
+		ID:     strconv.FormatInt(t.MemberID, 10),
+		IDType: "id",
+	})
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		rt.RespondError(c, err)
+		return
+	}
+	if err != nil || member.Active.Int != int64(config.Config.Models.Members["active"]) {
+		rt.RespondError(c, ErrInvalidToken)
+		return
+	}
+
+	if violations := passwordViolations(member, input.Password); len(violations) > 0 {
+		rt.RespondError(c, ErrPasswordPolicy.WithDetails(violations))
+		return
+	}
+
+	// Consume before setting password, so concurrent requests with the same token set it only once
+	if _, err = TokenAPI.ConsumeToken(c.Request.Context(), tokenPurposePasswordReset, hash); err != nil {
+		rt.RespondError(c, tokenError(err))
+		return
+	}
+	// The reset token proves the request is made by the member itself
+	meta := auditMeta(c, auditActionPasswordChange)
+	meta.ActorID = member.ID
+	if err = SetPassword(c.Request.Context(), member, input.Password, meta); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// VerifyMail activates the pending member a verification token is issued to
+func (r *memberHandler) VerifyMail(c *gin.Context) {
+
+	input := struct {
+		Token string `json:"token"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Token == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+
+	member, err := VerifyMail(c.Request.Context(), input.Token, auditMeta(c, auditActionActivate))
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrUserNotFound) {
+			err = ErrInvalidToken
 		}
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": []Member{member}})
+}
+
+// ResendVerification mails a new verification link to the pending member owning mail.
+// Like ForgotPassword, it responds the same whether the member exists or not.
+func (r *memberHandler) ResendVerification(c *gin.Context) {
+
+	input := struct {
+		Mail string `json:"mail"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Mail == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+	if err := ResendVerification(c.Request.Context(), input.Mail); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// Login verifies the password of a member identified by id, member_id or mail,
+// and returns the member if credentials are valid.
+func (r *memberHandler) Login(c *gin.Context) {
+
+	input := LoginArgs{}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
 
-		if oldHPW != member.Password.String {
-			c.JSON(http.StatusUnauthorized, gin.H{"Error": "Wrong Password"})
+	ipKey := lockout.IPKey(c.ClientIP())
+	if record := lockout.Check(ipKey); record.Locked(time.Now()) {
+		tooManyAttempts(c, record.LockedUntil)
+		return
+	}
+
+	member, err := Authenticate(c.Request.Context(), input, auditMeta(c, auditActionUpdate))
+	if err != nil {
+		var locked *LockedError
+		if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrInvalidCode) {
+			lockout.Fail(ipKey, config.Config.Lockout.IPThreshold)
+		}
+		if errors.As(err, &locked) {
+			tooManyAttempts(c, locked.Until)
+		} else {
+			rt.RespondError(c, err)
 		}
-	*/
+		return
+	}
+	pair, err := issueTokens(c.Request.Context(), member)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	resp := gin.H{"_items": []Member{member}, "token": pair.Token}
+	if twoFactorSetupRequired(member) {
+		// The token only works for enrolling, clients prompt editors and admins to enroll and log in again
+		resp["two_factor_setup_required"] = true
+	} else {
+		resp["refresh_token"] = pair.RefreshToken
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	// Gen salt and password
-	salt, err := utils.CryptGenSalt()
+// EnrollTwoFactor generates a new secret for the caller to add in an authenticator app.
+// Two-factor authentication is turned on after ConfirmTwoFactor.
+func (r *memberHandler) EnrollTwoFactor(c *gin.Context) {
+
+	caller, ok := callerFrom(c)
+	if !ok {
+		rt.RespondError(c, ErrUnauthorized)
+		return
+	}
+	secret, uri, err := EnrollTwoFactor(c.Request.Context(), caller)
 	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": fmt.Sprintf("Internal Server Error. %s", err.Error())})
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+// ConfirmTwoFactor turns on two-factor authentication for the caller with a code from the authenticator app,
+// and returns recovery codes, which are shown only this time.
+func (r *memberHandler) ConfirmTwoFactor(c *gin.Context) {
+
+	caller, ok := callerFrom(c)
+	if !ok {
+		rt.RespondError(c, ErrUnauthorized)
+		return
+	}
+	input := struct {
+		OTP string `json:"otp"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.OTP == "" {
+		rt.RespondError(c, ErrInvalidInput)
+		return
+	}
+	codes, err := ConfirmTwoFactor(c.Request.Context(), caller, input.OTP)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor lets admins turn off two-factor authentication of a member, who lost the authenticator
+// and recovery codes for example. The member could enroll again after logging in with password.
+func (r *memberHandler) DisableTwoFactor(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if err := DisableTwoFactor(c.Request.Context(), member); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// tokenError hides whether a token is missing or expired, either is ErrInvalidToken
+func tokenError(err error) error {
+	if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
+		return ErrInvalidToken
+	}
+	return err
+}
+
+// tooManyAttempts responds 429 with Retry-After set to the end of lock
+func tooManyAttempts(c *gin.Context, until time.Time) {
+	retryAfter := int64(time.Until(until).Seconds()) + 1
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	rt.RespondError(c, ErrTooManyAttempts)
+}
+
+// RefreshToken exchanges a refresh token for a new pair of tokens.
+// Refresh tokens are single-use, the one passed in is consumed.
+func (r *memberHandler) RefreshToken(c *gin.Context) {
+
+	input := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil || input.RefreshToken == "" {
+		rt.RespondError(c, ErrInvalidInput)
 		return
 	}
 
-	hpw, err := utils.CryptGenHash(input.NewPassword, string(salt))
+	t, err := TokenAPI.ConsumeToken(c.Request.Context(), tokenPurposeRefresh, token.Hash(input.RefreshToken))
 	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": fmt.Sprintf("Internal Server Error. %s", err.Error())})
+		rt.RespondError(c, tokenError(err))
 		return
 	}
 
-	err = MemberAPI.UpdateMember(Member{
-		ID:       member.ID,
-		MemberID: member.MemberID,
-		Password: rrsql.NullString{hpw, true},
-		Salt:     rrsql.NullString{salt, true},
+	member, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{
+		ID:     strconv.FormatInt(t.MemberID, 10),
+		IDType: "id",
 	})
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		rt.RespondError(c, err)
+		return
+	}
+	if err != nil || member.Active.Int != int64(config.Config.Models.Members["active"]) {
+		rt.RespondError(c, ErrInvalidToken)
+		return
+	}
+	pair, err := issueTokens(c.Request.Context(), member)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, pair)
+}
+
+// GetLock shows failed login attempts and lock of a member
+func (r *memberHandler) GetLock(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	record := lockout.Check(lockout.MemberKey(member.ID))
+	c.JSON(http.StatusOK, gin.H{"_items": gin.H{
+		"id":           member.ID,
+		"failures":     record.Failures,
+		"locked":       record.Locked(time.Now()),
+		"locked_until": record.LockedUntil,
+	}})
+}
+
+// DeleteLock clears failed login attempts and lock of a member
+func (r *memberHandler) DeleteLock(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if err := lockout.Clear(lockout.MemberKey(member.ID)); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// pathMember finds the member of id in path, responding errors if there is none
+func (r *memberHandler) pathMember(c *gin.Context) (Member, bool) {
+
+	member, err := MemberAPI.GetMember(c.Request.Context(), GetMemberArgs{ID: c.Param("id"), IDType: "id"})
 	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": fmt.Sprintf("Internal Server Error. %s", err.Error())})
+		rt.RespondError(c, err)
+		return Member{}, false
+	}
+	return member, true
+}
+
+// GetIdentities lists social login accounts linked to a member
+func (r *memberHandler) GetIdentities(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
 		return
 	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
+	}
+	identities, err := IdentityAPI.GetIdentities(c.Request.Context(), member.ID)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": identities, "password": hasPassword(member)})
+}
 
+// PostIdentity links a social login account to a member
+func (r *memberHandler) PostIdentity(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
+	}
+	input := struct {
+		Provider string `json:"provider"`
+		Subject  string `json:"subject"`
+	}{}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		rt.RespondError(c, ErrInvalidIdentity)
+		return
+	}
+	identity, err := LinkIdentity(c.Request.Context(), member, input.Provider, input.Subject)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": []MemberIdentity{identity}})
+}
+
+// DeleteIdentity unlinks the account of provider in query from a member
+func (r *memberHandler) DeleteIdentity(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
+	}
+	provider := c.Query("provider")
+	if provider == "" {
+		rt.RespondError(c, ErrInvalidIdentity)
+		return
+	}
+	if err := UnlinkIdentity(c.Request.Context(), member, provider); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// Restore brings a deleted member back to the state before deletion
+func (r *memberHandler) Restore(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	member, err := MemberAPI.RestoreMember(c.Request.Context(), member.ID, auditMeta(c, auditActionRestore))
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": []Member{member}})
+}
+
+// Anonymize scrubs personal data and credentials of a member, keeping the member referred elsewhere
+func (r *memberHandler) Anonymize(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if !ownerOrManager(c, member.ID, scopeDeleteAccount) {
+		return
+	}
+	if err := MemberAPI.AnonymizeMembers(c.Request.Context(), []int64{member.ID}, auditMeta(c, auditActionAnonymize)); err != nil {
+		if errors.Is(err, ErrMembersNotFound) {
+			err = ErrUserNotFound
+		}
+		rt.RespondError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// AnonymizeAll scrubs personal data and credentials of members of ids in body
+func (r *memberHandler) AnonymizeAll(c *gin.Context) {
+	payload := struct {
+		IDs []int64 `json:"ids"`
+	}{}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		rt.RespondError(c, ErrInvalidRequestBody)
+		return
+	}
+	if len(payload.IDs) == 0 {
+		rt.RespondError(c, ErrIDListEmpty)
+		return
+	}
+	if err := MemberAPI.AnonymizeMembers(c.Request.Context(), payload.IDs, auditMeta(c, auditActionAnonymize)); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
+// GetPurge reports members the next purge would erase, without erasing them
+func (r *memberHandler) GetPurge(c *gin.Context) {
+	r.purge(c, true)
+}
+
+// Purge erases a batch of members deleted longer than the grace period
+func (r *memberHandler) Purge(c *gin.Context) {
+	r.purge(c, false)
+}
+
+func (r *memberHandler) purge(c *gin.Context, dryRun bool) {
+	purged, err := PurgeDeletedMembers(c.Request.Context(), dryRun, auditMeta(c, auditActionPurge))
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": purged, "dry_run": dryRun})
+}
+
+// GetHistory lists changes made to a member, latest first, optionally filtered by action and actor
+func (r *memberHandler) GetHistory(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	args := &GetHistoryArgs{}
+	args.SetDefault()
+	if err := c.ShouldBindQuery(args); err != nil {
+		rt.RespondError(c, ErrInvalidQuery)
+		return
+	}
+	if err := args.Validate(); err != nil {
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
+		return
+	}
+	args.MemberID = member.ID
+
+	var results struct {
+		Items []MemberAudit    `json:"_items"`
+		Meta  *rt.ResponseMeta `json:"_meta,omitempty"`
+	}
+	var err error
+	if results.Items, err = AuditAPI.GetHistory(c.Request.Context(), args); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	if args.Total {
+		total, err := AuditAPI.CountHistory(c.Request.Context(), args)
+		if err != nil {
+			rt.RespondError(c, err)
+			return
+		}
+		results.Meta = &rt.ResponseMeta{Total: &total}
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// Export responds an archive of data kept about a member. Archives of large accounts are built in background,
+// responded with the export to check and download later, which is responded again until it expires.
+func (r *memberHandler) Export(c *gin.Context) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return
+	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return
+	}
+	caller, _ := callerFrom(c)
+	archive, export, err := RequestExport(c.Request.Context(), member, caller.ID)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	if archive != nil {
+		sendArchive(c, member.ID, archive)
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/member/%d/export/%d", member.ID, export.ID))
+	if export.Status == exportStatusReady {
+		c.JSON(http.StatusOK, gin.H{"_items": []MemberExport{export}})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"_items": []MemberExport{export}})
+}
+
+// GetExport tells whether an export requested by Export is ready to download
+func (r *memberHandler) GetExport(c *gin.Context) {
+
+	member, exportID, ok := r.pathExport(c)
+	if !ok {
+		return
+	}
+	export, err := ExportAPI.GetExport(c.Request.Context(), member.ID, exportID)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"_items": []MemberExport{export}})
+}
+
+// DownloadExport responds the archive of an export once it is ready
+func (r *memberHandler) DownloadExport(c *gin.Context) {
+
+	member, exportID, ok := r.pathExport(c)
+	if !ok {
+		return
+	}
+	archive, err := GetExportArchive(c.Request.Context(), member.ID, exportID)
+	if err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	sendArchive(c, member.ID, archive)
+}
+
+// pathExport finds the member and export id in path, responding errors if the caller couldn't see them
+func (r *memberHandler) pathExport(c *gin.Context) (Member, int64, bool) {
+
+	member, ok := r.pathMember(c)
+	if !ok {
+		return Member{}, 0, false
+	}
+	if !ownerOrManager(c, member.ID, scopeUpdateAccount) {
+		return Member{}, 0, false
+	}
+	exportID, err := strconv.ParseInt(c.Param("export_id"), 10, 64)
+	if err != nil {
+		rt.RespondError(c, ErrExportNotFound)
+		return Member{}, 0, false
+	}
+	return member, exportID, true
+}
+
+func sendArchive(c *gin.Context, memberID int64, archive []byte) {
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="member-%d-export.zip"`, memberID))
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// Filter searches members by id, mail and nickname, and time ranges of creation and update,
+// responding only the fields asked for, with cursors to the pages around
+func (r *memberHandler) Filter(c *gin.Context) {
+
+	var args = &FilterMemberArgs{}
+	if err := bindFilterArgs(c, args); err != nil {
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
+		return
+	}
+	var results struct {
+		Items []Stunt          `json:"_items"`
+		Meta  *rt.ResponseMeta `json:"_meta,omitempty"`
+	}
+	// Columns sorted by are selected for cursors, and left out of responses unless asked for
+	fields := args.Fields
+	args.Fields = withSortColumns(fields, args.Sorting)
+	var err error
+	if results.Items, err = MemberAPI.FilterMembers(c.Request.Context(), args); err != nil {
+		rt.RespondError(c, err)
+		return
+	}
+	if results.Items == nil {
+		results.Items = []Stunt{}
+	}
+	meta := rt.ResponseMeta{}
+	if args.Total {
+		total, err := MemberAPI.Count(c.Request.Context(), args)
+		if err != nil {
+			rt.RespondError(c, err)
+			return
+		}
+		meta.Total = &total
+	}
+	rows := make([]map[string]interface{}, len(results.Items))
+	for i, s := range results.Items {
+		rows[i] = stuntValues(s)
+		results.Items[i] = projectStunt(s, fields)
+	}
+	meta.NextCursor, meta.PrevCursor = memberCursors(args.Sorting, rows, args.MaxResult, args.Keyset, args.Page)
+	if meta.Total != nil || meta.NextCursor != "" || meta.PrevCursor != "" {
+		results.Meta = &meta
+	}
+	c.JSON(http.StatusOK, results)
+}
+
 func (r *memberHandler) Count(c *gin.Context) {
 
 	var args = &GetMembersArgs{}
 	if err := r.bindQuery(c, args); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
 		return
 	}
 	if args.Active == nil {
 		args.DefaultActive()
 	}
-	count, err := MemberAPI.Count(args)
+	count, err := MemberAPI.Count(c.Request.Context(), args)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		rt.RespondError(c, err)
 		return
 	}
 	resp := map[string]int{"total": count}
@@ -389,12 +1113,19 @@ func (r *memberHandler) SearchKeyNickname(c *gin.Context) {
 	args := GetMembersKeywordsArgs{}
 
 	if err := bindKeywordsArgs(c, &args); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		rt.RespondError(c, apierror.BadRequest(ErrInvalidQuery.Code, err))
 		return
 	}
-	members, err := MemberAPI.GetIDsByNickname(args)
+	// Anyone looks up nicknames, but only managers see more than public profiles
+	if !isManager(c) {
+		if hidden := hiddenFields(args.Fields, config.Config.FieldPresets["public"]); len(hidden) > 0 {
+			rt.RespondError(c, ErrForbiddenFields.WithDetails(hidden))
+			return
+		}
+	}
+	members, err := MemberAPI.GetIDsByNickname(c.Request.Context(), args)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		rt.RespondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"_items": members})
@@ -402,7 +1133,7 @@ func (r *memberHandler) SearchKeyNickname(c *gin.Context) {
 
 func (r *memberHandler) SetRoutes(router *gin.Engine) {
 
-	memberRouter := router.Group("/member")
+	memberRouter := router.Group("/member", r.authenticate)
 	{
 		memberRouter.GET("/:id", r.Get)
 		memberRouter.POST("", r.Post)
@@ -410,15 +1141,51 @@ func (r *memberHandler) SetRoutes(router *gin.Engine) {
 		memberRouter.DELETE("/:id", r.Delete)
 
 		memberRouter.PUT("/password", r.PutPassword)
+		memberRouter.POST("/password/check", r.CheckPassword)
+		memberRouter.POST("/password/forgot", r.ForgotPassword)
+		memberRouter.POST("/password/reset", r.ResetPassword)
+		memberRouter.POST("/login", r.Login)
+		memberRouter.POST("/token/refresh", r.RefreshToken)
+		memberRouter.POST("/verify", r.VerifyMail)
+		memberRouter.POST("/verify/resend", r.ResendVerification)
+
+		memberRouter.GET("/:id/lock", RequireScopes(scopeMemberManage), r.GetLock)
+		memberRouter.DELETE("/:id/lock", RequireScopes(scopeMemberManage), r.DeleteLock)
+
+		memberRouter.POST("/2fa/enroll", r.EnrollTwoFactor)
+		memberRouter.POST("/2fa/confirm", r.ConfirmTwoFactor)
+		memberRouter.DELETE("/:id/2fa", RequireScopes(scopeMemberManage), r.DisableTwoFactor)
+
+		memberRouter.GET("/:id/history", RequireScopes(scopeMemberManage), r.GetHistory)
+		memberRouter.POST("/:id/restore", RequireScopes(scopeMemberManage), r.Restore)
+		memberRouter.POST("/:id/anonymize", r.Anonymize)
+
+		memberRouter.GET("/:id/export", r.Export)
+		// POST is kept as an alias for clients requesting exports with it
+		memberRouter.POST("/:id/export", r.Export)
+		memberRouter.GET("/:id/export/:export_id", r.GetExport)
+		memberRouter.GET("/:id/export/:export_id/download", r.DownloadExport)
+
+		memberRouter.GET("/:id/identities", r.GetIdentities)
+		memberRouter.POST("/:id/identities", r.PostIdentity)
+		memberRouter.DELETE("/:id/identities", r.DeleteIdentity)
 	}
-	membersRouter := router.Group("/members")
+	// Profiles are the same to everyone, so they are cached regardless of callers
+	router.GET("/profile/:handle", r.Profile)
+
+	membersRouter := router.Group("/members", r.authenticate)
 	{
-		membersRouter.GET("", r.GetAll)
-		membersRouter.PUT("", r.ActivateAll)
-		membersRouter.DELETE("", r.DeleteAll)
+		membersRouter.GET("", RequireScopes(scopeMemberManage), r.GetAll)
+		membersRouter.PUT("", RequireScopes(scopeMemberManage), r.ActivateAll)
+		membersRouter.DELETE("", RequireScopes(scopeMemberManage), r.DeleteAll)
 
-		membersRouter.GET("/count", r.Count)
+		membersRouter.GET("/count", RequireScopes(scopeMemberManage), r.Count)
 		membersRouter.GET("/nickname", r.SearchKeyNickname)
+		membersRouter.GET("/filter", RequireScopes(scopeMemberManage), r.Filter)
+
+		membersRouter.GET("/purge", RequireScopes(scopeMemberManage), r.GetPurge)
+		membersRouter.POST("/purge", RequireScopes(scopeMemberManage), r.Purge)
+		membersRouter.POST("/anonymize", RequireScopes(scopeMemberManage), r.AnonymizeAll)
 	}
 }
 
@@ -1,16 +1,18 @@
 package member
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
-	"sort"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -18,27 +20,30 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/readr-media/readr-restful-member/config"
-	"github.com/readr-media/readr-restful-member/internal/args"
+	"github.com/readr-media/readr-restful-member/internal/lockout"
+	"github.com/readr-media/readr-restful-member/internal/mail"
+	rt "github.com/readr-media/readr-restful-member/internal/router"
 	"github.com/readr-media/readr-restful-member/internal/rrsql"
 	tc "github.com/readr-media/readr-restful-member/internal/test"
+	"github.com/readr-media/readr-restful-member/internal/token"
+	"github.com/readr-media/readr-restful-member/internal/totp"
 	"github.com/readr-media/readr-restful-member/internal/utils"
 )
 
-type mockMemberAPI struct{}
-
 // Declare a backup struct for member test data
 var mockMembers = []Member{
 	Member{
-		ID:           1,
-		MemberID:     "superman@mirrormedia.mg",
-		UUID:         "3d64e480-3e30-11e8-b94b-cfe922eb374f",
-		Nickname:     rrsql.NullString{String: "readr", Valid: true},
-		Active:       rrsql.NullInt{Int: 1, Valid: true},
-		UpdatedAt:    rrsql.NullTime{Time: time.Date(2017, 6, 8, 16, 27, 52, 0, time.UTC), Valid: true},
-		Mail:         rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
-		CustomEditor: rrsql.NullBool{Bool: true, Valid: true},
-		Role:         rrsql.NullInt{Int: 9, Valid: true},
-		Points:       rrsql.NullInt{Int: 0, Valid: true},
+		ID:               1,
+		MemberID:         "superman@mirrormedia.mg",
+		UUID:             "3d64e480-3e30-11e8-b94b-cfe922eb374f",
+		Nickname:         rrsql.NullString{String: "readr", Valid: true},
+		Active:           rrsql.NullInt{Int: 1, Valid: true},
+		UpdatedAt:        rrsql.NullTime{Time: time.Date(2017, 6, 8, 16, 27, 52, 0, time.UTC), Valid: true},
+		Mail:             rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
+		CustomEditor:     rrsql.NullBool{Bool: true, Valid: true},
+		Role:             rrsql.NullInt{Int: 9, Valid: true},
+		TwoFactorEnabled: twoFactorOn,
+		Points:           rrsql.NullInt{Int: 0, Valid: true},
 	},
 	Member{
 		ID:        2,
@@ -67,163 +72,36 @@ var mockMembers = []Member{
 	},
 }
 
-var mockMemberDS = []Member{}
-
-func (a *mockMemberAPI) GetMembers(req *GetMembersArgs) (result []Member, err error) {
-
-	if req.CustomEditor == true {
-		result = []Member{mockMemberDS[0]}
-		err = nil
-		return result, err
-	}
-
-	if req.Role != nil {
-		result = []Member{mockMemberDS[2]}
-		err = nil
-		return result, err
-	}
-	if len(req.Active) > 1 {
-		return []Member{}, errors.New("Too many active lists")
-	}
-	for k, v := range req.Active {
-		if k == "$nin" && reflect.DeepEqual(v, []int{0, -1}) {
-			return []Member{mockMemberDS[0]}, nil
-		} else if k == "$nin" && reflect.DeepEqual(v, []int{-1, 0, 1}) {
-			return []Member{}, nil
-		} else if reflect.DeepEqual(v, []int{-3, 0, 1}) {
-			return []Member{}, errors.New("Not all active elements are valid")
-		} else if reflect.DeepEqual(v, []int{3, 4}) {
-			return []Member{}, errors.New("No valid active request")
-		}
-	}
-
-	result = make([]Member, len(mockMemberDS))
-	copy(result, mockMemberDS)
-	switch req.Sorting {
-	case "updated_at":
-		sort.SliceStable(result, func(i, j int) bool {
-			return result[i].UpdatedAt.Before(result[j].UpdatedAt)
-		})
-		err = nil
-	case "-updated_at":
-		sort.SliceStable(result, func(i, j int) bool {
-			return result[i].UpdatedAt.After(result[j].UpdatedAt)
-		})
-		err = nil
-	}
-	if req.MaxResult == 2 {
-		result = result[0:2]
-	}
-	return result, err
-}
-
-func (a *mockMemberAPI) GetMember(req GetMemberArgs) (result Member, err error) {
-	intID, _ := strconv.Atoi(req.ID)
-	for _, value := range mockMemberDS {
-		if req.IDType == "id" && value.ID == int64(intID) {
-			return value, nil
-		} else if req.IDType == "member_id" && value.MemberID == req.ID {
-			return value, nil
-		} else if req.IDType == "mail" && req.ID == "registerdupeuser@mirrormedia.mg" {
-			return Member{RegisterMode: rrsql.NullString{"ordinary", true}}, nil
-		}
-	}
-	err = errors.New("User Not Found")
-	return result, err
-}
-
-func (a *mockMemberAPI) FilterMembers(args *FilterMemberArgs) (result []Stunt, err error) {
-	return result, nil
-}
-
-func (a *mockMemberAPI) InsertMember(m Member) (id int, err error) {
-	for _, member := range mockMemberDS {
-		if member.MemberID == m.MemberID {
-			return 0, errors.New("Duplicate entry")
-		}
-	}
-	m.ID = int64(len(mockMemberDS) + 1)
-	mockMemberDS = append(mockMemberDS, m)
-	err = nil
-	return int(m.ID), err
-}
-func (a *mockMemberAPI) UpdateMember(m Member) error {
-
-	err := errors.New("User Not Found")
-	for index, member := range mockMemberDS {
-		if member.ID == m.ID {
-			mockMemberDS[index] = m
-			err = nil
-		}
-	}
-	return err
-}
+// twoFactorOn marks admins and editors in tests as having turned on two-factor authentication,
+// otherwise their tokens only work for enrolling
+var twoFactorOn = rrsql.NullBool{Bool: true, Valid: true}
 
-func (a *mockMemberAPI) DeleteMember(idType string, id string) error {
+// memoryStore keeps members, and everything kept about them, in tests
+var memoryStore = newMemoryAPI()
 
-	err := errors.New("User Not Found")
-	intID, _ := strconv.Atoi(id)
-	for index, value := range mockMemberDS {
-		if int64(intID) == value.ID {
-			// mockMemberDS[index].Active = rrsql.NullInt{Int: int64(MemberStatus["delete"].(float64)), Valid: true}
-			mockMemberDS[index].Active = rrsql.NullInt{Int: int64(config.Config.Models.Members["delete"]), Valid: true}
-			return nil
-		}
-	}
-	return err
+// stalledMemberAPI makes listing members hang until the request is abandoned, like a query stuck in MySQL
+type stalledMemberAPI struct {
+	MemberInterface
 }
 
-func (a *mockMemberAPI) UpdateAll(ids []int64, active int) (err error) {
-
-	result := make([]int, 0)
-	for _, value := range ids {
-		for i, v := range mockMemberDS {
-			if v.ID == value {
-				mockMemberDS[i].Active = rrsql.NullInt{Int: int64(active), Valid: true}
-				result = append(result, i)
-			}
-		}
-	}
-	if len(result) == 0 {
-		err = errors.New("Members Not Found")
-		return err
-	}
-	return err
+func (a stalledMemberAPI) GetMembers(ctx context.Context, req *GetMembersArgs) ([]Member, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
 }
 
-func (a *mockMemberAPI) Count(req args.ArgsParser) (result int, err error) {
-	query, _ := req.ParseCountQuery()
-	result = 0
-	err = errors.New("Members Not Found")
-	if strings.Contains(query, "custom_editor") {
-		return 1, nil
-	}
-	if strings.Contains(query, "role") {
-		return 1, nil
-	}
-	if strings.Contains(query, "members.active NOT IN (?))") {
-		return 4, nil
-	}
-	if strings.Contains(query, "members.active IN (?))") {
-		return 2, nil
-	}
-	if strings.Contains(query, "CAST(members.mail as CHAR) LIKE") {
-		return 1, nil
-	}
-	return result, err
-}
+var mockOutbox = mail.Outbox{}
 
-func (a *mockMemberAPI) GetIDsByNickname(params GetMembersKeywordsArgs) (result []Stunt, err error) {
-	if params.Keywords == "readr" {
-		if params.Roles != nil {
-			result = append(result, Stunt{ID: &(mockMemberDS[0].ID), Nickname: &(mockMemberDS[0].Nickname)})
-			return result, err
-		}
-		result = append(result, Stunt{ID: &(mockMemberDS[0].ID), Nickname: &(mockMemberDS[0].Nickname)})
-		return result, err
+// testRequestID is sent as X-Request-ID by test requests, so error responses carry a known request ID
+const testRequestID = "test-request"
 
+// errorBody returns the envelope responded for an error of code and message, with details if any
+func errorBody(code string, message string, details ...interface{}) string {
+	resp := rt.ErrorResponse{Code: code, Message: message, RequestID: testRequestID}
+	if len(details) > 0 {
+		resp.Details = details[0]
 	}
-	return result, err
+	body, _ := json.Marshal(resp)
+	return string(body)
 }
 
 func TestMain(m *testing.M) {
@@ -234,7 +112,12 @@ func TestMain(m *testing.M) {
 	}
 
 	tc.SetRoutes(&Router)
-	MemberAPI = new(mockMemberAPI)
+	tc.Header.Set(rt.RequestIDHeader, testRequestID)
+	MemberAPI, AuditAPI = memoryStore, memoryStore
+	TokenAPI, IdentityAPI, TwoFactorAPI, ExportAPI, FollowAPI = memoryStore, memoryStore, memoryStore, memoryStore, memoryStore
+	mail.MailAPI = &mockOutbox
+	lockout.DefaultStore = lockout.NewMemoryStore()
+	config.Config.Mail.TemplatePath = "../../config"
 	os.Exit(m.Run())
 }
 
@@ -243,15 +126,22 @@ func TestRouteMembers(t *testing.T) {
 	if os.Getenv("db_driver") == "mysql" {
 		_, _ = rrsql.DB.Exec("truncate table members;")
 	} else {
-		mockMemberDS = []Member{}
+		memoryStore.members = []Member{}
 	}
 
 	for _, m := range mockMembers {
-		_, err := MemberAPI.InsertMember(m)
+		_, err := MemberAPI.InsertMember(context.Background(), m, AuditMeta{})
 		if err != nil {
 			log.Printf("Init member test fail %s", err.Error())
 		}
 	}
+	// Call as the admin, member 1
+	manager, err := issueTokens(context.Background(), mockMembers[0])
+	if err != nil {
+		t.Fatalf("Fail to issue token for admin: %v", err)
+	}
+	tc.Header.Set("Authorization", "Bearer "+manager.Token)
+	defer tc.Header.Del("Authorization")
 
 	asserter := func(resp string, tc tc.GenericTestcase, t *testing.T) {
 		type response struct {
@@ -286,14 +176,33 @@ func TestRouteMembers(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"UpdatedAtDescending", "GET", "/members", ``, http.StatusOK, []Member{mockMembers[1], mockMembers[0], mockMembers[2]}},
 			tc.GenericTestcase{"UpdatedAtAscending", "GET", "/members?sort=updated_at", ``, http.StatusOK, []Member{mockMembers[2], mockMembers[0], mockMembers[1]}},
+			tc.GenericTestcase{"UnknownSort", "GET", "/members?sort=-updated_at,shoe_size", ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid sort: shoe_size")},
+			tc.GenericTestcase{"SortByHiddenField", "GET", "/members?sort=password", ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid sort: password")},
+			tc.GenericTestcase{"SortInjection", "GET", "/members?sort=id%3BDROP%20TABLE%20members", ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid sort: id;DROP TABLE members")},
 			tc.GenericTestcase{"max_result", "GET", "/members?max_result=2", ``, http.StatusOK, []Member{mockMembers[1], mockMembers[0]}},
+			tc.GenericTestcase{"LastPage", "GET", "/members?max_result=255&page=65535", ``, http.StatusOK, `{"_items":[]}`},
+			tc.GenericTestcase{"InvalidPage", "GET", "/members?page=0", ``, http.StatusBadRequest, errorBody("invalid_page", "Invalid Page")},
 			tc.GenericTestcase{"ActiveFilter", "GET", `/members?active={"$nin":[0,-1]}`, ``, http.StatusOK, []Member{mockMembers[0]}},
 			tc.GenericTestcase{"CustomEditorFilter", "GET", `/members?custom_editor=true`, ``, http.StatusOK, []Member{mockMembers[0]}},
 			tc.GenericTestcase{"NoMatchMembers", "GET", `/members?active={"$nin":[-1,0,1]}`, ``, http.StatusOK, `{"_items":[]}`},
-			tc.GenericTestcase{"MoreThanOneActive", "GET", `/members?active={"$nin":[1,0], "$in":[-1,3]}`, ``, http.StatusBadRequest, `{"Error":"Too many active lists"}`},
-			tc.GenericTestcase{"NotEntirelyValidActive", "GET", `/members?active={"$in":[-3,0,1]}`, ``, http.StatusBadRequest, `{"Error":"Not all active elements are valid"}`},
-			tc.GenericTestcase{"NoValidActive", "GET", `/members?active={"$nin":[3,4]}`, ``, http.StatusBadRequest, `{"Error":"No valid active request"}`},
+			tc.GenericTestcase{"MoreThanOneActive", "GET", `/members?active={"$nin":[1,0], "$in":[-1,3]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Too many active lists")},
+			tc.GenericTestcase{"NotEntirelyValidActive", "GET", `/members?active={"$in":[-3,0,1]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Not all active elements are valid")},
+			tc.GenericTestcase{"NoValidActive", "GET", `/members?active={"$nin":[3,4]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "No valid active request")},
 			tc.GenericTestcase{"Role", "GET", `/members?role=1`, ``, http.StatusOK, []Member{mockMembers[2]}},
+			tc.GenericTestcase{"Filter", "GET", `/members?filter={"role":{"$gte":3}}`, ``, http.StatusOK, []Member{mockMembers[1], mockMembers[0]}},
+			tc.GenericTestcase{"FilterNull", "GET", `/members?filter={"birthday":{"$null":false},"gender":{"$in":["m","F"]}}`, ``, http.StatusOK, []Member{mockMembers[2]}},
+			tc.GenericTestcase{"FilterWithActive", "GET", `/members?filter={"role":{"$gte":3}}&active={"$in":[1]}`, ``, http.StatusOK, []Member{mockMembers[0]}},
+			tc.GenericTestcase{"FilterUnknownColumn", "GET", `/members?filter={"shoe_size":{"$gt":40}}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter: shoe_size")},
+			tc.GenericTestcase{"FilterHiddenColumn", "GET", `/members?filter={"password":{"$null":true}}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter: password")},
+			tc.GenericTestcase{"FilterUnknownOperator", "GET", `/members?filter={"role":{"$regex":"9"}}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter: role $regex")},
+			tc.GenericTestcase{"FilterWrongType", "GET", `/members?filter={"role":{"$eq":"admin"}}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter: role $eq")},
+			tc.GenericTestcase{"FilterInvalidJSON", "GET", `/members?filter=role>3`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter")},
+			tc.GenericTestcase{"Fields", "GET", `/members?role=1&fields=["id","mail"]`, ``, http.StatusOK, `{"_items":[{"id":3,"mail":"Barney.Corwin@hotmail.com"}]}`},
+			tc.GenericTestcase{"FieldsPreset", "GET", `/members?role=1&fields=card`, ``, http.StatusOK, `{"_items":[{"id":3,"uuid":"3d6512e8-3e30-11e8-b94b-cfe922eb374f","nickname":"reader"}]}`},
+			tc.GenericTestcase{"FieldsHidden", "GET", `/members?fields=["id","password"]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"password"})},
+			tc.GenericTestcase{"FieldsUnknownPreset", "GET", `/members?fields=everything`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"everything"})},
+			tc.GenericTestcase{"FieldsInvalidJSON", "GET", `/members?fields=["id"`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields")},
+			tc.GenericTestcase{"FieldsEmpty", "GET", `/members?fields=[]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -301,8 +210,11 @@ func TestRouteMembers(t *testing.T) {
 	t.Run("GetMember", func(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"Current", "GET", "/member/1", ``, http.StatusOK, []Member{mockMembers[0]}},
-			tc.GenericTestcase{"NotExisted", "GET", "/member/24601", ``, http.StatusNotFound, `{"Error":"User Not Found"}`},
+			tc.GenericTestcase{"NotExisted", "GET", "/member/24601", ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
 			tc.GenericTestcase{"NotExisted", "GET", "/member/superman@mirrormedia.mg", ``, http.StatusOK, []Member{mockMembers[0]}},
+			tc.GenericTestcase{"Fields", "GET", `/member/2?fields=["id","birthday","mail","phone"]`, ``, http.StatusOK, `{"_items":[{"id":2,"birthday":"2001-01-03T00:00:00Z","mail":"Lulu_Brakus@yahoo.com"}]}`},
+			tc.GenericTestcase{"FieldsPreset", "GET", `/member/1?fields=public`, ``, http.StatusOK, `{"_items":[{"id":1,"uuid":"3d64e480-3e30-11e8-b94b-cfe922eb374f","nickname":"readr","role":9}]}`},
+			tc.GenericTestcase{"FieldsHidden", "GET", `/member/1?fields=["salt"]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"salt"})},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -310,8 +222,8 @@ func TestRouteMembers(t *testing.T) {
 	t.Run("PostMember", func(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"New", "POST", "/member", `{"member_id":"spaceoddity", "name":"Major Tom", "mail":"spaceoddity"}`, http.StatusOK, `{"_items":{"last_id":4}}`},
-			//tc.GenericTestcase{"EmptyPayload", "POST", "/member", `{}`, http.StatusBadRequest, `{"Error":"Invalid User"}`},
-			//tc.GenericTestcase{"Existed", "POST", "/member", `{"id": 1, "member_id":"superman@mirrormedia.mg"}`, http.StatusBadRequest, `{"Error":"User Already Existed"}`},
+			//tc.GenericTestcase{"EmptyPayload", "POST", "/member", `{}`, http.StatusBadRequest, errorBody("invalid_user", "Invalid User")},
+			//tc.GenericTestcase{"Existed", "POST", "/member", `{"id": 1, "member_id":"superman@mirrormedia.mg"}`, http.StatusConflict, errorBody("user_already_existed", "User Already Existed")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -321,10 +233,11 @@ func TestRouteMembers(t *testing.T) {
 			tc.GenericTestcase{"SimpleCount", "GET", "/members/count", ``, http.StatusOK, `{"_meta":{"total":4}}`},
 			tc.GenericTestcase{"CountActive", "GET", `/members/count?active={"$in":[1,-1]}`, ``, http.StatusOK, `{"_meta":{"total":2}}`},
 			tc.GenericTestcase{"CountCustomEditor", "GET", `/members/count?custom_editor=true`, ``, http.StatusOK, `{"_meta":{"total":1}}`},
-			tc.GenericTestcase{"MoreThanOneActive", "GET", `/members/count?active={"$nin":[1,0], "$in":[-1,3]}`, ``, http.StatusBadRequest, `{"Error":"Too many active lists"}`},
-			tc.GenericTestcase{"NotEntirelyValidActive", "GET", `/members/count?active={"$in":[-3,0,1]}`, ``, http.StatusBadRequest, `{"Error":"Not all active elements are valid"}`},
-			tc.GenericTestcase{"NoValidActive", "GET", `/members/count?active={"$nin":[3,4]}`, ``, http.StatusBadRequest, `{"Error":"No valid active request"}`},
+			tc.GenericTestcase{"MoreThanOneActive", "GET", `/members/count?active={"$nin":[1,0], "$in":[-1,3]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Too many active lists")},
+			tc.GenericTestcase{"NotEntirelyValidActive", "GET", `/members/count?active={"$in":[-3,0,1]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Not all active elements are valid")},
+			tc.GenericTestcase{"NoValidActive", "GET", `/members/count?active={"$nin":[3,4]}`, ``, http.StatusBadRequest, errorBody("invalid_query", "No valid active request")},
 			tc.GenericTestcase{"Role", "GET", "/members/count?role=9", ``, http.StatusOK, `{"_meta":{"total":1}}`},
+			tc.GenericTestcase{"Filter", "GET", `/members/count?filter={"role":{"$gte":3}}`, ``, http.StatusOK, `{"_meta":{"total":2}}`},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -333,8 +246,8 @@ func TestRouteMembers(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"Keyword", "GET", `/members/nickname?keyword=readr`, ``, http.StatusOK, `{"_items":[{"id":1,"nickname":"readr"}]}`},
 			tc.GenericTestcase{"KeywordAndRoles", "GET", `/members/nickname?keyword=readr&roles={"$in":[3,9]}`, ``, http.StatusOK, `{"_items":[{"id":1,"nickname":"readr"}]}`},
-			tc.GenericTestcase{"InvalidKeyword", "GET", `/members/nickname`, ``, http.StatusBadRequest, `{"Error":"Invalid keyword"}`},
-			tc.GenericTestcase{"InvalidFields", "GET", `/members/nickname?keyword=readr&fields=["line"]`, ``, http.StatusBadRequest, `{"Error":"Invalid fields: line"}`},
+			tc.GenericTestcase{"InvalidKeyword", "GET", `/members/nickname`, ``, http.StatusBadRequest, errorBody("invalid_keyword", "Invalid keyword")},
+			tc.GenericTestcase{"InvalidFields", "GET", `/members/nickname?keyword=readr&fields=["line"]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"line"})},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -343,7 +256,7 @@ func TestRouteMembers(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"New", "PUT", "/member", `{"id":1, "name":"Clark Kent"}`, http.StatusOK, ``},
 			tc.GenericTestcase{"UpdateDailyPush", "PUT", "/member", `{"id":1, "daily_push":true}`, http.StatusOK, ``},
-			tc.GenericTestcase{"NotExisted", "PUT", "/member", `{"id":24601, "name":"spaceoddity"}`, http.StatusBadRequest, `{"Error":"User Not Found"}`},
+			tc.GenericTestcase{"NotExisted", "PUT", "/member", `{"id":24601, "name":"spaceoddity"}`, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -352,9 +265,9 @@ func TestRouteMembers(t *testing.T) {
 	t.Run("DeleteMembers", func(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"Delete", "DELETE", `/members?ids=[2]`, ``, http.StatusOK, ``},
-			tc.GenericTestcase{"Empty", "DELETE", `/members?ids=[]`, ``, http.StatusBadRequest, `{"Error":"ID List Empty"}`},
-			//tc.GenericTestcase{"InvalidQueryArray", "DELETE", `/members?ids=["superman@mirrormedia.mg,"test6743"]`, ``, http.StatusBadRequest, `{"Error":"invalid character 't' after array element"}`},
-			tc.GenericTestcase{"NotFound", "DELETE", `/members?ids=[24601, 24602]`, ``, http.StatusBadRequest, `{"Error":"Members Not Found"}`},
+			tc.GenericTestcase{"Empty", "DELETE", `/members?ids=[]`, ``, http.StatusBadRequest, errorBody("id_list_empty", "ID List Empty")},
+			//tc.GenericTestcase{"InvalidQueryArray", "DELETE", `/members?ids=["superman@mirrormedia.mg,"test6743"]`, ``, http.StatusBadRequest, errorBody("invalid_query", "invalid character 't' after array element")},
+			tc.GenericTestcase{"NotFound", "DELETE", `/members?ids=[24601, 24602]`, ``, http.StatusNotFound, errorBody("members_not_found", "Members Not Found")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -362,7 +275,7 @@ func TestRouteMembers(t *testing.T) {
 	t.Run("DeleteMember", func(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"Current", "DELETE", `/member/3`, ``, http.StatusOK, ``},
-			tc.GenericTestcase{"NonExisted", "DELETE", `/member/24601`, ``, http.StatusNotFound, `{"Error":"User Not Found"}`},
+			tc.GenericTestcase{"NonExisted", "DELETE", `/member/24601`, ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -370,8 +283,8 @@ func TestRouteMembers(t *testing.T) {
 	t.Run("ActivateMultipleMembers", func(t *testing.T) {
 		for _, testcase := range []tc.GenericTestcase{
 			tc.GenericTestcase{"CurrentMembers", "PUT", `/members`, `{"ids": [1,2]}`, http.StatusOK, ``},
-			tc.GenericTestcase{"NotFound", "PUT", `/members`, `{"ids": [24601, 24602]}`, http.StatusNotFound, `{"Error":"Members Not Found"}`},
-			tc.GenericTestcase{"InvalidPayload", "PUT", `/members`, `{}`, http.StatusBadRequest, `{"Error":"Invalid Request Body"}`},
+			tc.GenericTestcase{"NotFound", "PUT", `/members`, `{"ids": [24601, 24602]}`, http.StatusNotFound, errorBody("members_not_found", "Members Not Found")},
+			tc.GenericTestcase{"InvalidPayload", "PUT", `/members`, `{}`, http.StatusBadRequest, errorBody("invalid_request_body", "Invalid Request Body")},
 		} {
 			tc.GenericDoTest(testcase, t, asserter)
 		}
@@ -383,22 +296,59 @@ func TestRouteMemberUpdatePassword(t *testing.T) {
 
 	var r *gin.Engine
 	r = gin.New()
+	r.Use(rt.RequestID)
 	Router.SetRoutes(r)
 
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true},
+			Password: rrsql.NullString{String: hpw, Valid: true}, Salt: rrsql.NullString{String: salt, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		// Registered with social login, without password yet
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true},
+			RegisterMode: rrsql.NullString{String: "oauth-fb", Valid: true}},
+	}
+	admin, err := issueTokens(context.Background(), memoryStore.members[1])
+	if err != nil {
+		t.Fatalf("Fail to issue token for admin: %v", err)
+	}
+	self, err := issueTokens(context.Background(), memoryStore.members[0])
+	if err != nil {
+		t.Fatalf("Fail to issue token for member: %v", err)
+	}
+	social, err := issueTokens(context.Background(), memoryStore.members[2])
+	if err != nil {
+		t.Fatalf("Fail to issue token for member: %v", err)
+	}
+
 	type ChangePWCaseIn struct {
-		ID       string `json:"id,omitempty"`
-		Password string `json:"password,omitempty"`
+		ID          string `json:"id,omitempty"`
+		Password    string `json:"password,omitempty"`
+		OldPassword string `json:"old_password,omitempty"`
 	}
 
 	var TestRouteChangePWCases = []struct {
 		name     string
 		in       ChangePWCaseIn
+		bearer   string
 		httpcode int
 	}{
-		{"ChangePWOK", ChangePWCaseIn{ID: "1", Password: "angrypug"}, http.StatusOK},
-		{"ChangePWFail", ChangePWCaseIn{ID: "1"}, http.StatusBadRequest},
-		{"ChangePWNoID", ChangePWCaseIn{Password: "angrypug"}, http.StatusBadRequest},
-		{"ChangePWMemberNotFound", ChangePWCaseIn{ID: "24601", Password: "angrypug"}, http.StatusNotFound},
+		{"ChangePWAnonymous", ChangePWCaseIn{ID: "1", Password: "happypug42", OldPassword: "angrypug"}, "", http.StatusUnauthorized},
+		{"ChangePWOtherMember", ChangePWCaseIn{ID: "2", Password: "happypug42", OldPassword: "angrypug"}, self.Token, http.StatusForbidden},
+		{"ChangePWOK", ChangePWCaseIn{ID: "1", Password: "happypug42", OldPassword: "angrypug"}, self.Token, http.StatusOK},
+		{"ChangePWWrongOld", ChangePWCaseIn{ID: "1", Password: "happypug42", OldPassword: "angrypug"}, self.Token, http.StatusUnauthorized},
+		{"ChangePWNoOld", ChangePWCaseIn{ID: "1", Password: "happypug42"}, self.Token, http.StatusBadRequest},
+		{"ChangePWOldTooLong", ChangePWCaseIn{ID: "1", Password: "happypug42", OldPassword: strings.Repeat("angrypug", 17)}, self.Token, http.StatusBadRequest},
+		{"ChangePWFail", ChangePWCaseIn{ID: "1"}, self.Token, http.StatusBadRequest},
+		{"ChangePWNoID", ChangePWCaseIn{Password: "angrypug42"}, self.Token, http.StatusBadRequest},
+		{"ChangePWMemberNotFound", ChangePWCaseIn{ID: "24601", Password: "angrypug42"}, self.Token, http.StatusForbidden},
+		{"ChangePWMemberNotFoundByManager", ChangePWCaseIn{ID: "24601", Password: "angrypug42"}, admin.Token, http.StatusNotFound},
+		{"ChangePWFirstPassword", ChangePWCaseIn{ID: "3", Password: "happypug42"}, social.Token, http.StatusOK},
+		{"ChangePWSecondPasswordNoOld", ChangePWCaseIn{ID: "3", Password: "angrypug42"}, social.Token, http.StatusBadRequest},
+		{"ChangePWPolicyViolation", ChangePWCaseIn{ID: "1", Password: "pug", OldPassword: "happypug42"}, self.Token, http.StatusUnprocessableEntity},
+		{"ChangePWSameAsMemberID", ChangePWCaseIn{ID: "1", Password: "superman@mirrormedia.mg", OldPassword: "happypug42"}, self.Token, http.StatusUnprocessableEntity},
+		{"ChangePWAdminOverride", ChangePWCaseIn{ID: "1", Password: "angrypug42"}, admin.Token, http.StatusOK},
 	}
 
 	for _, testcase := range TestRouteChangePWCases {
@@ -408,7 +358,11 @@ func TestRouteMemberUpdatePassword(t *testing.T) {
 			t.Fail()
 		}
 		req, _ := http.NewRequest("PUT", "/member/password", bytes.NewBuffer(jsonStr))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
 		req.Header.Set("Content-Type", "application/json")
+		if testcase.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+testcase.bearer)
+		}
 
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, req)
@@ -419,7 +373,7 @@ func TestRouteMemberUpdatePassword(t *testing.T) {
 		}
 
 		if w.Code == http.StatusOK {
-			member, err := MemberAPI.GetMember(GetMemberArgs{
+			member, err := MemberAPI.GetMember(context.Background(), GetMemberArgs{
 				ID:     testcase.in.ID,
 				IDType: "id",
 			})
@@ -428,16 +382,1628 @@ func TestRouteMemberUpdatePassword(t *testing.T) {
 				t.Fail()
 			}
 
-			newPW, err := utils.CryptGenHash(testcase.in.Password, member.Salt.String)
+			ok, _, err := utils.CryptVerifyPassword(testcase.in.Password, member.Password.String, member.Salt.String)
 			switch {
 			case err != nil:
-				t.Errorf("Error when hashing password, testcase %s", testcase.name)
+				t.Errorf("Error when verifying password, testcase %s", testcase.name)
 				t.Fail()
-			case newPW != member.Password.String:
+			case !ok:
 				t.Errorf("%v", member.ID)
-				t.Errorf("Password update fail Want %v but get %v, testcase %s", newPW, member.Password.String, testcase.name)
+				t.Errorf("Password update fail, %v doesn't match %s, testcase %s", member.Password.String, testcase.in.Password, testcase.name)
 				t.Fail()
 			}
+			if !member.PasswordChangedAt.Valid {
+				t.Errorf("Expect password_changed_at to be recorded, testcase %s", testcase.name)
+			}
+		}
+	}
+}
+
+func TestRouteMemberCheckPassword(t *testing.T) {
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"Valid", "POST", "/member/password/check", `{"password":"angrypug42"}`, http.StatusOK, ``},
+		tc.GenericTestcase{"TooShort", "POST", "/member/password/check", `{"password":"pug42"}`, http.StatusUnprocessableEntity,
+			errorBody("password_policy_violation", "Password Policy Violation", json.RawMessage(`[{"rule":"min_length","message":"Password must be at least 8 characters"}]`))},
+		tc.GenericTestcase{"SameAsNickname", "POST", "/member/password/check", `{"password":"angrypug42","nickname":"AngryPug42"}`, http.StatusUnprocessableEntity,
+			errorBody("password_policy_violation", "Password Policy Violation", json.RawMessage(`[{"rule":"personal_info","message":"Password must not be the same as mail, nickname or member_id"}]`))},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+}
+
+func TestRouteMemberLogin(t *testing.T) {
+
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	password, passwordSalt := rrsql.NullString{String: hpw, Valid: true}, rrsql.NullString{String: salt, Valid: true}
+
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Mail: rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 2, MemberID: "test6743@test.test", Active: rrsql.NullInt{Int: 0, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Active: rrsql.NullInt{Int: -1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 4, MemberID: "spaceoddity", Active: rrsql.NullInt{Int: 1, Valid: true}},
+	}
+
+	asserter := func(resp string, tc tc.GenericTestcase, t *testing.T) {
+		var Response struct {
+			Items []map[string]interface{} `json:"_items"`
+		}
+		if err := json.Unmarshal([]byte(resp), &Response); err != nil {
+			t.Errorf("%s, Unexpected result body: %v", resp, err.Error())
+		}
+		if len(Response.Items) != 1 || Response.Items[0]["id"] != float64(tc.Resp.(int)) {
+			t.Errorf("%s, expect to get member %v, but %v", tc.Name, tc.Resp, resp)
+		}
+		for _, secret := range []string{"password", "salt"} {
+			if _, ok := Response.Items[0][secret]; ok {
+				t.Errorf("%s, expect %s not to be returned", tc.Name, secret)
+			}
+		}
+	}
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ByID", "POST", "/member/login", `{"id":"1","password":"angrypug"}`, http.StatusOK, 1},
+		tc.GenericTestcase{"ByMemberID", "POST", "/member/login", `{"member_id":"superman@mirrormedia.mg","password":"angrypug"}`, http.StatusOK, 1},
+		tc.GenericTestcase{"ByMail", "POST", "/member/login", `{"mail":"superman@mirrormedia.mg","password":"angrypug"}`, http.StatusOK, 1},
+		tc.GenericTestcase{"WrongPassword", "POST", "/member/login", `{"id":"1","password":"happypug"}`, http.StatusUnauthorized, errorBody("wrong_password", "Wrong Password")},
+		tc.GenericTestcase{"NoPasswordSet", "POST", "/member/login", `{"id":"4","password":"angrypug"}`, http.StatusUnauthorized, errorBody("wrong_password", "Wrong Password")},
+		tc.GenericTestcase{"NotExisted", "POST", "/member/login", `{"id":"24601","password":"angrypug"}`, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		tc.GenericTestcase{"Deactivated", "POST", "/member/login", `{"id":"2","password":"angrypug"}`, http.StatusForbidden, errorBody("user_deactivated", "User Deactivated")},
+		tc.GenericTestcase{"Deleted", "POST", "/member/login", `{"id":"3","password":"angrypug"}`, http.StatusGone, errorBody("user_deleted", "User Deleted")},
+		tc.GenericTestcase{"NoIdentifier", "POST", "/member/login", `{"password":"angrypug"}`, http.StatusBadRequest, errorBody("invalid_input", "Invalid Input")},
+		tc.GenericTestcase{"NoPassword", "POST", "/member/login", `{"id":"1"}`, http.StatusBadRequest, errorBody("invalid_input", "Invalid Input")},
+		tc.GenericTestcase{"PasswordTooLong", "POST", "/member/login", fmt.Sprintf(`{"id":"1","password":"%s"}`, strings.Repeat("angrypug", 17)),
+			http.StatusBadRequest, errorBody("password_too_long", "Password Too Long")},
+	} {
+		tc.GenericDoTest(testcase, t, asserter)
+	}
+
+	t.Run("RehashLegacyPassword", func(t *testing.T) {
+		member, _ := MemberAPI.GetMember(context.Background(), GetMemberArgs{ID: "1", IDType: "id"})
+		if !strings.HasPrefix(member.Password.String, "$argon2id$") {
+			t.Fatalf("Expect legacy hash to be upgraded on login, but get %v", member.Password.String)
+		}
+		if ok, needRehash, err := utils.CryptVerifyPassword("angrypug", member.Password.String, member.Salt.String); err != nil || !ok || needRehash {
+			t.Errorf("Expect upgraded hash to verify with current parameters, but get %v, %v, %v", ok, needRehash, err)
+		}
+		if member.PasswordChangedAt.Valid {
+			t.Errorf("Expect rehash not to be recorded as a password change")
+		}
+		tc.GenericDoTest(tc.GenericTestcase{"LoginAfterRehash", "POST", "/member/login", `{"id":"1","password":"angrypug"}`, http.StatusOK, 1}, t, asserter)
+	})
+}
+
+func TestRouteMemberToken(t *testing.T) {
+
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	password, passwordSalt := rrsql.NullString{String: hpw, Valid: true}, rrsql.NullString{String: salt, Valid: true}
+
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn,
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 2, MemberID: "test6743@test.test", Role: rrsql.NullInt{Int: 1, Valid: true},
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+	}
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+
+	do := func(method, url, body, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	login := func(id string) (pair TokenPair) {
+		w := do("POST", "/member/login", fmt.Sprintf(`{"id":"%s","password":"angrypug"}`, id), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Login %s fail: %d %s", id, w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &pair)
+		return pair
+	}
+
+	member := login("2")
+	if member.Token == "" || member.RefreshToken == "" {
+		t.Fatalf("Expect tokens returned after login, but get %v", member)
+	}
+	// Logging in as admin takes a second factor, which TestRouteMemberTwoFactor covers
+	admin, err := issueTokens(context.Background(), memoryStore.members[0])
+	if err != nil {
+		t.Fatalf("Fail to issue token for admin: %v", err)
+	}
+
+	t.Run("Middleware", func(t *testing.T) {
+		for _, testcase := range []struct {
+			name     string
+			method   string
+			url      string
+			body     string
+			bearer   string
+			httpcode int
+		}{
+			{"ValidToken", "GET", "/member/1", ``, admin.Token, http.StatusOK},
+			{"InvalidToken", "GET", "/member/1", ``, "thisisnotatoken", http.StatusUnauthorized},
+			{"OtherUpdate", "PUT", "/member", `{"id":1, "nickname":"pug"}`, member.Token, http.StatusForbidden},
+			{"OtherPassword", "PUT", "/member/password", `{"id":"1", "password":"angrypug"}`, member.Token, http.StatusForbidden},
+			{"SelfUpdate", "PUT", "/member", `{"id":2, "nickname":"pug"}`, member.Token, http.StatusOK},
+			{"AdminUpdate", "PUT", "/member", `{"id":2, "nickname":"pug"}`, admin.Token, http.StatusOK},
+		} {
+			if w := do(testcase.method, testcase.url, testcase.body, testcase.bearer); w.Code != testcase.httpcode {
+				t.Errorf("%s want %d but get %d", testcase.name, testcase.httpcode, w.Code)
+			}
+		}
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		w := do("POST", "/member/token/refresh", fmt.Sprintf(`{"refresh_token":"%s"}`, admin.RefreshToken), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Refresh want %d but get %d", http.StatusOK, w.Code)
+		}
+		var pair TokenPair
+		json.Unmarshal(w.Body.Bytes(), &pair)
+		if pair.Token == "" || pair.RefreshToken == "" || pair.RefreshToken == admin.RefreshToken {
+			t.Errorf("Expect a new pair of tokens, but get %v", pair)
+		}
+		if w := do("POST", "/member/token/refresh", fmt.Sprintf(`{"refresh_token":"%s"}`, admin.RefreshToken), ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Reuse refresh token want %d but get %d", http.StatusUnauthorized, w.Code)
+		}
+		if w := do("POST", "/member/token/refresh", `{}`, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Empty refresh token want %d but get %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestRouteMemberScopes(t *testing.T) {
+
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		// Role 2 is not configured, so it has no scope at all
+		Member{ID: 4, MemberID: "spaceoddity", Role: rrsql.NullInt{Int: 2, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+	}
+	tokens := map[string]string{}
+	for name, m := range map[string]Member{"admin": memoryStore.members[0], "member": memoryStore.members[1], "unscoped": memoryStore.members[3]} {
+		pair, err := issueTokens(context.Background(), m)
+		if err != nil {
+			t.Fatalf("Fail to issue token for %s: %v", name, err)
+		}
+		tokens[name] = pair.Token
+	}
+
+	t.Run("TokenScopes", func(t *testing.T) {
+		claims, err := token.Parse(tokens["admin"])
+		if err != nil {
+			t.Fatalf("Fail to parse token: %v", err)
+		}
+		if !reflect.DeepEqual(claims.Scopes, []string{"memberManage", "updateAccount", "deleteAccount"}) {
+			t.Errorf("Expect admin token to carry scopes of admin, but get %v", claims.Scopes)
+		}
+		if claims, _ = token.Parse(tokens["unscoped"]); len(claims.Scopes) != 0 {
+			t.Errorf("Expect no scope for unconfigured role, but get %v", claims.Scopes)
+		}
+	})
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	for _, testcase := range []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		bearer   string
+		httpcode int
+		resp     string
+	}{
+		{"GetAnonymous", "GET", "/member/2", ``, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"GetOther", "GET", "/member/3", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"GetNotExistedByMember", "GET", "/member/24601", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"ListAnonymous", "GET", "/members", ``, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"ListMember", "GET", "/members", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"CountMember", "GET", "/members/count", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"NicknameHiddenFields", "GET", `/members/nickname?keyword=pug&fields=["mail","phone"]`, ``, "", http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"mail", "phone"})},
+		{"UpdateAnonymous", "PUT", "/member", `{"id":2, "nickname":"pug"}`, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"UpdateSelf", "PUT", "/member", `{"id":2, "nickname":"pug"}`, tokens["member"], http.StatusOK, ``},
+		{"UpdateSelfRole", "PUT", "/member", `{"id":2, "role":9}`, tokens["member"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"role"})},
+		{"UpdateSelfPoints", "PUT", "/member", `{"id":2, "points":100}`, tokens["member"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"points"})},
+		{"UpdateSelfPremium", "PUT", "/member", `{"id":2, "premium_before":"2030-01-01T00:00:00Z"}`, tokens["member"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"premium_before"})},
+		{"UpdateOther", "PUT", "/member", `{"id":3, "nickname":"pug"}`, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"UpdateSelfUnscoped", "PUT", "/member", `{"id":4, "nickname":"pug"}`, tokens["unscoped"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"UpdateSelfSystem", "PUT", "/member", `{"id":2, "uuid":"3d64e480-3e30-11e8-b94b-cfe922eb374f", "created_at":"2030-01-01T00:00:00Z", "two_factor_enabled":false}`, tokens["member"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"uuid", "created_at", "two_factor_enabled"})},
+		{"ManagerUpdateImmutable", "PUT", "/member", `{"id":3, "member_id":"majortom", "register_mode":"oauth-fb", "role":3}`, tokens["admin"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"member_id", "register_mode"})},
+		{"ManagerUpdateSystem", "PUT", "/member", `{"id":3, "updated_by":1}`, tokens["admin"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"updated_by"})},
+		{"RegisterWithUUID", "POST", "/member", `{"member_id":"majortom", "uuid":"3d64e480-3e30-11e8-b94b-cfe922eb374f"}`, "", http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"uuid"})},
+		{"ManagerUpdateRole", "PUT", "/member", `{"id":3, "role":3, "active":0}`, tokens["admin"], http.StatusOK, ``},
+		{"RegisterWithRole", "POST", "/member", `{"member_id":"majortom", "role":9}`, "", http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"role"})},
+		{"ManagerCreateWithID", "POST", "/member", `{"id":24601, "member_id":"majortom"}`, tokens["admin"], http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"id"})},
+		{"ManagerCreateWithRole", "POST", "/member", `{"member_id":"majortom", "role":3}`, tokens["admin"], http.StatusOK, `{"_items":{"last_id":5}}`},
+		{"ActivateAllAnonymous", "PUT", "/members", `{"ids":[3]}`, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"ActivateAllMember", "PUT", "/members", `{"ids":[3]}`, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"DeleteAllMember", "DELETE", `/members?ids=[3]`, ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"LockMember", "GET", "/member/3/lock", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"DeleteOther", "DELETE", "/member/3", ``, tokens["member"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"DeleteSelfUnscoped", "DELETE", "/member/4", ``, tokens["unscoped"], http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"DeleteSelf", "DELETE", "/member/2", ``, tokens["member"], http.StatusOK, ``},
+		{"ManagerDelete", "DELETE", "/member/3", ``, tokens["admin"], http.StatusOK, ``},
+	} {
+		req, _ := http.NewRequest(testcase.method, testcase.url, strings.NewReader(testcase.body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		if testcase.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+testcase.bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != testcase.httpcode || w.Body.String() != testcase.resp {
+			t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+		}
+	}
+	if m, _ := MemberAPI.GetMember(context.Background(), GetMemberArgs{ID: "3", IDType: "id"}); m.Role.Int != 3 || m.UpdatedBy.Int != 1 {
+		t.Errorf("Expect manager to change role and be recorded as updated_by, but get %v, %v", m.Role, m.UpdatedBy)
+	}
+}
+
+func TestRouteMemberHistory(t *testing.T) {
+
+	hpw, _ := utils.CryptHashPassword("angrypug")
+	password := rrsql.NullString{String: hpw, Valid: true}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password},
+	}
+	memoryStore.audits = []MemberAudit{}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	member, _ := issueTokens(context.Background(), memoryStore.members[1])
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	do := func(method, url, body, bearer, requestID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		if requestID != "" {
+			req.Header.Set(rt.RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, change := range []struct {
+		method, url, body, bearer, requestID string
+	}{
+		{"PUT", "/member", `{"id":2, "nickname":"pug"}`, member.Token, "req-1"},
+		{"PUT", "/member", `{"id":2, "nickname":"pug"}`, member.Token, ""},
+		{"PUT", "/member/password", `{"id":"2", "password":"happypug42", "old_password":"angrypug"}`, member.Token, "req-2"},
+		{"DELETE", `/members?ids=[2]`, ``, admin.Token, ""},
+		{"PUT", "/members", `{"ids":[2]}`, admin.Token, ""},
+		{"POST", "/member", `{"member_id":"spaceoddity"}`, "", ""},
+		{"DELETE", "/member/3", ``, admin.Token, ""},
+	} {
+		if w := do(change.method, change.url, change.body, change.bearer, change.requestID); w.Code != http.StatusOK {
+			t.Fatalf("%s %s want %d but get %d %s", change.method, change.url, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("RequestID", func(t *testing.T) {
+		if id := do("GET", "/member/1", ``, "", "req-3").Header().Get(rt.RequestIDHeader); id != "req-3" {
+			t.Errorf("Expect request ID echoed, but get %s", id)
+		}
+		if id := do("GET", "/member/1", ``, "", "not a valid id!").Header().Get(rt.RequestIDHeader); len(id) != 36 {
+			t.Errorf("Expect request ID generated for invalid one, but get %s", id)
+		}
+	})
+
+	t.Run("Changes", func(t *testing.T) {
+		w := do("GET", "/member/2/history", ``, admin.Token, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Want %d but get %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "$argon2id") {
+			t.Errorf("Expect password hash redacted, but get %s", w.Body.String())
+		}
+		var resp struct {
+			Items []MemberAudit `json:"_items"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		// Updating nickname again changes nothing, so it is not recorded
+		actions := []string{}
+		for _, audit := range resp.Items {
+			actions = append(actions, audit.Action)
+		}
+		if !reflect.DeepEqual(actions, []string{"bulk_update", "bulk_update", "password_change", "update"}) {
+			t.Fatalf("Expect actions latest first, but get %v", actions)
+		}
+		update := resp.Items[3]
+		if update.ActorID.Int != 2 || update.RequestID.String != "req-1" ||
+			!reflect.DeepEqual(update.Changes["nickname"], AuditChange{Before: nil, After: "pug"}) {
+			t.Errorf("Unexpected update audit %v", update)
+		}
+		if len(update.Changes) != 1 {
+			t.Errorf("Expect only nickname among changes, but get %v", update.Changes)
+		}
+		change := resp.Items[2]
+		if change.Changes["password"] != (AuditChange{Before: "[REDACTED]", After: "[REDACTED]"}) || change.RequestID.String != "req-2" {
+			t.Errorf("Unexpected password change audit %v", change)
+		}
+		if _, ok := change.Changes["salt"]; !ok {
+			t.Errorf("Expect salt emptied among changes, but get %v", change.Changes)
+		}
+		deleted := resp.Items[1]
+		if deleted.ActorID.Int != 1 || !reflect.DeepEqual(deleted.Changes["active"], AuditChange{Before: float64(1), After: float64(-1)}) {
+			t.Errorf("Unexpected bulk update audit %v", deleted)
+		}
+	})
+
+	for _, testcase := range []struct {
+		name     string
+		url      string
+		bearer   string
+		httpcode int
+		resp     string
+	}{
+		{"ByAction", "/member/2/history?action=password_change", admin.Token, http.StatusOK, `"action":"password_change"`},
+		{"ByActor", "/member/2/history?actor=1&total=true", admin.Token, http.StatusOK, `"_meta":{"total":2}`},
+		{"Page", "/member/2/history?max_result=1&page=4&total=true", admin.Token, http.StatusOK, `"_meta":{"total":4}`},
+		{"PageOut", "/member/2/history?max_result=1&page=5", admin.Token, http.StatusOK, `{"_items":[]}`},
+		{"LastPage", "/member/2/history?max_result=255&page=65535", admin.Token, http.StatusOK, `{"_items":[]}`},
+		{"Create", "/member/3/history?action=create", admin.Token, http.StatusOK, `"member_id":{"before":"","after":"spaceoddity"}`},
+		{"Delete", "/member/3/history?action=delete", admin.Token, http.StatusOK, `"changes":{"active":{"before":1,"after":-1},"deleted_at":{"before":null,`},
+		{"InvalidAction", "/member/2/history?action=drop", admin.Token, http.StatusBadRequest, errorBody("invalid_action", "Invalid Action")},
+		{"InvalidPage", "/member/2/history?page=0", admin.Token, http.StatusBadRequest, errorBody("invalid_page", "Invalid Page")},
+		{"NotExisted", "/member/24601/history", admin.Token, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		{"Self", "/member/2/history", member.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"Anonymous", "/member/2/history", "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+	} {
+		w := do("GET", testcase.url, ``, testcase.bearer, testRequestID)
+		if w.Code != testcase.httpcode || !strings.Contains(w.Body.String(), testcase.resp) {
+			t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+		}
+	}
+	if page := do("GET", "/member/2/history?max_result=1&page=4", ``, admin.Token, ""); !strings.Contains(page.Body.String(), `"action":"update"`) {
+		t.Errorf("Expect the earliest change on the last page, but get %s", page.Body.String())
+	}
+}
+
+func TestRouteMemberLifecycle(t *testing.T) {
+
+	longAgo := rrsql.NullTime{Time: time.Now().AddDate(0, 0, -60), Valid: true}
+	active, pending, deleted := rrsql.NullInt{Int: 1, Valid: true}, rrsql.NullInt{Int: 2, Valid: true}, rrsql.NullInt{Int: -1, Valid: true}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: active},
+		Member{ID: 2, MemberID: "test6743@test.test", Mail: rrsql.NullString{String: "test6743@test.test", Valid: true}, Role: rrsql.NullInt{Int: 1, Valid: true}, Active: active},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: pending},
+		Member{ID: 4, MemberID: "spaceoddity", Mail: rrsql.NullString{String: "majortom@mirrormedia.mg", Valid: true}, Active: deleted, DeletedAt: longAgo, PrevActive: active},
+		Member{ID: 5, MemberID: "majortom", Mail: rrsql.NullString{String: "majortom@mirrormedia.mg", Valid: true}, Active: active},
+		Member{ID: 6, MemberID: "majortom", Active: deleted, DeletedAt: longAgo},
+	}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	member, _ := issueTokens(context.Background(), memoryStore.members[1])
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	do := func(method, url, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, testcase := range []struct {
+		name     string
+		method   string
+		url      string
+		bearer   string
+		httpcode int
+		resp     string
+	}{
+		{"RestoreByMember", "POST", "/member/4/restore", member.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"RestoreNotDeleted", "POST", "/member/2/restore", admin.Token, http.StatusConflict, errorBody("user_not_deleted", "User Not Deleted")},
+		{"RestoreNotExisted", "POST", "/member/24601/restore", admin.Token, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		{"RestoreMailTaken", "POST", "/member/4/restore", admin.Token, http.StatusConflict, errorBody("mail_taken", "Mail Taken")},
+		{"RestoreMemberIDTaken", "POST", "/member/6/restore", admin.Token, http.StatusConflict, errorBody("member_id_taken", "Member ID Taken")},
+		{"DeleteSelf", "DELETE", "/member/2", member.Token, http.StatusOK, ``},
+		{"DeletePending", "DELETE", `/members?ids=[3]`, admin.Token, http.StatusOK, ``},
+		{"DeleteAgain", "DELETE", "/member/3", admin.Token, http.StatusOK, ``},
+		{"DeletedCouldNotLogin", "GET", "/member/2", member.Token, http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		{"Restore", "POST", "/member/2/restore", admin.Token, http.StatusOK, `"active":1,"custom_editor":null`},
+		{"RestorePending", "POST", "/member/3/restore", admin.Token, http.StatusOK, `"active":2,"custom_editor":null`},
+		{"RestoredLogin", "GET", "/member/2", member.Token, http.StatusOK, `"id":2,`},
+		{"PurgeByMember", "GET", "/members/purge", member.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"PurgeDryRun", "GET", "/members/purge", admin.Token, http.StatusOK, `{"_items":[{"id":4,"member_id":"spaceoddity","deleted_at":"`},
+		{"PurgeDryRunKeeps", "GET", "/member/4", admin.Token, http.StatusOK, `"id":4,`},
+	} {
+		w := do(testcase.method, testcase.url, testcase.bearer)
+		if w.Code != testcase.httpcode || !strings.Contains(w.Body.String(), testcase.resp) {
+			t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("Purge", func(t *testing.T) {
+		// Member 2 is deleted again just now, within the grace period
+		do("DELETE", "/member/2", admin.Token)
+		batchSize := config.Config.Purge.BatchSize
+		config.Config.Purge.BatchSize = 1
+		defer func() { config.Config.Purge.BatchSize = batchSize }()
+
+		var resp struct {
+			Items  []PurgeCandidate `json:"_items"`
+			DryRun bool             `json:"dry_run"`
+		}
+		for _, expected := range [][]int64{{4}, {6}, {}} {
+			w := do("POST", "/members/purge", admin.Token)
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			ids := []int64{}
+			for _, p := range resp.Items {
+				ids = append(ids, p.ID)
+			}
+			if w.Code != http.StatusOK || resp.DryRun || !reflect.DeepEqual(ids, expected) {
+				t.Errorf("Purge want %v but get %d %s", expected, w.Code, w.Body.String())
+			}
+		}
+		for _, id := range []string{"4", "6"} {
+			if w := do("GET", "/member/"+id, admin.Token); w.Code != http.StatusNotFound {
+				t.Errorf("Expect member %s erased, but get %d", id, w.Code)
+			}
+		}
+		if w := do("GET", "/member/2", admin.Token); w.Code != http.StatusOK {
+			t.Errorf("Expect member deleted within grace period kept, but get %d", w.Code)
+		}
+	})
+}
+
+// readArchive unzips an export archive into file names and contents
+func readArchive(t *testing.T, b []byte) map[string]string {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("Fail to read archive: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		rc, _ := f.Open()
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestRouteMemberExport(t *testing.T) {
+
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", Mail: rrsql.NullString{String: "test6743@test.test", Valid: true},
+			Password: rrsql.NullString{String: "$argon2id$v=19$m=65536,t=1,p=2$c2VjcmV0$aGFzaA", Valid: true}, Salt: rrsql.NullString{String: "pepper-salt", Valid: true},
+			Points: rrsql.NullInt{Int: 42, Valid: true}, DailyPush: rrsql.NullBool{Bool: true, Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+	}
+	memoryStore.identities = []MemberIdentity{MemberIdentity{ID: 1, MemberID: 2, Provider: "oauth-goo", Subject: "g-2"}}
+	memoryStore.follows = []MemberFollow{
+		MemberFollow{MemberID: 2, TargetID: 3, Type: config.Config.Models.FollowingType["member"], Emotion: config.Config.Models.Emotions["follow"]},
+		MemberFollow{MemberID: 3, TargetID: 2, Type: config.Config.Models.FollowingType["member"], Emotion: config.Config.Models.Emotions["follow"]},
+	}
+	memoryStore.audits = []MemberAudit{}
+	memoryStore.keepAudit(newAudit(2, AuditMeta{}, auditActionCreate, Member{}, memoryStore.members[1], []string{"member_id", "points"}))
+	memoryStore.keepAudit(newAudit(2, AuditMeta{ActorID: 2}, auditActionPasswordChange, Member{}, memoryStore.members[1], []string{"password"}))
+	memoryStore.exports = []MemberExport{}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	self, _ := issueTokens(context.Background(), memoryStore.members[1])
+	other, _ := issueTokens(context.Background(), memoryStore.members[2])
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	do := func(method, url, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	checkArchive := func(name string, w *httptest.ResponseRecorder) {
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" ||
+			w.Header().Get("Content-Disposition") != `attachment; filename="member-2-export.zip"` {
+			t.Fatalf("%s expect archive but get %d %s", name, w.Code, w.Body.String())
+		}
+		files := readArchive(t, w.Body.Bytes())
+		for _, section := range []string{"member", "identities", "history", "points", "follows", "notifications"} {
+			for _, f := range []string{section + ".json", section + ".csv"} {
+				if _, ok := files[f]; !ok {
+					t.Errorf("%s expect %s in archive", name, f)
+				}
+				if !strings.Contains(files["manifest.json"], `"`+f+`"`) {
+					t.Errorf("%s expect %s in manifest, but get %s", name, f, files["manifest.json"])
+				}
+			}
+		}
+		for f, content := range files {
+			if strings.Contains(content, "pepper-salt") || strings.Contains(content, "argon2id") {
+				t.Errorf("%s expect no secrets, but get %s: %s", name, f, content)
+			}
+		}
+		for f, expected := range map[string]string{
+			"member.json":        `"points": 42,`,
+			"member.csv":         "id,member_id,uuid,points,",
+			"identities.csv":     "1,2,oauth-goo,g-2,",
+			"history.json":       `"action": "password_change"`,
+			"history.csv":        `{""password"":{""before"":""[REDACTED]"",""after"":""[REDACTED]""}}`,
+			"manifest.json":      `{"member_id":2,`,
+			"identities.json":    `"provider": "oauth-goo"`,
+			"points.json":        `"points": 42,`,
+			"points.csv":         "member_id,points,premium_before\n2,42,\n",
+			"follows.json":       `"target_id": 3,`,
+			"follows.csv":        "member_id,target_id,type,emotion,created_at\n2,3,1,0,\n",
+			"notifications.json": `"daily_push": true,`,
+			"notifications.csv":  "member_id,profile_push,post_push,daily_push,comment_push\n2,,,true,\n",
+		} {
+			if !strings.Contains(files[f], expected) {
+				t.Errorf("%s expect %s in %s, but get %s", name, expected, f, files[f])
+			}
+		}
+		if strings.Contains(strings.Split(files["member.csv"], "\n")[0], "salt") {
+			t.Errorf("%s expect no salt column, but get %s", name, files["member.csv"])
+		}
+	}
+
+	t.Run("Sync", func(t *testing.T) {
+		for _, testcase := range []struct {
+			name     string
+			method   string
+			url      string
+			bearer   string
+			httpcode int
+			resp     string
+		}{
+			{"Anonymous", "POST", "/member/2/export", "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+			{"Other", "POST", "/member/2/export", other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+			{"NotExisted", "POST", "/member/24601/export", admin.Token, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+			{"OtherByGet", "GET", "/member/2/export", other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		} {
+			w := do(testcase.method, testcase.url, testcase.bearer)
+			if w.Code != testcase.httpcode || w.Body.String() != testcase.resp {
+				t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+			}
+		}
+		checkArchive("Self", do("GET", "/member/2/export", self.Token))
+		checkArchive("Manager", do("GET", "/member/2/export", admin.Token))
+		checkArchive("Post", do("POST", "/member/2/export", self.Token))
+		if len(memoryStore.exports) != 0 {
+			t.Errorf("Expect small accounts exported without background exports, but get %v", memoryStore.exports)
+		}
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		syncLimit := config.Config.Export.SyncLimit
+		config.Config.Export.SyncLimit = 1
+		defer func() { config.Config.Export.SyncLimit = syncLimit }()
+
+		var resp struct {
+			Items []MemberExport `json:"_items"`
+		}
+		w := do("GET", "/member/2/export", self.Token)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusAccepted || len(resp.Items) != 1 || w.Header().Get("Location") != fmt.Sprintf("/member/2/export/%d", resp.Items[0].ID) {
+			t.Fatalf("Expect export accepted but get %d %s %v", w.Code, w.Body.String(), w.Header())
+		}
+		location := w.Header().Get("Location")
+
+		for i := 0; i < 100 && resp.Items[0].Status != exportStatusReady; i++ {
+			time.Sleep(10 * time.Millisecond)
+			json.Unmarshal(do("GET", location, self.Token).Body.Bytes(), &resp)
+		}
+		if resp.Items[0].Status != exportStatusReady || resp.Items[0].Size == 0 || !resp.Items[0].ExpiresAt.Valid {
+			t.Fatalf("Expect export ready but get %v", resp.Items[0])
+		}
+		if w = do("GET", "/member/2/export", self.Token); w.Code != http.StatusOK || w.Header().Get("Location") != location {
+			t.Errorf("Expect ready export reused but get %d %s", w.Code, w.Header().Get("Location"))
+		}
+		if w = do("POST", "/member/2/export", self.Token); w.Code != http.StatusOK || w.Header().Get("Location") != location {
+			t.Errorf("Expect ready export reused by POST but get %d %s", w.Code, w.Header().Get("Location"))
+		}
+		checkArchive("Download", do("GET", location+"/download", self.Token))
+		checkArchive("DownloadByManager", do("GET", location+"/download", admin.Token))
+
+		// Member 3 is large enough to be exported in background, and is building one
+		for i := 0; i < 2; i++ {
+			memoryStore.keepAudit(newAudit(3, AuditMeta{}, auditActionUpdate, Member{}, memoryStore.members[2], []string{"member_id"}))
+		}
+		memoryStore.exports = append(memoryStore.exports, MemberExport{ID: 24601, MemberID: 3, Status: exportStatusPending, CreatedAt: rrsql.NullTime{Time: time.Now(), Valid: true}})
+		for _, testcase := range []struct {
+			name     string
+			method   string
+			url      string
+			bearer   string
+			httpcode int
+			resp     string
+		}{
+			{"GetByOther", "GET", location, other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+			{"DownloadByOther", "GET", location + "/download", other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+			{"GetOfOther", "GET", "/member/3/export/" + strconv.FormatInt(resp.Items[0].ID, 10), other.Token, http.StatusNotFound, errorBody("export_not_found", "Export Not Found")},
+			{"GetNotExisted", "GET", "/member/2/export/24601", self.Token, http.StatusNotFound, errorBody("export_not_found", "Export Not Found")},
+			{"GetInvalid", "GET", "/member/2/export/latest", self.Token, http.StatusNotFound, errorBody("export_not_found", "Export Not Found")},
+			{"GetPending", "GET", "/member/3/export/24601", other.Token, http.StatusOK, `"status":"pending"`},
+			{"Pending", "GET", "/member/3/export", other.Token, http.StatusAccepted, `"id":24601,`},
+			{"ByOther", "GET", "/member/2/export", other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+			{"DownloadPending", "GET", "/member/3/export/24601/download", other.Token, http.StatusConflict, errorBody("export_not_ready", "Export Not Ready")},
+		} {
+			w := do(testcase.method, testcase.url, testcase.bearer)
+			if w.Code != testcase.httpcode || !strings.Contains(w.Body.String(), testcase.resp) {
+				t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+			}
+		}
+
+		for i := range memoryStore.exports {
+			if memoryStore.exports[i].MemberID == 2 {
+				memoryStore.exports[i].ExpiresAt.Time = time.Now().Add(-time.Second)
+			}
+		}
+		if w = do("GET", location+"/download", self.Token); w.Code != http.StatusGone || w.Body.String() != errorBody("export_expired", "Export Expired") {
+			t.Errorf("Expect expired export gone but get %d %s", w.Code, w.Body.String())
+		}
+		if w = do("GET", "/member/2/export", self.Token); w.Code != http.StatusAccepted || w.Header().Get("Location") == location {
+			t.Errorf("Expect new export for expired one but get %d %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Workers", func(t *testing.T) {
+		syncLimit, workers := config.Config.Export.SyncLimit, config.Config.Export.Workers
+		config.Config.Export.SyncLimit = 1
+		defer func() {
+			config.Config.Export.SyncLimit, config.Config.Export.Workers = syncLimit, workers
+			exportBuilds.stopped = false
+		}()
+		// Wait for the export requested above before resetting exports
+		exportBuilds.done.Wait()
+		memoryStore.exports = []MemberExport{}
+
+		config.Config.Export.Workers = 0
+		if w := do("POST", "/member/2/export", self.Token); w.Code != http.StatusTooManyRequests || w.Body.String() != errorBody("too_many_exports", "Too Many Exports") {
+			t.Errorf("Expect export refused without workers but get %d %s", w.Code, w.Body.String())
+		}
+		if len(memoryStore.exports) != 0 {
+			t.Errorf("Expect no export kept for refused requests, but get %v", memoryStore.exports)
+		}
+
+		config.Config.Export.Workers = workers
+		if err := StopExports(context.Background()); err != nil {
+			t.Fatalf("Expect exports stopped but get %v", err)
+		}
+		if exportBuilds.running != 0 {
+			t.Errorf("Expect no export building after stopped, but get %d", exportBuilds.running)
+		}
+		if w := do("POST", "/member/2/export", self.Token); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expect export refused after stopped but get %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestRouteMemberAnonymize(t *testing.T) {
+
+	personal := func(id int64, memberID string, uuid string) Member {
+		return Member{ID: id, MemberID: memberID, UUID: uuid,
+			Name: rrsql.NullString{String: "Major Tom", Valid: true}, Nickname: rrsql.NullString{String: "spaceoddity", Valid: true},
+			Mail: rrsql.NullString{String: memberID, Valid: true}, Phone: rrsql.NullString{String: "0912345678", Valid: true},
+			Birthday: rrsql.NullTime{Time: time.Date(1947, 1, 8, 0, 0, 0, 0, time.UTC), Valid: true},
+			SocialID: rrsql.NullString{String: "fb-" + uuid, Valid: true}, TalkID: rrsql.NullString{String: "groundcontrol", Valid: true},
+			ProfileImage: rrsql.NullString{String: "https://www.readr.tw/tom.jpg", Valid: true}, Description: rrsql.NullString{String: "Floating in a tin can", Valid: true},
+			Password: rrsql.NullString{String: "hashed", Valid: true}, Salt: rrsql.NullString{String: "salted", Valid: true},
+			TwoFactorEnabled: rrsql.NullBool{Bool: true, Valid: true}, Points: rrsql.NullInt{Int: 42, Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}}
+	}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		personal(2, "majortom@mirrormedia.mg", "3d6ea9a4-7b5b-4d5d-9c1e-2f4c1d8e8a01"),
+		personal(3, "Barney.Corwin@hotmail.com", "5f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0"),
+		personal(4, "test6743@test.test", ""),
+	}
+	memoryStore.members[3].Active = rrsql.NullInt{Int: -1, Valid: true}
+	memoryStore.members[3].DeletedAt = rrsql.NullTime{Time: time.Now().AddDate(0, 0, -60), Valid: true}
+	memoryStore.members[3].PrevActive = rrsql.NullInt{Int: 1, Valid: true}
+	memoryStore.identities = []MemberIdentity{MemberIdentity{ID: 1, MemberID: 2, Provider: "oauth-fb", Subject: "fb-2"}}
+	memoryStore.tokens = []MemberToken{MemberToken{ID: 1, MemberID: 2, Purpose: "refresh", TokenHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}}
+	memoryStore.exports = []MemberExport{MemberExport{ID: 1, MemberID: 2, Status: exportStatusReady}}
+	memoryStore.audits = []MemberAudit{}
+	memoryStore.keepAudit(newAudit(2, AuditMeta{}, auditActionCreate, Member{}, memoryStore.members[1], []string{"member_id", "mail", "name", "points"}))
+	uuids := map[int64]string{}
+	for _, m := range memoryStore.members {
+		uuids[m.ID] = m.UUID
+	}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	self, _ := issueTokens(context.Background(), memoryStore.members[1])
+	other, _ := issueTokens(context.Background(), memoryStore.members[2])
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	do := func(method, url, body, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	checkAnonymized := func(name string, id int64, tombstone string) {
+		for _, m := range memoryStore.members {
+			if m.ID != id {
+				continue
+			}
+			if m.MemberID != tombstone || m.UUID != uuids[id] || !m.AnonymizedAt.Valid || m.Active.Int != -1 || m.DeletedAt.Valid ||
+				m.Name.Valid || m.Nickname.Valid || m.Mail.Valid || m.Phone.Valid || m.Birthday.Valid || m.SocialID.Valid || m.TalkID.Valid ||
+				m.ProfileImage.Valid || m.Description.Valid || m.Password.Valid || m.Salt.Valid || m.TwoFactorEnabled.Bool || m.Points.Int != 42 {
+				t.Errorf("%s expect member %d anonymized, but get %+v", name, id, m)
+			}
+			return
+		}
+		t.Errorf("%s expect member %d kept", name, id)
+	}
+
+	for _, testcase := range []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		bearer   string
+		httpcode int
+		resp     string
+	}{
+		{"Anonymous", "POST", "/member/2/anonymize", ``, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"Other", "POST", "/member/2/anonymize", ``, other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"NotExisted", "POST", "/member/24601/anonymize", ``, admin.Token, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		{"Self", "POST", "/member/2/anonymize", ``, self.Token, http.StatusOK, ``},
+		{"Again", "POST", "/member/2/anonymize", ``, admin.Token, http.StatusOK, ``},
+		{"Restore", "POST", "/member/2/restore", ``, admin.Token, http.StatusConflict, errorBody("user_anonymized", "User Anonymized")},
+		{"Activate", "PUT", "/members", `{"ids":[2]}`, admin.Token, http.StatusOK, ``},
+		{"BulkByMember", "POST", "/members/anonymize", `{"ids":[3,4]}`, other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"BulkEmpty", "POST", "/members/anonymize", `{"ids":[]}`, admin.Token, http.StatusBadRequest, errorBody("id_list_empty", "ID List Empty")},
+		{"BulkInvalid", "POST", "/members/anonymize", `{"ids":"3"}`, admin.Token, http.StatusBadRequest, errorBody("invalid_request_body", "Invalid Request Body")},
+		{"BulkNotExisted", "POST", "/members/anonymize", `{"ids":[24601]}`, admin.Token, http.StatusNotFound, errorBody("members_not_found", "Members Not Found")},
+		{"Bulk", "POST", "/members/anonymize", `{"ids":[3,4]}`, admin.Token, http.StatusOK, ``},
+		{"Purge", "GET", "/members/purge", ``, admin.Token, http.StatusOK, `{"_items":[],"dry_run":true}`},
+	} {
+		w := do(testcase.method, testcase.url, testcase.body, testcase.bearer)
+		if w.Code != testcase.httpcode || w.Body.String() != testcase.resp {
+			t.Errorf("%s want %d %s but get %d %s", testcase.name, testcase.httpcode, testcase.resp, w.Code, w.Body.String())
+		}
+	}
+
+	checkAnonymized("Self", 2, "anonymized-3d6ea9a4-7b5b-4d5d-9c1e-2f4c1d8e8a01")
+	checkAnonymized("Bulk", 3, "anonymized-5f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0")
+	checkAnonymized("BulkDeleted", 4, "anonymized-4")
+	for _, token := range memoryStore.tokens {
+		if token.MemberID != 1 {
+			t.Errorf("Expect tokens of anonymized members erased, but get %v", token)
+		}
+	}
+	if len(memoryStore.identities) != 0 || len(memoryStore.exports) != 0 {
+		t.Errorf("Expect identities and exports erased, but get %v %v", memoryStore.identities, memoryStore.exports)
+	}
+
+	w := do("GET", "/member/2/history", ``, admin.Token)
+	for _, pii := range []string{"Major Tom", "majortom@mirrormedia.mg", "0912345678", "groundcontrol", "tin can", "hashed"} {
+		if strings.Contains(w.Body.String(), pii) {
+			t.Errorf("Expect %s redacted from history, but get %s", pii, w.Body.String())
+		}
+	}
+	var history struct {
+		Items []MemberAudit `json:"_items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history.Items) != 2 || history.Items[0].Action != auditActionAnonymize || history.Items[0].ActorID.Int != 2 ||
+		history.Items[0].Changes["mail"].Before != redacted || history.Items[1].Changes["points"].After != float64(42) {
+		t.Errorf("Expect anonymize recorded once in history, but get %s", w.Body.String())
+	}
+}
+
+func TestRouteMemberFilter(t *testing.T) {
+
+	at := func(date string) rrsql.NullTime {
+		t, _ := time.Parse("2006-01-02", date)
+		return rrsql.NullTime{Time: t, Valid: true}
+	}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Nickname: rrsql.NullString{String: "superman", Valid: true}, Mail: rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
+			Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}, CreatedAt: at("2017-06-01"), UpdatedAt: at("2018-03-01")},
+		Member{ID: 2, MemberID: "test6743@test.test", Nickname: rrsql.NullString{String: "yeahman", Valid: true}, Mail: rrsql.NullString{String: "test6743@test.test", Valid: true},
+			Phone: rrsql.NullString{String: "0912345678", Valid: true}, Password: rrsql.NullString{String: "hashed", Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}, CreatedAt: at("2018-01-01"), UpdatedAt: at("2018-05-01")},
+		Member{ID: 12, MemberID: "Barney.Corwin@hotmail.com", Nickname: rrsql.NullString{String: "barney", Valid: true}, Mail: rrsql.NullString{String: "Barney.Corwin@hotmail.com", Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 0, Valid: true}, CreatedAt: at("2018-02-01"), UpdatedAt: at("2018-02-01")},
+	}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	member, _ := issueTokens(context.Background(), memoryStore.members[1])
+
+	tc.Header.Set("Authorization", "Bearer "+admin.Token)
+	defer tc.Header.Del("Authorization")
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"Default", "GET", `/members/filter`, ``, http.StatusOK, `{"_items":[{"id":2,"member_id":"test6743@test.test","uuid":"","nickname":"yeahman","mail":"test6743@test.test","phone":"0912345678","created_at":"2018-01-01T00:00:00Z","updated_at":"2018-05-01T00:00:00Z","role":1,"active":1},{"id":1,"member_id":"superman@mirrormedia.mg","uuid":"","nickname":"superman","mail":"superman@mirrormedia.mg","created_at":"2017-06-01T00:00:00Z","updated_at":"2018-03-01T00:00:00Z","two_factor_enabled":true,"role":9,"active":1},{"id":12,"member_id":"Barney.Corwin@hotmail.com","uuid":"","nickname":"barney","mail":"Barney.Corwin@hotmail.com","created_at":"2018-02-01T00:00:00Z","updated_at":"2018-02-01T00:00:00Z","role":1,"active":0}]}`},
+		tc.GenericTestcase{"Fields", "GET", `/members/filter?fields=["id","nickname"]&sort=id`, ``, http.StatusOK, `{"_items":[{"id":1,"nickname":"superman"},{"id":2,"nickname":"yeahman"},{"id":12,"nickname":"barney"}]}`},
+		tc.GenericTestcase{"ByID", "GET", `/members/filter?id=2&fields=["id"]`, ``, http.StatusOK, `{"_items":[{"id":2},{"id":12}]}`},
+		tc.GenericTestcase{"ByMail", "GET", `/members/filter?mail=hotmail&fields=["id","mail"]`, ``, http.StatusOK, `{"_items":[{"id":12,"mail":"Barney.Corwin@hotmail.com"}]}`},
+		tc.GenericTestcase{"ByNickname", "GET", `/members/filter?nickname=man&fields=["nickname"]&sort=nickname`, ``, http.StatusOK, `{"_items":[{"nickname":"superman"},{"nickname":"yeahman"}]}`},
+		tc.GenericTestcase{"CreatedAt", "GET", `/members/filter?created_at={"$gt":"2018-01-01T00:00:00Z"}&fields=["id"]&sort=id`, ``, http.StatusOK, `{"_items":[{"id":2},{"id":12}]}`},
+		tc.GenericTestcase{"UpdatedAt", "GET", `/members/filter?updated_at={"$gt":"2018-01-01T00:00:00Z","$lt":"2018-04-01T00:00:00Z"}&fields=["id"]&sort=id`, ``, http.StatusOK, `{"_items":[{"id":1},{"id":12}]}`},
+		tc.GenericTestcase{"Paging", "GET", `/members/filter?fields=["id"]&sort=id&max_result=2&page=2&total=true`, ``, http.StatusOK, fmt.Sprintf(`{"_items":[{"id":12}],"_meta":{"total":3,"prev_cursor":"%s"}}`, rrsql.Cursor{Sort: "id", Values: []interface{}{12}, Backward: true}.Encode())},
+		tc.GenericTestcase{"Total", "GET", `/members/filter?nickname=man&fields=["id"]&sort=id&total=true`, ``, http.StatusOK, `{"_items":[{"id":1},{"id":2}],"_meta":{"total":2}}`},
+		tc.GenericTestcase{"NotFound", "GET", `/members/filter?mail=yahoo&total=true`, ``, http.StatusOK, `{"_items":[],"_meta":{"total":0}}`},
+		tc.GenericTestcase{"Filter", "GET", `/members/filter?filter={"role":{"$eq":1},"created_at":{"$lt":"2018-01-15T00:00:00Z"}}&fields=["id"]&total=true`, ``, http.StatusOK, `{"_items":[{"id":2}],"_meta":{"total":1}}`},
+		tc.GenericTestcase{"InvalidFilter", "GET", `/members/filter?filter={"mail":{"$like":"%25hotmail%25"}}`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid filter: mail")},
+		tc.GenericTestcase{"MultipleSort", "GET", `/members/filter?fields=["id"]&sort=role,-updated_at`, ``, http.StatusOK, `{"_items":[{"id":2},{"id":12},{"id":1}]}`},
+		tc.GenericTestcase{"UnknownSort", "GET", `/members/filter?sort=-nickname,shoe_size`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid sort: shoe_size")},
+		tc.GenericTestcase{"HiddenField", "GET", `/members/filter?fields=["id","password"]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"password"})},
+		tc.GenericTestcase{"UnknownField", "GET", `/members/filter?fields=["id","shoe_size"]`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields", []string{"shoe_size"})},
+		tc.GenericTestcase{"InvalidFields", "GET", `/members/filter?fields=id`, ``, http.StatusBadRequest, errorBody("invalid_fields", "Invalid fields")},
+		tc.GenericTestcase{"InvalidCreatedAt", "GET", `/members/filter?created_at=yesterday`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid created_at")},
+		tc.GenericTestcase{"InvalidPage", "GET", `/members/filter?page=0`, ``, http.StatusBadRequest, errorBody("invalid_page", "Invalid Page")},
+		tc.GenericTestcase{"InvalidMaxResult", "GET", `/members/filter?max_result=ten`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid Query")},
+	} {
+		tc.GenericDoTest(testcase, t, false)
+	}
+
+	tc.Header.Set("Authorization", "Bearer "+member.Token)
+	tc.GenericDoTest(tc.GenericTestcase{"Member", "GET", `/members/filter`, ``, http.StatusForbidden, errorBody("forbidden", "Forbidden")}, t, false)
+}
+
+func TestRouteMemberCursor(t *testing.T) {
+
+	at := func(date string) rrsql.NullTime {
+		t, _ := time.Parse("2006-01-02", date)
+		return rrsql.NullTime{Time: t, Valid: true}
+	}
+	nickname := func(n string) rrsql.NullString { return rrsql.NullString{String: n, Valid: true} }
+	active, role := rrsql.NullInt{Int: 1, Valid: true}, rrsql.NullInt{Int: 1, Valid: true}
+	// Sorted by -updated_at, with id as tiebreaker and NULL last: 2, 3, 1, 5, 4
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Nickname: nickname("superman"), Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: active, UpdatedAt: at("2018-03-01")},
+		Member{ID: 2, MemberID: "test6743@test.test", Nickname: nickname("yeahman"), Role: role, Active: active, UpdatedAt: at("2018-05-01")},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Nickname: nickname("barney"), Role: role, Active: active, UpdatedAt: at("2018-03-01")},
+		Member{ID: 4, MemberID: "Lulu_Brakus@yahoo.com", Nickname: nickname("lulu"), Role: role, Active: active},
+		Member{ID: 5, MemberID: "spaceoddity", Nickname: nickname("majortom"), Role: role, Active: active, UpdatedAt: at("2018-01-01")},
+	}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	type page struct {
+		Items []Stunt `json:"_items"`
+		Meta  struct {
+			NextCursor string `json:"next_cursor"`
+			PrevCursor string `json:"prev_cursor"`
+		} `json:"_meta"`
+	}
+	get := func(url string) (p page) {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Authorization", "Bearer "+admin.Token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expect %s to be ok, but get %d %s", url, w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return p
+	}
+	ids := func(p page) (result []int64) {
+		for _, s := range p.Items {
+			if s.ID != nil {
+				result = append(result, *s.ID)
+			}
+		}
+		return result
+	}
+	walk := func(t *testing.T, url string) {
+		var p page
+		for _, step := range []struct {
+			cursor  func(p page) string
+			ids     []int64
+			hasNext bool
+			hasPrev bool
+		}{
+			{nil, []int64{2, 3}, true, false},
+			{func(p page) string { return p.Meta.NextCursor }, []int64{1, 5}, true, true},
+			{func(p page) string { return p.Meta.NextCursor }, []int64{4}, false, true},
+			{func(p page) string { return p.Meta.PrevCursor }, []int64{1, 5}, true, true},
+			{func(p page) string { return p.Meta.PrevCursor }, []int64{2, 3}, true, true},
+			{func(p page) string { return p.Meta.PrevCursor }, nil, false, false},
+		} {
+			next := url
+			if step.cursor != nil {
+				next = url + "&cursor=" + step.cursor(p)
+			}
+			p = get(next)
+			if !reflect.DeepEqual(ids(p), step.ids) || (p.Meta.NextCursor != "") != step.hasNext || (p.Meta.PrevCursor != "") != step.hasPrev {
+				t.Fatalf("Expect %v from %s with next %v and prev %v, but get %v %+v", step.ids, next, step.hasNext, step.hasPrev, ids(p), p.Meta)
+			}
+		}
+	}
+	var p page
+
+	t.Run("Members", func(t *testing.T) {
+		walk(t, `/members?filter={"role":{"$gte":0}}&max_result=2`)
+	})
+	t.Run("Filter", func(t *testing.T) {
+		walk(t, `/members/filter?fields=["id","nickname"]&max_result=2`)
+	})
+	t.Run("FieldsNotSorted", func(t *testing.T) {
+		p = get(`/members/filter?fields=["nickname"]&max_result=2`)
+		p = get(`/members/filter?fields=["nickname"]&max_result=2&cursor=` + p.Meta.NextCursor)
+		b, _ := json.Marshal(p.Items)
+		if string(b) != `[{"nickname":"superman"},{"nickname":"majortom"}]` {
+			t.Errorf("Expect only nickname of the second page, but get %s", b)
+		}
+	})
+	t.Run("FromPage", func(t *testing.T) {
+		p = get(`/members/filter?fields=["id"]&max_result=2&page=2`)
+		if p = get(`/members/filter?fields=["id"]&max_result=2&cursor=` + p.Meta.PrevCursor); !reflect.DeepEqual(ids(p), []int64{2, 3}) {
+			t.Errorf("Expect the first page before the second one, but get %v", ids(p))
+		}
+	})
+
+	tc.Header.Set("Authorization", "Bearer "+admin.Token)
+	defer tc.Header.Del("Authorization")
+	otherSort := rrsql.Cursor{Sort: "-updated_at", Values: []interface{}{"2018-03-01T00:00:00Z", 1}}.Encode()
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"InvalidCursor", "GET", `/members?cursor=garbage`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid cursor")},
+		tc.GenericTestcase{"CursorOfOtherSort", "GET", `/members?sort=id&cursor=` + otherSort, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid cursor")},
+		tc.GenericTestcase{"FilterInvalidCursor", "GET", `/members/filter?cursor=garbage`, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid cursor")},
+		tc.GenericTestcase{"FilterCursorOfOtherSort", "GET", `/members/filter?sort=nickname&cursor=` + otherSort, ``, http.StatusBadRequest, errorBody("invalid_query", "Invalid cursor")},
+	} {
+		tc.GenericDoTest(testcase, t, false)
+	}
+}
+
+func TestRouteMemberProfile(t *testing.T) {
+
+	created := rrsql.NullTime{Time: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	str := func(s string) rrsql.NullString { return rrsql.NullString{String: s, Valid: true} }
+	state := func(name string) rrsql.NullInt {
+		return rrsql.NullInt{Int: int64(config.Config.Models.Members[name]), Valid: true}
+	}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", UUID: "3d64e480-3e30-11e8-b94b-cfe922eb374f", Nickname: str("readr"),
+			Mail: str("superman@mirrormedia.mg"), Phone: str("0912345678"), Birthday: created, SocialID: str("1234567890"), Points: rrsql.NullInt{Int: 100, Valid: true},
+			ProfileImage: str("https://www.readr.tw/readr.png"), Description: str("Hello"), Role: rrsql.NullInt{Int: 1, Valid: true},
+			Active: state("active"), CreatedAt: created, HideProfile: rrsql.NullBool{Bool: false, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", UUID: "3d651126-3e30-11e8-b94b-cfe922eb374f", Nickname: str("ghost"),
+			Mail: str("test6743@test.test"), Description: str("Nobody knows"), Role: rrsql.NullInt{Int: 1, Valid: true},
+			Active: state("active"), CreatedAt: created, HideProfile: rrsql.NullBool{Bool: true, Valid: true}},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", UUID: "3d6512e8-3e30-11e8-b94b-cfe922eb374f", Nickname: str("twin"), Active: state("delete")},
+		Member{ID: 4, MemberID: "Lulu_Brakus@yahoo.com", UUID: "3d651370-3e30-11e8-b94b-cfe922eb374f", Nickname: str("sleeper"), Active: state("deactive")},
+		Member{ID: 5, MemberID: "spaceoddity", UUID: "3d6513f2-3e30-11e8-b94b-cfe922eb374f", Nickname: str("twin"), Active: state("active")},
+	}
+
+	public := `{"_items":[{"id":1,"uuid":"3d64e480-3e30-11e8-b94b-cfe922eb374f","nickname":"readr","created_at":"2018-01-01T00:00:00Z","description":"Hello","profile_image":"https://www.readr.tw/readr.png","role":1}]}`
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ByUUID", "GET", "/profile/3d64e480-3e30-11e8-b94b-cfe922eb374f", ``, http.StatusOK, public},
+		tc.GenericTestcase{"ByNickname", "GET", "/profile/@readr", ``, http.StatusOK, public},
+		tc.GenericTestcase{"Hidden", "GET", "/profile/3d651126-3e30-11e8-b94b-cfe922eb374f", ``, http.StatusOK, `{"_items":[{"uuid":"3d651126-3e30-11e8-b94b-cfe922eb374f","nickname":"ghost","hide_profile":true}]}`},
+		tc.GenericTestcase{"Deleted", "GET", "/profile/3d6512e8-3e30-11e8-b94b-cfe922eb374f", ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		tc.GenericTestcase{"Deactivated", "GET", "/profile/@sleeper", ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		tc.GenericTestcase{"NicknameOfDeleted", "GET", "/profile/@twin", ``, http.StatusOK, `{"_items":[{"id":5,"uuid":"3d6513f2-3e30-11e8-b94b-cfe922eb374f","nickname":"twin"}]}`},
+		tc.GenericTestcase{"NotExisted", "GET", "/profile/nobody", ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		tc.GenericTestcase{"EmptyNickname", "GET", "/profile/@", ``, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+	} {
+		tc.GenericDoTest(testcase, t, false)
+	}
+
+	t.Run("ETag", func(t *testing.T) {
+		r := gin.New()
+		r.Use(rt.RequestID)
+		Router.SetRoutes(r)
+		get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/profile/@readr", nil)
+			req.Header.Set(rt.RequestIDHeader, testRequestID)
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+		etag := get("").Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("Expect profile to have an ETag")
+		}
+		if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("Expect not modified without body, but get %d %s", w.Code, w.Body.String())
+		}
+		if w := get(`"stale", W/` + etag); w.Code != http.StatusNotModified {
+			t.Errorf("Expect weak ETag in a list to match, but get %d", w.Code)
+		}
+		memoryStore.members[0].Description = str("Hello again")
+		if w := get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Errorf("Expect a new ETag once profile changes, but get %d %s", w.Code, w.Header().Get("ETag"))
+		}
+	})
+}
+
+func TestRouteMemberTimeout(t *testing.T) {
+
+	memoryStore.members = []Member{mockMembers[0]}
+	MemberAPI = stalledMemberAPI{memoryStore}
+	defer func() { MemberAPI = memoryStore }()
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	r.Use(rt.Timeout(time.Hour, map[string]time.Duration{"get /members": 50 * time.Millisecond}))
+	Router.SetRoutes(r)
+	admin, _ := issueTokens(context.Background(), mockMembers[0])
+	do := func(ctx context.Context, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Authorization", "Bearer "+admin.Token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	if w := do(context.Background(), "/members"); w.Code != http.StatusGatewayTimeout || w.Body.String() != errorBody("timeout", "Gateway Timeout") {
+		t.Errorf("Expect stalled listing to time out, but get %d %s", w.Code, w.Body.String())
+	}
+	// Clients going away aren't timeouts
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := do(canceled, "/members"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expect abandoned listing to fail, but get %d %s", w.Code, w.Body.String())
+	}
+	if w := do(context.Background(), "/member/1"); w.Code != http.StatusOK {
+		t.Errorf("Expect other routes to be bounded by default timeout, but get %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRouteMemberPasswordReset(t *testing.T) {
+
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	password, passwordSalt := rrsql.NullString{String: hpw, Valid: true}, rrsql.NullString{String: salt, Valid: true}
+
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Mail: rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
+			Nickname: rrsql.NullString{String: "superman", Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 2, MemberID: "test6743@test.test", Mail: rrsql.NullString{String: "test6743@test.test", Valid: true},
+			Active: rrsql.NullInt{Int: 0, Valid: true}, Password: password, Salt: passwordSalt},
+	}
+	memoryStore.tokens = []MemberToken{}
+	mockOutbox = mail.Outbox{}
+
+	resetToken := func(receiver string) string {
+		m, ok := mockOutbox.Last(receiver)
+		if !ok {
+			return ""
+		}
+		match := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`).FindStringSubmatch(m.Payload)
+		if match == nil {
+			t.Fatalf("Expect reset link in mail, but get %s", m.Payload)
+		}
+		return match[1]
+	}
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ForgotUnknownMail", "POST", "/member/password/forgot", `{"mail":"nobody@mirrormedia.mg"}`, http.StatusOK, ``},
+		tc.GenericTestcase{"ForgotDeactivated", "POST", "/member/password/forgot", `{"mail":"test6743@test.test"}`, http.StatusOK, ``},
+		tc.GenericTestcase{"ForgotNoMail", "POST", "/member/password/forgot", `{}`, http.StatusBadRequest, errorBody("invalid_input", "Invalid Input")},
+		tc.GenericTestcase{"ForgotOK", "POST", "/member/password/forgot", `{"mail":"superman@mirrormedia.mg"}`, http.StatusOK, ``},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+	if len(mockOutbox.Mails) != 1 {
+		t.Fatalf("Expect only one mail to be sent, but get %d", len(mockOutbox.Mails))
+	}
+	staleToken := resetToken("superman@mirrormedia.mg")
+
+	// Requesting again invalidates the link sent before
+	tc.GenericDoTest(tc.GenericTestcase{"ForgotAgain", "POST", "/member/password/forgot", `{"mail":"superman@mirrormedia.mg"}`, http.StatusOK, ``}, t, nil)
+	validToken := resetToken("superman@mirrormedia.mg")
+
+	expiredToken, expiredHash, _ := token.GenOpaqueToken()
+	memoryStore.tokens = append(memoryStore.tokens, MemberToken{ID: 99, MemberID: 1, Purpose: tokenPurposePasswordReset, TokenHash: expiredHash, ExpiresAt: time.Now().Add(-time.Minute)})
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ResetMissingToken", "POST", "/member/password/reset", `{"password":"happypug42"}`, http.StatusBadRequest, errorBody("invalid_input", "Invalid Input")},
+		tc.GenericTestcase{"ResetUnknownToken", "POST", "/member/password/reset", `{"token":"thisisnotatoken","password":"happypug42"}`, http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		tc.GenericTestcase{"ResetStaleToken", "POST", "/member/password/reset", fmt.Sprintf(`{"token":"%s","password":"happypug42"}`, staleToken), http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		tc.GenericTestcase{"ResetExpiredToken", "POST", "/member/password/reset", fmt.Sprintf(`{"token":"%s","password":"happypug42"}`, expiredToken), http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		tc.GenericTestcase{"ResetPolicyViolation", "POST", "/member/password/reset", fmt.Sprintf(`{"token":"%s","password":"superman"}`, validToken), http.StatusUnprocessableEntity, nil},
+		tc.GenericTestcase{"ResetOK", "POST", "/member/password/reset", fmt.Sprintf(`{"token":"%s","password":"happypug42"}`, validToken), http.StatusOK, ``},
+		tc.GenericTestcase{"ResetReused", "POST", "/member/password/reset", fmt.Sprintf(`{"token":"%s","password":"angrypug42"}`, validToken), http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		tc.GenericTestcase{"LoginOldPassword", "POST", "/member/login", `{"id":"1","password":"angrypug"}`, http.StatusUnauthorized, errorBody("wrong_password", "Wrong Password")},
+		tc.GenericTestcase{"LoginNewPassword", "POST", "/member/login", `{"id":"1","password":"happypug42"}`, http.StatusOK, nil},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+}
+
+func TestRouteMemberVerification(t *testing.T) {
+
+	config.Config.Mail.RequireVerification = true
+	defer func() { config.Config.Mail.RequireVerification = false }()
+
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Mail: rrsql.NullString{String: "superman@mirrormedia.mg", Valid: true},
+			Active: rrsql.NullInt{Int: 2, Valid: true}, Password: rrsql.NullString{String: hpw, Valid: true}, Salt: rrsql.NullString{String: salt, Valid: true}},
+	}
+	memoryStore.tokens = []MemberToken{}
+	mockOutbox = mail.Outbox{}
+
+	verifyToken := func(receiver string) string {
+		m, ok := mockOutbox.Last(receiver)
+		if !ok {
+			t.Fatalf("Expect verification mail sent to %s", receiver)
+		}
+		match := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`).FindStringSubmatch(m.Payload)
+		if match == nil {
+			t.Fatalf("Expect verification link in mail, but get %s", m.Payload)
+		}
+		return match[1]
+	}
+	state := func(id string) int64 {
+		member, _ := MemberAPI.GetMember(context.Background(), GetMemberArgs{ID: id, IDType: "id"})
+		return member.Active.Int
+	}
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"LoginPending", "POST", "/member/login", `{"id":"1","password":"angrypug"}`, http.StatusForbidden, errorBody("user_not_verified", "User Not Verified")},
+		tc.GenericTestcase{"RegisterOrdinaryActive", "POST", "/member", `{"mail":"spaceoddity@mirrormedia.mg", "register_mode":"ordinary", "active":1}`, http.StatusForbidden, errorBody("forbidden_fields", "Forbidden Fields", []string{"active"})},
+		tc.GenericTestcase{"RegisterOrdinary", "POST", "/member", `{"mail":"spaceoddity@mirrormedia.mg", "register_mode":"ordinary"}`, http.StatusOK, `{"_items":{"last_id":2}}`},
+		tc.GenericTestcase{"RegisterOrdinaryNoMail", "POST", "/member", `{"member_id":"spaceoddity", "register_mode":"ordinary"}`, http.StatusBadRequest, errorBody("invalid_user", "Invalid User")},
+		tc.GenericTestcase{"RegisterSocial", "POST", "/member", `{"mail":"majortom@mirrormedia.mg", "register_mode":"oauth-fb", "social_id":"1234567890"}`, http.StatusOK, `{"_items":{"last_id":3}}`},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+	if state("2") != 2 || state("3") != 1 {
+		t.Fatalf("Expect ordinary registration to be pending and social one active, but get %d and %d", state("2"), state("3"))
+	}
+	if _, ok := mockOutbox.Last("majortom@mirrormedia.mg"); ok {
+		t.Errorf("Expect no verification mail for social registration")
+	}
+	staleToken := verifyToken("spaceoddity@mirrormedia.mg")
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ResendUnknown", "POST", "/member/verify/resend", `{"mail":"nobody@mirrormedia.mg"}`, http.StatusOK, ``},
+		tc.GenericTestcase{"ResendActive", "POST", "/member/verify/resend", `{"mail":"majortom@mirrormedia.mg"}`, http.StatusOK, ``},
+		tc.GenericTestcase{"ResendOK", "POST", "/member/verify/resend", `{"mail":"spaceoddity@mirrormedia.mg"}`, http.StatusOK, ``},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+	if _, ok := mockOutbox.Last("majortom@mirrormedia.mg"); ok {
+		t.Errorf("Expect no verification mail for active member")
+	}
+	validToken := verifyToken("spaceoddity@mirrormedia.mg")
+
+	expiredToken, expiredHash, _ := token.GenOpaqueToken()
+	memoryStore.tokens = append(memoryStore.tokens, MemberToken{ID: 99, MemberID: 1, Purpose: tokenPurposeVerifyMail, TokenHash: expiredHash, ExpiresAt: time.Now().Add(-time.Minute)})
+
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"VerifyNoToken", "POST", "/member/verify", `{}`, http.StatusBadRequest, errorBody("invalid_input", "Invalid Input")},
+		tc.GenericTestcase{"VerifyStaleToken", "POST", "/member/verify", fmt.Sprintf(`{"token":"%s"}`, staleToken), http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+		tc.GenericTestcase{"VerifyExpiredToken", "POST", "/member/verify", fmt.Sprintf(`{"token":"%s"}`, expiredToken), http.StatusUnauthorized, errorBody("token_expired", "Token Expired")},
+		tc.GenericTestcase{"VerifyOK", "POST", "/member/verify", fmt.Sprintf(`{"token":"%s"}`, validToken), http.StatusOK, nil},
+		tc.GenericTestcase{"VerifyReused", "POST", "/member/verify", fmt.Sprintf(`{"token":"%s"}`, validToken), http.StatusUnauthorized, errorBody("invalid_token", "Invalid Token")},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+	if state("2") != 1 {
+		t.Errorf("Expect verified member to be active, but get %d", state("2"))
+	}
+	if state("1") != 2 {
+		t.Errorf("Expect expired token not to activate member, but get %d", state("1"))
+	}
+
+	// Members pending verification are left out of listings unless asked for
+	admin := Member{ID: 9, MemberID: "admin", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}}
+	memoryStore.members = append(memoryStore.members, admin)
+	manager, _ := issueTokens(context.Background(), admin)
+	tc.Header.Set("Authorization", "Bearer "+manager.Token)
+	defer tc.Header.Del("Authorization")
+	for _, testcase := range []tc.GenericTestcase{
+		tc.GenericTestcase{"ListWithoutPending", "GET", `/members?fields=["id"]&sort=id`, ``, http.StatusOK, `{"_items":[{"id":2},{"id":3},{"id":9}]}`},
+		tc.GenericTestcase{"CountWithoutPending", "GET", "/members/count", ``, http.StatusOK, `{"_meta":{"total":3}}`},
+		tc.GenericTestcase{"ListPending", "GET", `/members?fields=["id"]&active={"$in":[2]}`, ``, http.StatusOK, `{"_items":[{"id":1}]}`},
+	} {
+		tc.GenericDoTest(testcase, t, nil)
+	}
+
+	t.Run("ChangeMail", func(t *testing.T) {
+		r := gin.New()
+		r.Use(rt.RequestID)
+		Router.SetRoutes(r)
+		// Registrations come without role, grant member 3 the ordinary one
+		memoryStore.members[2].Role = rrsql.NullInt{Int: 1, Valid: true}
+		self, _ := issueTokens(context.Background(), memoryStore.members[2])
+		put := func(body string, bearer string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("PUT", "/member", strings.NewReader(body))
+			req.Header.Set(rt.RequestIDHeader, testRequestID)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+bearer)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		if w := put(`{"id":3, "mail":"SpaceOddity@mirrormedia.mg"}`, self.Token); w.Code != http.StatusConflict || w.Body.String() != errorBody("mail_taken", "Mail Taken") {
+			t.Errorf("Expect mail of others to be refused, but get %d %s", w.Code, w.Body.String())
+		}
+		if w := put(`{"id":3, "mail":"ziggy@mirrormedia.mg"}`, self.Token); w.Code != http.StatusOK {
+			t.Fatalf("Expect mail to be changed, but get %d %s", w.Code, w.Body.String())
+		}
+		if state("3") != 2 {
+			t.Errorf("Expect member to be pending after changing mail, but get %d", state("3"))
+		}
+		if w := put(`{"id":3, "nickname":"ziggy"}`, self.Token); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expect pending member to be refused, but get %d", w.Code)
+		}
+		tc.GenericDoTest(tc.GenericTestcase{"VerifyChangedMail", "POST", "/member/verify", fmt.Sprintf(`{"token":"%s"}`, verifyToken("ziggy@mirrormedia.mg")), http.StatusOK, nil}, t, nil)
+		if state("3") != 1 {
+			t.Errorf("Expect member to be active after verifying changed mail, but get %d", state("3"))
+		}
+
+		if w := put(`{"id":2, "mail":"starman@mirrormedia.mg"}`, manager.Token); w.Code != http.StatusOK || state("2") != 1 {
+			t.Errorf("Expect managers to change mail without verification, but get %d %d", w.Code, state("2"))
+		}
+		if _, ok := mockOutbox.Last("starman@mirrormedia.mg"); ok {
+			t.Errorf("Expect no verification mail for mail changed by managers")
+		}
+	})
+}
+
+func TestRouteMemberLockout(t *testing.T) {
+
+	lockout.DefaultStore = lockout.NewMemoryStore()
+	memberThreshold, ipThreshold := config.Config.Lockout.MemberThreshold, config.Config.Lockout.IPThreshold
+	config.Config.Lockout.MemberThreshold, config.Config.Lockout.IPThreshold = 3, 6
+	defer func() {
+		config.Config.Lockout.MemberThreshold, config.Config.Lockout.IPThreshold = memberThreshold, ipThreshold
+		lockout.DefaultStore = lockout.NewMemoryStore()
+	}()
+
+	salt, _ := utils.CryptGenSalt()
+	hpw, _ := utils.CryptGenHash("angrypug", salt)
+	password, passwordSalt := rrsql.NullString{String: hpw, Valid: true}, rrsql.NullString{String: salt, Valid: true}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn,
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 2, MemberID: "test6743@test.test", Role: rrsql.NullInt{Int: 1, Valid: true},
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+		Member{ID: 3, MemberID: "Barney.Corwin@hotmail.com", Role: rrsql.NullInt{Int: 1, Valid: true},
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password, Salt: passwordSalt},
+	}
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+
+	do := func(method, url, body, bearer, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":12345"
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	login := func(id, password, ip string) *httptest.ResponseRecorder {
+		return do("POST", "/member/login", fmt.Sprintf(`{"id":"%s","password":"%s"}`, id, password), "", ip)
+	}
+	var member TokenPair
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	json.Unmarshal(login("3", "angrypug", "192.0.2.1").Body.Bytes(), &member)
+
+	t.Run("MemberLock", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			// Spread over IPs so only the member counter locks
+			if w := login("2", "happypug", fmt.Sprintf("192.0.2.%d", 10+i)); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expect attempt %d to be unauthorized, but get %d", i, w.Code)
+			}
+		}
+		w := login("2", "angrypug", "192.0.2.20")
+		if w.Code != http.StatusTooManyRequests || w.Body.String() != errorBody("too_many_attempts", "Too Many Attempts") {
+			t.Fatalf("Expect locked member to be refused even with right password, but get %d %s", w.Code, w.Body.String())
+		}
+		if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter <= 0 || retryAfter > config.Config.Lockout.BaseDelay+1 {
+			t.Errorf("Expect Retry-After within base delay, but get %q", w.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("UnknownLock", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			login("24690", "happypug", fmt.Sprintf("192.0.2.%d", 50+i))
+		}
+		w := login("24690", "angrypug", "192.0.2.60")
+		if w.Code != http.StatusTooManyRequests || w.Body.String() != errorBody("too_many_attempts", "Too Many Attempts") {
+			t.Fatalf("Expect unknown member to be locked like existing ones, but get %d %s", w.Code, w.Body.String())
+		}
+		if w := login("24691", "angrypug", "192.0.2.60"); w.Code != http.StatusNotFound {
+			t.Errorf("Expect other unknown members not to be affected, but get %d", w.Code)
+		}
+	})
+
+	t.Run("AdminLockEndpoint", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			method   string
+			url      string
+			bearer   string
+			httpcode int
+		}{
+			{"Anonymous", "GET", "/member/2/lock", "", http.StatusUnauthorized},
+			{"NotAdmin", "GET", "/member/2/lock", member.Token, http.StatusForbidden},
+			{"NotAdminDelete", "DELETE", "/member/2/lock", member.Token, http.StatusForbidden},
+			{"NotExisted", "GET", "/member/24601/lock", admin.Token, http.StatusNotFound},
+			{"Get", "GET", "/member/2/lock", admin.Token, http.StatusOK},
+		} {
+			if w := do(tc.method, tc.url, ``, tc.bearer, "192.0.2.1"); w.Code != tc.httpcode {
+				t.Errorf("%s want %d but get %d", tc.name, tc.httpcode, w.Code)
+			}
+		}
+
+		var resp struct {
+			Items struct {
+				Failures int  `json:"failures"`
+				Locked   bool `json:"locked"`
+			} `json:"_items"`
+		}
+		json.Unmarshal(do("GET", "/member/2/lock", ``, admin.Token, "192.0.2.1").Body.Bytes(), &resp)
+		if resp.Items.Failures != 3 || !resp.Items.Locked {
+			t.Errorf("Expect 3 failures and a lock, but get %+v", resp.Items)
+		}
+
+		if w := do("DELETE", "/member/2/lock", ``, admin.Token, "192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expect admin to clear lock, but get %d", w.Code)
+		}
+		if w := login("2", "angrypug", "192.0.2.20"); w.Code != http.StatusOK {
+			t.Errorf("Expect member to login after lock cleared, but get %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("BackoffDoubles", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			login("2", "happypug", "192.0.2.30")
+		}
+		first := lockout.Check(lockout.MemberKey(2)).LockedUntil
+		lockout.Fail(lockout.MemberKey(2), config.Config.Lockout.MemberThreshold)
+		second := lockout.Check(lockout.MemberKey(2)).LockedUntil
+		if d := second.Sub(first); d < time.Duration(config.Config.Lockout.BaseDelay-1)*time.Second {
+			t.Errorf("Expect lock to be extended by doubled delay, but only %v", d)
+		}
+		lockout.Clear(lockout.MemberKey(2))
+	})
+
+	t.Run("SuccessResetsMemberFailures", func(t *testing.T) {
+		login("2", "happypug", "192.0.2.40")
+		login("2", "angrypug", "192.0.2.40")
+		if record := lockout.Check(lockout.MemberKey(2)); record.Failures != 0 {
+			t.Errorf("Expect failures to be cleared after login, but get %d", record.Failures)
+		}
+	})
+
+	t.Run("IPLock", func(t *testing.T) {
+		for i := 0; i < 6; i++ {
+			login(strconv.Itoa(24600+i), "angrypug", "198.51.100.7")
+		}
+		if w := login("3", "angrypug", "198.51.100.7"); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expect locked IP to be refused, but get %d", w.Code)
+		}
+		if w := login("3", "angrypug", "198.51.100.8"); w.Code != http.StatusOK {
+			t.Errorf("Expect other IPs not to be affected, but get %d", w.Code)
+		}
+	})
+}
+
+func TestRouteMemberTwoFactor(t *testing.T) {
+
+	lockout.DefaultStore = lockout.NewMemoryStore()
+	memoryStore.twoFactors, memoryStore.recoveryCodes = map[int64]TwoFactor{}, []RecoveryCode{}
+
+	hpw, _ := utils.CryptHashPassword("angrypug")
+	password := rrsql.NullString{String: hpw, Valid: true}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn,
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password},
+		Member{ID: 2, MemberID: "test6743@test.test", Mail: rrsql.NullString{String: "test6743@test.test", Valid: true}, Role: rrsql.NullInt{Int: 3, Valid: true},
+			Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password},
+	}
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+
+	do := func(method, url, body, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(name string, w *httptest.ResponseRecorder, httpcode int, body string) {
+		if w.Code != httpcode || (body != "" && w.Body.String() != body) {
+			t.Errorf("%s want %d %s but get %d %s", name, httpcode, body, w.Code, w.Body.String())
+		}
+	}
+
+	var editor struct {
+		TokenPair
+		SetupRequired bool `json:"two_factor_setup_required"`
+	}
+	admin, _ := issueTokens(context.Background(), memoryStore.members[0])
+	json.Unmarshal(do("POST", "/member/login", `{"id":"2","password":"angrypug"}`, "").Body.Bytes(), &editor)
+	if !editor.SetupRequired || editor.RefreshToken != "" {
+		t.Errorf("Expect editor to be prompted to set up two-factor authentication without refresh token, but get %+v", editor)
+	}
+	claims, _ := token.Parse(editor.Token)
+	if claims == nil || !reflect.DeepEqual(claims.Scopes, []string{scopeTwoFactorEnroll}) {
+		t.Errorf("Expect token of editor only to enroll, but get %+v", claims)
+	}
+	expect("NotEnrolledUpdate", do("PUT", "/member", `{"id":2, "nickname":"pug"}`, editor.Token), http.StatusForbidden,
+		errorBody("two_factor_setup_required", "Two Factor Setup Required"))
+
+	expect("EnrollAnonymous", do("POST", "/member/2fa/enroll", ``, ""), http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized"))
+	expect("ConfirmNotEnrolled", do("POST", "/member/2fa/confirm", `{"otp":"123456"}`, editor.Token), http.StatusBadRequest, errorBody("two_factor_not_enrolled", "Two Factor Not Enrolled"))
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	w := do("POST", "/member/2fa/enroll", ``, editor.Token)
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	if w.Code != http.StatusOK || enrollment.Secret == "" || !strings.HasPrefix(enrollment.URI, "otpauth://totp/Readr:test6743@test.test?") {
+		t.Fatalf("Unexpected enrollment %d %s", w.Code, w.Body.String())
+	}
+	code := func(offset int64) string {
+		c, _ := totp.Code(enrollment.Secret, totp.Step(time.Now())+offset)
+		return c
+	}
+
+	expect("ConfirmWrongCode", do("POST", "/member/2fa/confirm", fmt.Sprintf(`{"otp":"%s"}`, code(-5)), editor.Token), http.StatusUnauthorized, errorBody("invalid_code", "Invalid Code"))
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	// Kept to be replayed, code(0) may be of the next step by then
+	confirmed := code(0)
+	w = do("POST", "/member/2fa/confirm", fmt.Sprintf(`{"otp":"%s"}`, confirmed), editor.Token)
+	json.Unmarshal(w.Body.Bytes(), &confirmation)
+	if w.Code != http.StatusOK || len(confirmation.RecoveryCodes) != config.Config.TwoFactor.RecoveryCodes {
+		t.Fatalf("Unexpected confirmation %d %s", w.Code, w.Body.String())
+	}
+	for _, stored := range memoryStore.recoveryCodes {
+		if stored.CodeHash == confirmation.RecoveryCodes[0] {
+			t.Errorf("Expect recovery codes to be stored hashed")
+		}
+	}
+	expect("EnrollAgain", do("POST", "/member/2fa/enroll", ``, editor.Token), http.StatusConflict, errorBody("two_factor_enabled", "Two Factor Enabled"))
+
+	w = do("GET", "/member/2", ``, editor.Token)
+	if !strings.Contains(w.Body.String(), `"two_factor_enabled":true`) || strings.Contains(w.Body.String(), enrollment.Secret) {
+		t.Errorf("Expect only two_factor_enabled flag exposed, but get %s", w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		httpcode int
+		resp     string
+	}{
+		{"LoginWithoutCode", `{"id":"2","password":"angrypug"}`, http.StatusUnauthorized, errorBody("two_factor_required", "Two Factor Required")},
+		{"LoginWrongPasswordFirst", fmt.Sprintf(`{"id":"2","password":"happypug","otp":"%s"}`, code(1)), http.StatusUnauthorized, errorBody("wrong_password", "Wrong Password")},
+		{"LoginWrongCode", `{"id":"2","password":"angrypug","otp":"000000"}`, http.StatusUnauthorized, errorBody("invalid_code", "Invalid Code")},
+		{"LoginReplayedCode", fmt.Sprintf(`{"id":"2","password":"angrypug","otp":"%s"}`, confirmed), http.StatusUnauthorized, errorBody("invalid_code", "Invalid Code")},
+		{"LoginOTP", fmt.Sprintf(`{"id":"2","password":"angrypug","otp":"%s"}`, code(1)), http.StatusOK, ``},
+		{"LoginRecoveryCode", fmt.Sprintf(`{"id":"2","password":"angrypug","recovery_code":"%s"}`, strings.ToUpper(confirmation.RecoveryCodes[3])), http.StatusOK, ``},
+		{"LoginReusedRecoveryCode", fmt.Sprintf(`{"id":"2","password":"angrypug","recovery_code":"%s"}`, confirmation.RecoveryCodes[3]), http.StatusUnauthorized, errorBody("invalid_code", "Invalid Code")},
+	} {
+		expect(tc.name, do("POST", "/member/login", tc.body, ""), tc.httpcode, tc.resp)
+	}
+
+	expect("DisableByOwner", do("DELETE", "/member/2/2fa", ``, editor.Token), http.StatusForbidden, errorBody("forbidden", "Forbidden"))
+	expect("DisableNotExisted", do("DELETE", "/member/24601/2fa", ``, admin.Token), http.StatusNotFound, errorBody("user_not_found", "User Not Found"))
+	expect("DisableByAdmin", do("DELETE", "/member/2/2fa", ``, admin.Token), http.StatusOK, ``)
+	expect("LoginAfterDisabled", do("POST", "/member/login", `{"id":"2","password":"angrypug"}`, ""), http.StatusOK, ``)
+}
+
+func TestRouteMemberIdentities(t *testing.T) {
+
+	hpw, _ := utils.CryptHashPassword("angrypug")
+	password := rrsql.NullString{String: hpw, Valid: true}
+	memoryStore.members = []Member{
+		Member{ID: 1, MemberID: "1234567890", RegisterMode: rrsql.NullString{String: "oauth-goo", Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}},
+		Member{ID: 2, MemberID: "test6743@test.test", RegisterMode: rrsql.NullString{String: "ordinary", Valid: true},
+			Role: rrsql.NullInt{Int: 1, Valid: true}, Active: rrsql.NullInt{Int: 1, Valid: true}, Password: password},
+		Member{ID: 9, MemberID: "superman@mirrormedia.mg", Role: rrsql.NullInt{Int: 9, Valid: true}, TwoFactorEnabled: twoFactorOn, Active: rrsql.NullInt{Int: 1, Valid: true}},
+	}
+	memoryStore.identities = []MemberIdentity{
+		MemberIdentity{ID: 1, MemberID: 1, Provider: "oauth-goo", Subject: "1234567890"},
+	}
+
+	r := gin.New()
+	r.Use(rt.RequestID)
+	Router.SetRoutes(r)
+	do := func(method, url, body, bearer string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(rt.RequestIDHeader, testRequestID)
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	var other TokenPair
+	json.Unmarshal(do("POST", "/member/login", `{"id":"2","password":"angrypug"}`, "").Body.Bytes(), &other)
+	self, err := issueTokens(context.Background(), memoryStore.members[0])
+	if err != nil {
+		t.Fatalf("Fail to issue token for member: %v", err)
+	}
+	// Members are looked up by identities with service accounts of managers
+	admin, _ := issueTokens(context.Background(), memoryStore.members[2])
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		bearer   string
+		httpcode int
+		resp     string
+	}{
+		{"GetByIdentity", "GET", "/member/1234567890?provider=oauth-goo", ``, admin.Token, http.StatusOK, `"id":1,`},
+		{"GetByIdentityAnonymous", "GET", "/member/1234567890?provider=oauth-goo", ``, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"GetByUnknownIdentity", "GET", "/member/1234567890?provider=oauth-fb", ``, admin.Token, http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		{"List", "GET", "/member/1/identities", ``, self.Token, http.StatusOK, `{"_items":[{"id":1,"member_id":1,"provider":"oauth-goo","subject":"1234567890","created_at":null}],"password":false}`},
+		{"ListAnonymous", "GET", "/member/1/identities", ``, "", http.StatusUnauthorized, errorBody("unauthorized", "Unauthorized")},
+		{"ListOther", "GET", "/member/1/identities", ``, other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"ListNotExisted", "GET", "/member/24601/identities", ``, "", http.StatusNotFound, errorBody("user_not_found", "User Not Found")},
+		{"LinkOther", "POST", "/member/1/identities", `{"provider":"oauth-fb","subject":"fb-1"}`, other.Token, http.StatusForbidden, errorBody("forbidden", "Forbidden")},
+		{"LinkUnknownProvider", "POST", "/member/1/identities", `{"provider":"myspace","subject":"ms-1"}`, self.Token, http.StatusBadRequest, errorBody("invalid_identity", "Invalid Identity")},
+		{"LinkNoSubject", "POST", "/member/1/identities", `{"provider":"oauth-fb"}`, self.Token, http.StatusBadRequest, errorBody("invalid_identity", "Invalid Identity")},
+		{"Link", "POST", "/member/1/identities", `{"provider":"oauth-fb","subject":"fb-1"}`, self.Token, http.StatusOK, `"provider":"oauth-fb"`},
+		{"LinkSameProviderTwice", "POST", "/member/1/identities", `{"provider":"oauth-fb","subject":"fb-3"}`, self.Token, http.StatusConflict, errorBody("identity_already_linked", "Identity Already Linked")},
+		{"LinkTaken", "POST", "/member/2/identities", `{"provider":"oauth-fb","subject":"fb-1"}`, other.Token, http.StatusConflict, errorBody("identity_already_linked", "Identity Already Linked")},
+		{"UnlinkNoProvider", "DELETE", "/member/1/identities", ``, self.Token, http.StatusBadRequest, errorBody("invalid_identity", "Invalid Identity")},
+		{"UnlinkNotLinked", "DELETE", "/member/2/identities?provider=oauth-goo", ``, other.Token, http.StatusNotFound, errorBody("identity_not_found", "Identity Not Found")},
+		{"Unlink", "DELETE", "/member/1/identities?provider=oauth-goo", ``, self.Token, http.StatusOK, ``},
+		{"UnlinkLast", "DELETE", "/member/1/identities?provider=oauth-fb", ``, self.Token, http.StatusConflict, errorBody("last_login_method", "Last Login Method")},
+		{"LinkWithPassword", "POST", "/member/2/identities", `{"provider":"oauth-goo","subject":"g-2"}`, other.Token, http.StatusOK, `"provider":"oauth-goo"`},
+		{"UnlinkWithPassword", "DELETE", "/member/2/identities?provider=oauth-goo", ``, other.Token, http.StatusOK, ``},
+		{"RegisterSocial", "POST", "/member", `{"member_id":"fb-9", "register_mode":"oauth-fb", "social_id":"fb-9"}`, "", http.StatusOK, `{"_items":{"last_id":10}}`},
+		{"GetRegisteredByIdentity", "GET", "/member/fb-9?provider=oauth-fb", ``, admin.Token, http.StatusOK, `"id":10,`},
+	} {
+		w := do(tc.method, tc.url, tc.body, tc.bearer)
+		if w.Code != tc.httpcode || !strings.Contains(w.Body.String(), tc.resp) {
+			t.Errorf("%s want %d %s but get %d %s", tc.name, tc.httpcode, tc.resp, w.Code, w.Body.String())
 		}
 	}
 }
@@ -0,0 +1,428 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/lockout"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+func TestMemoryMemberStore(t *testing.T) {
+	testMemberStore(t, newMemoryAPI())
+}
+
+func TestSetMemoryStore(t *testing.T) {
+	attempts := lockout.DefaultStore
+	defer func() {
+		MemberAPI, AuditAPI = memoryStore, memoryStore
+		TokenAPI, IdentityAPI, TwoFactorAPI, ExportAPI, FollowAPI = memoryStore, memoryStore, memoryStore, memoryStore, memoryStore
+		lockout.DefaultStore = attempts
+	}()
+	if err := SetStore("memory"); err != nil {
+		t.Fatalf("Fail to set memory store: %v", err)
+	}
+	store, ok := MemberAPI.(*memoryAPI)
+	if !ok {
+		t.Fatalf("Expect members kept in memory, but get %T", MemberAPI)
+	}
+	for name, api := range map[string]interface{}{"AuditAPI": AuditAPI, "TokenAPI": TokenAPI, "IdentityAPI": IdentityAPI,
+		"TwoFactorAPI": TwoFactorAPI, "ExportAPI": ExportAPI, "FollowAPI": FollowAPI} {
+		if api != store {
+			t.Errorf("Expect %s kept in memory along with members, but get %T", name, api)
+		}
+	}
+	if _, ok := lockout.DefaultStore.(*lockout.MemoryStore); !ok {
+		t.Errorf("Expect login attempts kept in memory, but get %T", lockout.DefaultStore)
+	}
+	if err := SetStore("redis"); err == nil {
+		t.Errorf("Expect unknown store refused")
+	}
+}
+
+// TestMemoryStoreContext checks that stores kept in memory give up on canceled contexts, the way MySQL does
+func TestMemoryStoreContext(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store := newMemoryAPI()
+	for name, call := range map[string]func() error{
+		"InsertToken": func() error { return store.InsertToken(ctx, MemberToken{MemberID: 1}) },
+		"GetHistory": func() error {
+			_, err := store.GetHistory(ctx, &GetHistoryArgs{MemberID: 1, MaxResult: 20, Page: 1})
+			return err
+		},
+		"GetIdentities": func() error {
+			_, err := store.GetIdentities(ctx, 1)
+			return err
+		},
+		"SetSecret": func() error { return store.SetSecret(ctx, 1, "secret") },
+		"InsertExport": func() error {
+			_, err := store.InsertExport(ctx, MemberExport{MemberID: 1})
+			return err
+		},
+	} {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s expect context canceled, but get %v", name, err)
+		}
+	}
+	if len(store.tokens) > 0 || len(store.twoFactors) > 0 || len(store.exports) > 0 {
+		t.Errorf("Expect nothing kept with canceled context")
+	}
+}
+
+// TestMemoryStoreErase checks that credentials, identities, exports and follows kept in memory
+// are erased along with members, the way they are in MySQL
+func TestMemoryStoreErase(t *testing.T) {
+
+	ctx := context.Background()
+	store := newMemoryAPI()
+	for _, m := range []Member{
+		{ID: 1, MemberID: "majortom", Active: rrsql.NullInt{Int: 1, Valid: true}},
+		{ID: 2, MemberID: "spaceoddity", Active: rrsql.NullInt{Int: 1, Valid: true}},
+	} {
+		if _, err := store.InsertMember(ctx, m, AuditMeta{}); err != nil {
+			t.Fatalf("Fail to insert member %d: %v", m.ID, err)
+		}
+		store.InsertToken(ctx, MemberToken{MemberID: m.ID, Purpose: tokenPurposeRefresh, TokenHash: m.MemberID, ExpiresAt: time.Now().Add(time.Hour)})
+		store.InsertIdentity(ctx, MemberIdentity{MemberID: m.ID, Provider: "oauth-goo", Subject: m.MemberID})
+		store.SetSecret(ctx, m.ID, "secret")
+		store.Enable(ctx, m.ID, []RecoveryCode{{CodeHash: "hash"}})
+		store.InsertExport(ctx, MemberExport{MemberID: m.ID, Status: exportStatusPending})
+		store.follows = append(store.follows, MemberFollow{MemberID: m.ID, TargetID: 3 - m.ID})
+	}
+	m, err := store.GetMember(ctx, GetMemberArgs{Provider: "oauth-goo", Subject: "spaceoddity"})
+	if err != nil || m.ID != 2 || !m.TwoFactorEnabled.Bool {
+		t.Errorf("Expect member with two-factor found by identity, but get %+v %v", m, err)
+	}
+
+	kept := func(id int64) (kept []string) {
+		if _, err := store.GetToken(ctx, tokenPurposeRefresh, map[int64]string{1: "majortom", 2: "spaceoddity"}[id]); err == nil {
+			kept = append(kept, "token")
+		}
+		if identities, _ := store.GetIdentities(ctx, id); len(identities) > 0 {
+			kept = append(kept, "identity")
+		}
+		if _, err := store.GetTwoFactor(ctx, id); err == nil {
+			kept = append(kept, "two_factor")
+		}
+		if codes, _ := store.GetRecoveryCodes(ctx, id); len(codes) > 0 {
+			kept = append(kept, "recovery_code")
+		}
+		if _, err := store.GetLatestExport(ctx, id); err == nil {
+			kept = append(kept, "export")
+		}
+		return kept
+	}
+	if err = store.AnonymizeMembers(ctx, []int64{1}, AuditMeta{}); err != nil {
+		t.Fatalf("Fail to anonymize member: %v", err)
+	}
+	if erased := kept(1); len(erased) > 0 {
+		t.Errorf("Expect credentials of anonymized member erased, but get %v", erased)
+	}
+	if all := kept(2); len(all) != 5 {
+		t.Errorf("Expect credentials of others kept, but get %v", all)
+	}
+
+	store.DeleteMember(ctx, "id", "2", AuditMeta{})
+	if _, err = store.PurgeMembers(ctx, time.Now().Add(time.Hour), 10, false, AuditMeta{}); err != nil {
+		t.Fatalf("Fail to purge members: %v", err)
+	}
+	if erased := kept(2); len(erased) > 0 {
+		t.Errorf("Expect credentials of purged member erased, but get %v", erased)
+	}
+	if follows, _ := store.GetFollows(ctx, 2); len(follows) > 0 {
+		t.Errorf("Expect follows of purged member erased, but get %v", follows)
+	}
+	if follows, _ := store.GetFollows(ctx, 1); len(follows) != 1 {
+		t.Errorf("Expect follows of others kept, but get %v", follows)
+	}
+	if _, err = store.GetMember(ctx, GetMemberArgs{Provider: "oauth-goo", Subject: "spaceoddity"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expect purged member not found by identity, but get %v", err)
+	}
+}
+
+// TestMySQLMemberStore runs with db_driver=mysql, against memberdb of config emptied ahead
+func TestMySQLMemberStore(t *testing.T) {
+	if os.Getenv("db_driver") != "mysql" {
+		t.Skip("MySQL is only tested with db_driver=mysql")
+	}
+	rrsql.Connect(fmt.Sprintf("%s:%s@tcp(%s:%v)/memberdb?parseTime=true&charset=utf8mb4&multiStatements=true",
+		config.Config.SQL.User, config.Config.SQL.Password, config.Config.SQL.Host, config.Config.SQL.Port))
+	for _, table := range append(memberTables, "members") {
+		if _, err := rrsql.DB.Exec("TRUNCATE TABLE " + table); err != nil {
+			t.Fatalf("Fail to truncate %s: %v", table, err)
+		}
+	}
+	testMemberStore(t, new(memberAPI))
+}
+
+// testMemberStore checks behaviors every MemberInterface has to share, so members kept in memory
+// are found, sorted and changed the same way as those in MySQL
+func testMemberStore(t *testing.T, store MemberInterface) {
+
+	ctx := context.Background()
+	at := func(date string) rrsql.NullTime {
+		t, _ := time.Parse("2006-01-02", date)
+		return rrsql.NullTime{Time: t, Valid: true}
+	}
+	str := func(s string) rrsql.NullString { return rrsql.NullString{String: s, Valid: true} }
+	num := func(i int64) rrsql.NullInt { return rrsql.NullInt{Int: i, Valid: true} }
+	for _, m := range []Member{
+		{ID: 1, MemberID: "superman@mirrormedia.mg", UUID: "3d64e480-3e30-11e8-b94b-cfe922eb374f", Nickname: str("readr"),
+			Mail: str("superman@mirrormedia.mg"), Role: num(9), Active: num(1), Points: num(10),
+			CustomEditor: rrsql.NullBool{Bool: true, Valid: true}, CreatedAt: at("2018-01-01")},
+		{ID: 2, MemberID: "majortom", UUID: "3d651126-3e30-11e8-b94b-cfe922eb374f", Nickname: str("reader"),
+			Mail: str("majortom@readr.tw"), Role: num(1), Active: num(1), Points: num(30), CreatedAt: at("2018-02-01")},
+		{ID: 3, MemberID: "spaceoddity", UUID: "3d6512e8-3e30-11e8-b94b-cfe922eb374f", Nickname: str("ready"),
+			Mail: str("spaceoddity@readr.tw"), Role: num(3), Active: num(0), Points: num(20), CreatedAt: at("2018-03-01")},
+		{ID: 4, MemberID: "starman", UUID: "3d6513f2-3e30-11e8-b94b-cfe922eb374f", Nickname: str("reading"),
+			Role: num(1), Active: num(1), Points: num(25), CreatedAt: at("2018-04-01")},
+	} {
+		if _, err := store.InsertMember(ctx, m, AuditMeta{}); err != nil {
+			t.Fatalf("Fail to insert member %d: %v", m.ID, err)
+		}
+	}
+	ids := func(members []Member) (result []int64) {
+		for _, m := range members {
+			result = append(result, m.ID)
+		}
+		return result
+	}
+	stuntIDs := func(stunts []Stunt) (result []int64) {
+		for _, s := range stunts {
+			result = append(result, *s.ID)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+		return result
+	}
+	expectIDs := func(name string, want []int64, got []int64, err error) {
+		if err != nil || !reflect.DeepEqual(want, got) {
+			t.Errorf("%s expect members %v, but get %v %v", name, want, got, err)
+		}
+	}
+	expectErr := func(name string, want error, err error) {
+		if !errors.Is(err, want) {
+			t.Errorf("%s expect %v, but get %v", name, want, err)
+		}
+	}
+
+	t.Run("InsertMember", func(t *testing.T) {
+		id, err := store.InsertMember(ctx, Member{MemberID: "ziggy", Active: num(0)}, AuditMeta{})
+		if err != nil || id != 5 {
+			t.Errorf("Expect member inserted after the last id, but get %d %v", id, err)
+		}
+		_, err = store.InsertMember(ctx, Member{MemberID: "majortom"}, AuditMeta{})
+		expectErr("Duplicate", ErrUserExisted, err)
+	})
+
+	t.Run("GetMember", func(t *testing.T) {
+		active := 1
+		for _, testcase := range []struct {
+			name string
+			args GetMemberArgs
+			id   int64
+			err  error
+		}{
+			{"ByID", GetMemberArgs{IDType: "id", ID: "2"}, 2, nil},
+			{"ByMemberID", GetMemberArgs{IDType: "member_id", ID: "spaceoddity"}, 3, nil},
+			{"ByUUID", GetMemberArgs{IDType: "uuid", ID: "3d6513f2-3e30-11e8-b94b-cfe922eb374f"}, 4, nil},
+			{"ByNickname", GetMemberArgs{IDType: "nickname", ID: "readr"}, 1, nil},
+			{"Inactive", GetMemberArgs{IDType: "id", ID: "3", Active: &active}, 0, ErrUserNotFound},
+			{"NotExisted", GetMemberArgs{IDType: "id", ID: "24601"}, 0, ErrUserNotFound},
+		} {
+			m, err := store.GetMember(ctx, testcase.args)
+			if m.ID != testcase.id || !errors.Is(err, testcase.err) {
+				t.Errorf("%s expect member %d %v, but get %d %v", testcase.name, testcase.id, testcase.err, m.ID, err)
+			}
+		}
+		m, err := store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "2", Fields: rrsql.Sqlfields{"id", "nickname"}})
+		if err != nil || m.Nickname.String != "reader" || m.Mail.Valid {
+			t.Errorf("Expect only fields selected, but get %+v %v", m, err)
+		}
+	})
+
+	t.Run("GetMembers", func(t *testing.T) {
+		list := func(sorting string, page uint16, active []int) *GetMembersArgs {
+			return &GetMembersArgs{MaxResult: 2, Page: page, Sorting: sorting, Active: map[string][]int{"$in": active}}
+		}
+		result, err := store.GetMembers(ctx, list("-points", 1, []int{1}))
+		expectIDs("FirstPage", []int64{2, 4}, ids(result), err)
+		result, err = store.GetMembers(ctx, list("-points", 2, []int{1}))
+		expectIDs("SecondPage", []int64{1}, ids(result), err)
+		// Offset of 65536 rows, which wraps to the first page in uint16
+		result, err = store.GetMembers(ctx, list("-points", 32769, []int{1}))
+		expectIDs("LatePage", nil, ids(result), err)
+
+		args := list("points", 1, []int{0, 1})
+		args.MaxResult = 20
+		args.Filters = []rrsql.Filter{{Column: "points", Operator: "$gte", Value: int64(20)}}
+		result, err = store.GetMembers(ctx, args)
+		expectIDs("Filters", []int64{3, 4, 2}, ids(result), err)
+
+		role := int64(1)
+		args = list("id", 1, []int{1})
+		args.Role = &role
+		result, err = store.GetMembers(ctx, args)
+		expectIDs("Role", []int64{2, 4}, ids(result), err)
+
+		args = list("id", 1, []int{0, 1})
+		args.CustomEditor = true
+		result, err = store.GetMembers(ctx, args)
+		expectIDs("CustomEditor", []int64{1}, ids(result), err)
+
+		args = list("-id", 1, []int{0, 1})
+		args.IDs, args.UUIDs = []string{"1", "3", "4"}, []string{"3d6512e8-3e30-11e8-b94b-cfe922eb374f", "3d6513f2-3e30-11e8-b94b-cfe922eb374f"}
+		result, err = store.GetMembers(ctx, args)
+		expectIDs("IDsAndUUIDs", []int64{4, 3}, ids(result), err)
+
+		// Cursors continue where the page ends, and lead back to it
+		first, _ := store.GetMembers(ctx, list("-points", 1, []int{0, 1}))
+		rows := []map[string]interface{}{memberValues(first[0]), memberValues(first[1])}
+		next, _ := memberCursors("-points", rows, 2, nil, 1)
+		args = list("-points", 1, []int{0, 1})
+		if args.Keyset, err = parseMemberCursor(next, "-points"); err != nil {
+			t.Fatalf("Fail to parse cursor: %v", err)
+		}
+		second, err := store.GetMembers(ctx, args)
+		expectIDs("NextCursor", []int64{3, 1}, ids(second), err)
+		rows = []map[string]interface{}{memberValues(second[0]), memberValues(second[1])}
+		_, prev := memberCursors("-points", rows, 2, args.Keyset, 1)
+		if args.Keyset, err = parseMemberCursor(prev, "-points"); err != nil {
+			t.Fatalf("Fail to parse cursor: %v", err)
+		}
+		result, err = store.GetMembers(ctx, args)
+		expectIDs("PrevCursor", []int64{2, 4}, ids(result), err)
+
+		if _, err = store.GetMembers(ctx, list("shoe_size", 1, []int{1})); err == nil {
+			t.Errorf("Expect invalid sort to fail")
+		}
+	})
+
+	t.Run("FilterMembers", func(t *testing.T) {
+		args := &FilterMemberArgs{Fields: rrsql.Sqlfields{"id", "mail"}}
+		args.MaxResult, args.Page, args.Sorting, args.Mail = 20, 1, "id", "readr.tw"
+		result, err := store.FilterMembers(ctx, args)
+		if err != nil || len(result) != 2 || *result[0].ID != 2 || result[0].Mail.String != "majortom@readr.tw" || result[0].Nickname != nil {
+			t.Errorf("Expect members filtered by mail with only fields selected, but get %+v %v", result, err)
+		}
+		count, err := store.Count(ctx, args)
+		if err != nil || count != 2 {
+			t.Errorf("Expect 2 members counted by mail, but get %d %v", count, err)
+		}
+
+		args = &FilterMemberArgs{Fields: rrsql.Sqlfields{"id"}}
+		args.MaxResult, args.Page, args.Sorting = 20, 1, "-created_at"
+		args.CreatedAt = map[string]time.Time{"$gt": at("2018-02-01").Time, "$lt": at("2018-03-01").Time}
+		result, err = store.FilterMembers(ctx, args)
+		expectIDs("CreatedAt", []int64{3, 2}, []int64{*result[0].ID, *result[1].ID}, err)
+
+		args.CreatedAt, args.ID = nil, 4
+		result, err = store.FilterMembers(ctx, args)
+		expectIDs("ID", []int64{4}, stuntIDs(result), err)
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		args := &GetMembersArgs{Active: map[string][]int{"$nin": []int{0}}}
+		count, err := store.Count(ctx, args)
+		if err != nil || count != 3 {
+			t.Errorf("Expect 3 members counted, but get %d %v", count, err)
+		}
+		args.Filters = []rrsql.Filter{{Column: "role", Operator: "$eq", Value: int64(1)}}
+		count, err = store.Count(ctx, args)
+		if err != nil || count != 2 {
+			t.Errorf("Expect 2 members counted by filters, but get %d %v", count, err)
+		}
+	})
+
+	t.Run("GetIDsByNickname", func(t *testing.T) {
+		args := GetMembersKeywordsArgs{Keywords: "rea", Fields: rrsql.Sqlfields{"id", "nickname"}}
+		result, err := store.GetIDsByNickname(ctx, args)
+		expectIDs("Active", []int64{1, 2, 4}, stuntIDs(result), err)
+		args.Roles = map[string][]int{"$in": []int{1}}
+		result, err = store.GetIDsByNickname(ctx, args)
+		expectIDs("Roles", []int64{2, 4}, stuntIDs(result), err)
+		args.Keywords, args.Roles = "ady", nil
+		result, err = store.GetIDsByNickname(ctx, args)
+		expectIDs("Prefix", nil, stuntIDs(result), err)
+	})
+
+	t.Run("UpdateMember", func(t *testing.T) {
+		if err := store.UpdateMember(ctx, Member{ID: 2, Nickname: str("tom")}, AuditMeta{}); err != nil {
+			t.Fatalf("Fail to update member: %v", err)
+		}
+		m, err := store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "2"})
+		if err != nil || m.Nickname.String != "tom" || m.Mail.String != "majortom@readr.tw" || m.Points.Int != 30 {
+			t.Errorf("Expect only nickname updated, but get %+v %v", m, err)
+		}
+		expectErr("NotExisted", ErrUserNotFound, store.UpdateMember(ctx, Member{ID: 24601, Nickname: str("tom")}, AuditMeta{}))
+	})
+
+	t.Run("UpdateAll", func(t *testing.T) {
+		if err := store.UpdateAll(ctx, []int64{3, 24601}, 1, AuditMeta{}); err != nil {
+			t.Fatalf("Fail to activate members: %v", err)
+		}
+		if m, err := store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "3"}); err != nil || m.Active.Int != 1 {
+			t.Errorf("Expect member activated, but get %+v %v", m, err)
+		}
+		expectErr("NotExisted", ErrMembersNotFound, store.UpdateAll(ctx, []int64{24601}, 1, AuditMeta{}))
+	})
+
+	t.Run("DeleteAndRestore", func(t *testing.T) {
+		if err := store.DeleteMember(ctx, "member_id", "starman", AuditMeta{}); err != nil {
+			t.Fatalf("Fail to delete member: %v", err)
+		}
+		m, err := store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "4"})
+		if err != nil || m.Active.Int != -1 || !m.DeletedAt.Valid || m.PrevActive.Int != 1 {
+			t.Errorf("Expect member deleted with state to restore to, but get %+v %v", m, err)
+		}
+		if m, err = store.RestoreMember(ctx, 4, AuditMeta{}); err != nil || m.Active.Int != 1 || m.DeletedAt.Valid {
+			t.Errorf("Expect member restored, but get %+v %v", m, err)
+		}
+		_, err = store.RestoreMember(ctx, 4, AuditMeta{})
+		expectErr("NotDeleted", ErrUserNotDeleted, err)
+		expectErr("NotExisted", ErrUserNotFound, store.DeleteMember(ctx, "id", "24601", AuditMeta{}))
+	})
+
+	t.Run("PurgeMembers", func(t *testing.T) {
+		if err := store.DeleteMember(ctx, "id", "4", AuditMeta{}); err != nil {
+			t.Fatalf("Fail to delete member: %v", err)
+		}
+		if purged, err := store.PurgeMembers(ctx, time.Now().Add(-time.Hour), 10, true, AuditMeta{}); err != nil || len(purged) != 0 {
+			t.Errorf("Expect members deleted lately kept, but get %v %v", purged, err)
+		}
+		purged, err := store.PurgeMembers(ctx, time.Now().Add(time.Hour), 10, true, AuditMeta{})
+		if err != nil || len(purged) != 1 || purged[0].ID != 4 {
+			t.Errorf("Expect deleted member to purge, but get %v %v", purged, err)
+		}
+		if _, err = store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "4"}); err != nil {
+			t.Errorf("Expect member kept by dry run, but get %v", err)
+		}
+		if purged, err = store.PurgeMembers(ctx, time.Now().Add(time.Hour), 10, false, AuditMeta{}); err != nil || len(purged) != 1 {
+			t.Errorf("Expect deleted member purged, but get %v %v", purged, err)
+		}
+		_, err = store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "4"})
+		expectErr("Purged", ErrUserNotFound, err)
+	})
+
+	t.Run("AnonymizeMembers", func(t *testing.T) {
+		if err := store.AnonymizeMembers(ctx, []int64{3, 24601}, AuditMeta{}); err != nil {
+			t.Fatalf("Fail to anonymize member: %v", err)
+		}
+		m, err := store.GetMember(ctx, GetMemberArgs{IDType: "id", ID: "3"})
+		if err != nil || m.MemberID != "anonymized-3d6512e8-3e30-11e8-b94b-cfe922eb374f" || m.Mail.Valid || m.Nickname.Valid ||
+			!m.AnonymizedAt.Valid || m.Active.Int != -1 || m.Points.Int != 20 {
+			t.Errorf("Expect member anonymized, but get %+v %v", m, err)
+		}
+		_, err = store.RestoreMember(ctx, 3, AuditMeta{})
+		expectErr("Restore", ErrUserAnonymized, err)
+		expectErr("NotExisted", ErrMembersNotFound, store.AnonymizeMembers(ctx, []int64{24601}, AuditMeta{}))
+	})
+}
@@ -0,0 +1,93 @@
+package member
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// MemberToken maps the schema of table 'member_tokens'.
+// It keeps the hash of opaque tokens handed to members, such as refresh tokens.
+type MemberToken struct {
+	ID        int64          `json:"id" db:"id"`
+	MemberID  int64          `json:"member_id" db:"member_id"`
+	Purpose   string         `json:"purpose" db:"purpose"`
+	TokenHash string         `json:"-" db:"token_hash"`
+	ExpiresAt time.Time      `json:"expires_at" db:"expires_at"`
+	UsedAt    rrsql.NullTime `json:"used_at" db:"used_at"`
+	CreatedAt rrsql.NullTime `json:"created_at" db:"created_at"`
+}
+
+const (
+	tokenPurposeRefresh       = "refresh"
+	tokenPurposePasswordReset = "password_reset"
+	tokenPurposeVerifyMail    = "verify_mail"
+)
+
+type tokenAPI struct{}
+
+var TokenAPI TokenInterface = new(tokenAPI)
+
+type TokenInterface interface {
+	InsertToken(ctx context.Context, t MemberToken) error
+	GetToken(ctx context.Context, purpose string, hash string) (MemberToken, error)
+	ConsumeToken(ctx context.Context, purpose string, hash string) (MemberToken, error)
+	RevokeTokens(ctx context.Context, memberID int64, purpose string) error
+}
+
+func (a *tokenAPI) InsertToken(ctx context.Context, t MemberToken) error {
+	_, err := rrsql.DB.NamedExecContext(ctx, `INSERT INTO member_tokens (member_id, purpose, token_hash, expires_at)
+		VALUES (:member_id, :purpose, :token_hash, :expires_at)`, t)
+	return err
+}
+
+// GetToken returns an unused, unexpired token without consuming it
+func (a *tokenAPI) GetToken(ctx context.Context, purpose string, hash string) (result MemberToken, err error) {
+
+	err = rrsql.DB.GetContext(ctx, &result, `SELECT * FROM member_tokens WHERE purpose = ? AND token_hash = ?`, purpose, hash)
+	switch {
+	case err == sql.ErrNoRows:
+		return MemberToken{}, ErrTokenNotFound
+	case err != nil:
+		return MemberToken{}, err
+	case result.UsedAt.Valid:
+		return MemberToken{}, ErrTokenNotFound
+	case time.Now().After(result.ExpiresAt):
+		return MemberToken{}, ErrTokenExpired
+	}
+	return result, nil
+}
+
+// ConsumeToken marks an unused, unexpired token as used and returns it, so every token works only once
+func (a *tokenAPI) ConsumeToken(ctx context.Context, purpose string, hash string) (result MemberToken, err error) {
+
+	err = rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &result, `SELECT * FROM member_tokens WHERE purpose = ? AND token_hash = ? FOR UPDATE`, purpose, hash)
+		switch {
+		case err == sql.ErrNoRows:
+			return ErrTokenNotFound
+		case err != nil:
+			return err
+		case result.UsedAt.Valid:
+			return ErrTokenNotFound
+		case time.Now().After(result.ExpiresAt):
+			return ErrTokenExpired
+		}
+		result.UsedAt = rrsql.NullTime{Time: time.Now(), Valid: true}
+		_, err = tx.ExecContext(ctx, `UPDATE member_tokens SET used_at = ? WHERE id = ?`, result.UsedAt, result.ID)
+		return err
+	})
+	if err != nil {
+		return MemberToken{}, err
+	}
+	return result, nil
+}
+
+// RevokeTokens marks all unused tokens of member for purpose as used
+func (a *tokenAPI) RevokeTokens(ctx context.Context, memberID int64, purpose string) error {
+	_, err := rrsql.DB.ExecContext(ctx, `UPDATE member_tokens SET used_at = NOW() WHERE member_id = ? AND purpose = ? AND used_at IS NULL`, memberID, purpose)
+	return err
+}
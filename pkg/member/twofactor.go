@@ -0,0 +1,284 @@
+package member
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/readr-media/readr-restful-member/config"
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+	"github.com/readr-media/readr-restful-member/internal/totp"
+	"github.com/readr-media/readr-restful-member/internal/utils"
+)
+
+const recovery_code_bytes = 5
+
+// TwoFactor maps the schema of table 'member_two_factor'.
+// It is never marshalled into responses, members only see the two_factor_enabled flag.
+type TwoFactor struct {
+	MemberID     int64          `db:"member_id"`
+	Secret       string         `db:"secret"`
+	LastUsedStep int64          `db:"last_used_step"`
+	EnabledAt    rrsql.NullTime `db:"enabled_at"`
+	CreatedAt    rrsql.NullTime `db:"created_at"`
+}
+
+// RecoveryCode maps the schema of table 'member_recovery_codes'.
+// Codes are hashed with utils.CryptGenHash and a salt of their own.
+type RecoveryCode struct {
+	ID        int64          `db:"id"`
+	MemberID  int64          `db:"member_id"`
+	CodeHash  string         `db:"code_hash"`
+	Salt      string         `db:"salt"`
+	UsedAt    rrsql.NullTime `db:"used_at"`
+	CreatedAt rrsql.NullTime `db:"created_at"`
+}
+
+type twoFactorAPI struct{}
+
+var TwoFactorAPI TwoFactorInterface = new(twoFactorAPI)
+
+type TwoFactorInterface interface {
+	GetTwoFactor(ctx context.Context, memberID int64) (TwoFactor, error)
+	SetSecret(ctx context.Context, memberID int64, secret string) error
+	Enable(ctx context.Context, memberID int64, codes []RecoveryCode) error
+	Disable(ctx context.Context, memberID int64) error
+	UseStep(ctx context.Context, memberID int64, step int64) error
+	GetRecoveryCodes(ctx context.Context, memberID int64) ([]RecoveryCode, error)
+	UseRecoveryCode(ctx context.Context, id int64) error
+}
+
+func (a *twoFactorAPI) GetTwoFactor(ctx context.Context, memberID int64) (result TwoFactor, err error) {
+	err = rrsql.DB.GetContext(ctx, &result, `SELECT * FROM member_two_factor WHERE member_id = ?`, memberID)
+	if err == sql.ErrNoRows {
+		return TwoFactor{}, ErrTwoFactorNotFound
+	}
+	return result, err
+}
+
+// SetSecret saves a pending secret for member, replacing any pending one.
+// Secrets turn effective after Enable.
+func (a *twoFactorAPI) SetSecret(ctx context.Context, memberID int64, secret string) error {
+	_, err := rrsql.DB.ExecContext(ctx, `INSERT INTO member_two_factor (member_id, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_used_step = 0, enabled_at = NULL, created_at = NOW()`, memberID, secret)
+	return err
+}
+
+// Enable turns on the pending secret of member, and replaces recovery codes with codes
+func (a *twoFactorAPI) Enable(ctx context.Context, memberID int64, codes []RecoveryCode) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE member_two_factor SET enabled_at = NOW() WHERE member_id = ?`, memberID)
+		if err != nil {
+			return err
+		}
+		if rowCnt, _ := result.RowsAffected(); rowCnt == 0 {
+			return ErrTwoFactorNotFound
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM member_recovery_codes WHERE member_id = ?`, memberID); err != nil {
+			return err
+		}
+		for _, code := range codes {
+			code.MemberID = memberID
+			if _, err = tx.NamedExecContext(ctx, `INSERT INTO member_recovery_codes (member_id, code_hash, salt)
+				VALUES (:member_id, :code_hash, :salt)`, code); err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE members SET two_factor_enabled = 1 WHERE id = ?`, memberID)
+		return err
+	})
+}
+
+// Disable removes secret and recovery codes of member
+func (a *twoFactorAPI) Disable(ctx context.Context, memberID int64) error {
+	return rrsql.WithTransaction(ctx, rrsql.DB.DB, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM member_two_factor WHERE member_id = ?`, memberID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM member_recovery_codes WHERE member_id = ?`, memberID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE members SET two_factor_enabled = 0 WHERE id = ?`, memberID)
+		return err
+	})
+}
+
+// UseStep records the time step of a code just verified, and refuses steps not later than the last used one,
+// so every code works only once.
+func (a *twoFactorAPI) UseStep(ctx context.Context, memberID int64, step int64) error {
+	result, err := rrsql.DB.ExecContext(ctx, `UPDATE member_two_factor SET last_used_step = ? WHERE member_id = ? AND last_used_step < ?`, step, memberID, step)
+	if err != nil {
+		return err
+	}
+	if rowCnt, _ := result.RowsAffected(); rowCnt == 0 {
+		return ErrCodeAlreadyUsed
+	}
+	return nil
+}
+
+// GetRecoveryCodes returns unused recovery codes of member
+func (a *twoFactorAPI) GetRecoveryCodes(ctx context.Context, memberID int64) (result []RecoveryCode, err error) {
+	err = rrsql.DB.SelectContext(ctx, &result, `SELECT * FROM member_recovery_codes WHERE member_id = ? AND used_at IS NULL`, memberID)
+	return result, err
+}
+
+func (a *twoFactorAPI) UseRecoveryCode(ctx context.Context, id int64) error {
+	result, err := rrsql.DB.ExecContext(ctx, `UPDATE member_recovery_codes SET used_at = NOW() WHERE id = ? AND used_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if rowCnt, _ := result.RowsAffected(); rowCnt == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+// requiresTwoFactor reports whether member is expected to turn on two-factor authentication
+func requiresTwoFactor(member Member) bool {
+	return (member.Role.Valid && member.Role.Int >= int64(config.Config.TwoFactor.RequiredRole)) || member.CustomEditor.Bool
+}
+
+// twoFactorSetupRequired reports whether member has yet to turn on the two-factor authentication required of it
+func twoFactorSetupRequired(member Member) bool {
+	return requiresTwoFactor(member) && !member.TwoFactorEnabled.Bool
+}
+
+// EnrollTwoFactor generates a new pending secret for member, and returns it with its otpauth URI
+func EnrollTwoFactor(ctx context.Context, member Member) (secret string, uri string, err error) {
+
+	if member.TwoFactorEnabled.Bool {
+		return "", "", ErrTwoFactorEnabled
+	}
+	if secret, err = totp.GenerateSecret(); err != nil {
+		return "", "", err
+	}
+	if err = TwoFactorAPI.SetSecret(ctx, member.ID, secret); err != nil {
+		return "", "", err
+	}
+	account := member.Mail.String
+	if account == "" {
+		account = member.MemberID
+	}
+	return secret, totp.URI(secret, config.Config.TwoFactor.Issuer, account), nil
+}
+
+// ConfirmTwoFactor turns on the pending secret of member once otp proves the authenticator app is set,
+// and returns recovery codes in plain text. They are never shown again.
+func ConfirmTwoFactor(ctx context.Context, member Member, otp string) (codes []string, err error) {
+
+	tf, err := TwoFactorAPI.GetTwoFactor(ctx, member.ID)
+	if err != nil {
+		if errors.Is(err, ErrTwoFactorNotFound) {
+			return nil, ErrTwoFactorNotEnrolled
+		}
+		return nil, err
+	}
+	if tf.EnabledAt.Valid {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err = useOTP(ctx, tf, otp); err != nil {
+		return nil, err
+	}
+
+	hashed := make([]RecoveryCode, 0, config.Config.TwoFactor.RecoveryCodes)
+	for i := 0; i < config.Config.TwoFactor.RecoveryCodes; i++ {
+		code, err := genRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		salt, err := utils.CryptGenSalt()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := utils.CryptGenHash(normalizeRecoveryCode(code), salt)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashed = append(hashed, RecoveryCode{MemberID: member.ID, CodeHash: hash, Salt: salt})
+	}
+	if err = TwoFactorAPI.Enable(ctx, member.ID, hashed); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor removes secret and recovery codes of member, so it logs in with password only
+func DisableTwoFactor(ctx context.Context, member Member) error {
+	return TwoFactorAPI.Disable(ctx, member.ID)
+}
+
+// verifySecondFactor checks otp, or recovery code if otp is empty, for members with two-factor turned on.
+// Recovery codes work only once.
+func verifySecondFactor(ctx context.Context, member Member, otp string, recoveryCode string) error {
+
+	if !member.TwoFactorEnabled.Bool {
+		return nil
+	}
+	if otp == "" && recoveryCode == "" {
+		return ErrTwoFactorRequired
+	}
+
+	if otp != "" {
+		tf, err := TwoFactorAPI.GetTwoFactor(ctx, member.ID)
+		if err != nil {
+			return err
+		}
+		return useOTP(ctx, tf, otp)
+	}
+
+	codes, err := TwoFactorAPI.GetRecoveryCodes(ctx, member.ID)
+	if err != nil {
+		return err
+	}
+	recoveryCode = normalizeRecoveryCode(recoveryCode)
+	for _, code := range codes {
+		if ok, err := utils.CryptCompareHash(recoveryCode, code.Salt, code.CodeHash); err != nil {
+			return err
+		} else if ok {
+			if err = TwoFactorAPI.UseRecoveryCode(ctx, code.ID); err != nil {
+				if errors.Is(err, ErrRecoveryCodeNotFound) {
+					return ErrInvalidCode
+				}
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+// useOTP validates otp against secret of tf, and makes sure it hasn't been used
+func useOTP(ctx context.Context, tf TwoFactor, otp string) error {
+	step, ok := totp.Validate(tf.Secret, otp, time.Now(), config.Config.TwoFactor.Skew)
+	if !ok {
+		return ErrInvalidCode
+	}
+	if err := TwoFactorAPI.UseStep(ctx, tf.MemberID, step); err != nil {
+		if errors.Is(err, ErrCodeAlreadyUsed) {
+			return ErrInvalidCode
+		}
+		return err
+	}
+	return nil
+}
+
+// genRecoveryCode returns a random code like "k3xq-7mzp"
+func genRecoveryCode() (string, error) {
+	b := make([]byte, recovery_code_bytes)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,85 @@
+package member
+
+import (
+	"github.com/readr-media/readr-restful-member/internal/rrsql"
+)
+
+// fieldPolicy tells who could write a column of members
+type fieldPolicy int
+
+const (
+	// fieldSelf could be written by the member itself, or managers
+	fieldSelf fieldPolicy = iota
+	// fieldManager could be written only by callers with memberManage
+	fieldManager
+	// fieldImmutable is given once on creation and never updated
+	fieldImmutable
+	// fieldSystem is maintained by this service only, such as timestamps and credentials
+	fieldSystem
+)
+
+// memberFieldPolicy declares writability of every column of members.
+// Columns not listed are regarded as fieldSystem.
+var memberFieldPolicy = map[string]fieldPolicy{
+	"name":          fieldSelf,
+	"nickname":      fieldSelf,
+	"birthday":      fieldSelf,
+	"gender":        fieldSelf,
+	"work":          fieldSelf,
+	"mail":          fieldSelf,
+	"phone":         fieldSelf,
+	"talk_id":       fieldSelf,
+	"description":   fieldSelf,
+	"profile_image": fieldSelf,
+	"identity":      fieldSelf,
+	"hide_profile":  fieldSelf,
+	"profile_push":  fieldSelf,
+	"post_push":     fieldSelf,
+	"daily_push":    fieldSelf,
+	"comment_push":  fieldSelf,
+
+	"role":           fieldManager,
+	"active":         fieldManager,
+	"points":         fieldManager,
+	"premium_before": fieldManager,
+	"custom_editor":  fieldManager,
+
+	"member_id":     fieldImmutable,
+	"register_mode": fieldImmutable,
+	"social_id":     fieldImmutable,
+
+	"uuid":                fieldSystem,
+	"created_at":          fieldSystem,
+	"updated_at":          fieldSystem,
+	"updated_by":          fieldSystem,
+	"password":            fieldSystem,
+	"salt":                fieldSystem,
+	"password_changed_at": fieldSystem,
+	"two_factor_enabled":  fieldSystem,
+	"deleted_at":          fieldSystem,
+	"prev_active":         fieldSystem,
+	"anonymized_at":       fieldSystem,
+}
+
+// rejectedFields returns fields set in m which the caller couldn't write.
+// Immutable fields are writable only when creating is true. id is the key of updates, so it is rejected
+// only when given on creating, where ids are generated.
+func rejectedFields(m Member, manager bool, creating bool) (rejected []string) {
+	for _, field := range rrsql.GetStructDBTags("partial", m) {
+		if field == "id" && (!creating || m.ID == 0) {
+			continue
+		}
+		policy, ok := memberFieldPolicy[field]
+		if !ok {
+			policy = fieldSystem
+		}
+		switch {
+		case policy == fieldSelf:
+		case policy == fieldManager && manager:
+		case policy == fieldImmutable && creating:
+		default:
+			rejected = append(rejected, field)
+		}
+	}
+	return rejected
+}